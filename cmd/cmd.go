@@ -2,10 +2,12 @@ package cmd
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/dutchcoders/transfer.sh/server/storage"
 
@@ -83,6 +85,12 @@ var globalFlags = []cli.Flag{
 		Value:   os.TempDir(),
 		EnvVars: []string{"TEMP_PATH"},
 	},
+	&cli.Int64Flag{
+		Name:    "temp-path-min-free",
+		Usage:   "minimum free space to keep on temp-path, in megabytes",
+		Value:   0,
+		EnvVars: []string{"TEMP_PATH_MIN_FREE"},
+	},
 	&cli.StringFlag{
 		Name:    "web-path",
 		Usage:   "path to static web files",
@@ -165,6 +173,36 @@ var globalFlags = []cli.Flag{
 		Usage:   "Forces path style URLs, required for Minio.",
 		EnvVars: []string{"S3_PATH_STYLE"},
 	},
+	&cli.StringFlag{
+		Name:    "s3-sse",
+		Usage:   "server-side encryption for uploaded objects: s3|kms|c",
+		Value:   "",
+		EnvVars: []string{"S3_SSE"},
+	},
+	&cli.StringFlag{
+		Name:    "s3-sse-kms-key-id",
+		Usage:   "KMS key id for SSE-KMS, defaults to the AWS managed key",
+		Value:   "",
+		EnvVars: []string{"S3_SSE_KMS_KEY_ID"},
+	},
+	&cli.StringFlag{
+		Name:    "s3-sse-c-key",
+		Usage:   "base64 encoded 256-bit customer key for SSE-C",
+		Value:   "",
+		EnvVars: []string{"S3_SSE_C_KEY"},
+	},
+	&cli.StringFlag{
+		Name:    "s3-storage-class",
+		Usage:   "storage class for uploaded objects",
+		Value:   "",
+		EnvVars: []string{"S3_STORAGE_CLASS"},
+	},
+	&cli.StringFlag{
+		Name:    "s3-object-tags",
+		Usage:   "comma separated list of key=value tags for uploaded objects",
+		Value:   "",
+		EnvVars: []string{"S3_OBJECT_TAGS"},
+	},
 	&cli.StringFlag{
 		Name:    "gdrive-client-json-filepath",
 		Usage:   "",
@@ -183,6 +221,18 @@ var globalFlags = []cli.Flag{
 		Value:   googleapi.DefaultUploadChunkSize / 1024 / 1024,
 		EnvVars: []string{"GDRIVE_CHUNK_SIZE"},
 	},
+	&cli.StringFlag{
+		Name:    "gdrive-impersonate-user",
+		Usage:   "user a gdrive service account acts as, with domain-wide delegation",
+		Value:   "",
+		EnvVars: []string{"GDRIVE_IMPERSONATE_USER"},
+	},
+	&cli.StringFlag{
+		Name:    "gdrive-shared-drive-id",
+		Usage:   "id of the gdrive shared drive to store files in",
+		Value:   "",
+		EnvVars: []string{"GDRIVE_SHARED_DRIVE_ID"},
+	},
 	&cli.StringFlag{
 		Name:    "storj-access",
 		Usage:   "Access for the project",
@@ -195,6 +245,47 @@ var globalFlags = []cli.Flag{
 		Value:   "",
 		EnvVars: []string{"STORJ_BUCKET"},
 	},
+	&cli.BoolFlag{
+		Name:    "download-redirect",
+		Usage:   "redirect downloads to presigned storage URLs (s3 only)",
+		EnvVars: []string{"DOWNLOAD_REDIRECT"},
+	},
+	&cli.IntFlag{
+		Name:    "download-redirect-expiry",
+		Usage:   "validity of presigned download URLs, in seconds",
+		Value:   300,
+		EnvVars: []string{"DOWNLOAD_REDIRECT_EXPIRY"},
+	},
+	&cli.IntFlag{
+		Name:    "storage-timeout",
+		Usage:   "seconds a storage operation may stall before failing, 0 to disable",
+		Value:   0,
+		EnvVars: []string{"STORAGE_TIMEOUT"},
+	},
+	&cli.IntFlag{
+		Name:    "storage-retries",
+		Usage:   "number of retries for failed idempotent storage operations",
+		Value:   0,
+		EnvVars: []string{"STORAGE_RETRIES"},
+	},
+	&cli.IntFlag{
+		Name:    "storage-retry-backoff",
+		Usage:   "initial backoff between storage retries, in milliseconds",
+		Value:   200,
+		EnvVars: []string{"STORAGE_RETRY_BACKOFF"},
+	},
+	&cli.IntFlag{
+		Name:    "storage-breaker-threshold",
+		Usage:   "consecutive storage failures opening the circuit breaker, 0 to disable",
+		Value:   0,
+		EnvVars: []string{"STORAGE_BREAKER_THRESHOLD"},
+	},
+	&cli.IntFlag{
+		Name:    "storage-breaker-cooldown",
+		Usage:   "seconds the circuit breaker stays open before probing the storage again",
+		Value:   30,
+		EnvVars: []string{"STORAGE_BREAKER_COOLDOWN"},
+	},
 	&cli.IntFlag{
 		Name:    "rate-limit",
 		Usage:   "requests per minute",
@@ -213,6 +304,18 @@ var globalFlags = []cli.Flag{
 		Value:   0,
 		EnvVars: []string{"PURGE_INTERVAL"},
 	},
+	&cli.IntFlag{
+		Name:    "purge-high-watermark",
+		Usage:   "usage percentage of the local storage above which the purge evicts the oldest files",
+		Value:   0,
+		EnvVars: []string{"PURGE_HIGH_WATERMARK"},
+	},
+	&cli.IntFlag{
+		Name:    "purge-low-watermark",
+		Usage:   "usage percentage of the local storage the eviction frees space down to",
+		Value:   0,
+		EnvVars: []string{"PURGE_LOW_WATERMARK"},
+	},
 	&cli.Int64Flag{
 		Name:    "max-upload-size",
 		Usage:   "max limit for upload, in kilobytes",
@@ -237,6 +340,18 @@ var globalFlags = []cli.Flag{
 		Value:   "",
 		EnvVars: []string{"BASEDIR"},
 	},
+	&cli.Int64Flag{
+		Name:    "storage-quota",
+		Usage:   "max total size of the local storage, in megabytes",
+		Value:   0,
+		EnvVars: []string{"STORAGE_QUOTA"},
+	},
+	&cli.Int64Flag{
+		Name:    "basedir-min-free",
+		Usage:   "minimum free space to keep on basedir, in megabytes",
+		Value:   0,
+		EnvVars: []string{"BASEDIR_MIN_FREE"},
+	},
 	&cli.StringFlag{
 		Name:    "clamav-host",
 		Usage:   "clamav-host",
@@ -254,6 +369,42 @@ var globalFlags = []cli.Flag{
 		Value:   "",
 		EnvVars: []string{"VIRUSTOTAL_KEY"},
 	},
+	&cli.StringFlag{
+		Name:    "scanners",
+		Usage:   "comma separated scanners uploads have to pass: clamav, virustotal, yara or command",
+		Value:   "",
+		EnvVars: []string{"SCANNERS"},
+	},
+	&cli.IntFlag{
+		Name:    "scan-workers",
+		Usage:   "number of workers scanning uploads once stored, quarantined until they pass, instead of before storing them",
+		Value:   0,
+		EnvVars: []string{"SCAN_WORKERS"},
+	},
+	&cli.StringFlag{
+		Name:    "yara-rules",
+		Usage:   "path to the rules of the yara scanner",
+		Value:   "",
+		EnvVars: []string{"YARA_RULES"},
+	},
+	&cli.StringFlag{
+		Name:    "scan-command",
+		Usage:   "command of the command scanner, exiting with 1 for infected files given as last argument",
+		Value:   "",
+		EnvVars: []string{"SCAN_COMMAND"},
+	},
+	&cli.IntFlag{
+		Name:    "scan-timeout",
+		Usage:   "timeout in seconds of a scanner on a file",
+		Value:   60,
+		EnvVars: []string{"SCAN_TIMEOUT"},
+	},
+	&cli.IntFlag{
+		Name:    "clamav-pool-size",
+		Usage:   "number of idle clamd connections kept open",
+		Value:   4,
+		EnvVars: []string{"CLAMAV_POOL_SIZE"},
+	},
 	&cli.BoolFlag{
 		Name:    "profiler",
 		Usage:   "enable profiling",
@@ -307,6 +458,168 @@ var globalFlags = []cli.Flag{
 		Value:   10,
 		EnvVars: []string{"RANDOM_TOKEN_LENGTH"},
 	},
+	&cli.StringFlag{
+		Name:    "token-generator",
+		Usage:   "generator of upload tokens: base62, diceware or ulid",
+		Value:   "base62",
+		EnvVars: []string{"TOKEN_GENERATOR"},
+	},
+	&cli.IntFlag{
+		Name:    "token-words",
+		Usage:   "number of words of diceware tokens",
+		Value:   4,
+		EnvVars: []string{"TOKEN_WORDS"},
+	},
+	&cli.StringFlag{
+		Name:    "reserved-tokens",
+		Usage:   "comma separated list of tokens uploads cannot use",
+		Value:   "",
+		EnvVars: []string{"RESERVED_TOKENS"},
+	},
+	&cli.IntFlag{
+		Name:    "fetch-timeout",
+		Usage:   "timeout in seconds of server-side fetches of remote URLs",
+		Value:   300,
+		EnvVars: []string{"FETCH_TIMEOUT"},
+	},
+	&cli.IntFlag{
+		Name:    "fetch-max-redirects",
+		Usage:   "number of redirects server-side fetches follow",
+		Value:   5,
+		EnvVars: []string{"FETCH_MAX_REDIRECTS"},
+	},
+	&cli.StringFlag{
+		Name:    "fetch-allowlist",
+		Usage:   "comma separated hosts, IPs and CIDRs server-side fetches may reach despite being private or loopback",
+		Value:   "",
+		EnvVars: []string{"FETCH_ALLOWLIST"},
+	},
+	&cli.StringFlag{
+		Name:    "upload-policy",
+		Usage:   "path to a JSON upload policy with per-route and per-user rules",
+		Value:   "",
+		EnvVars: []string{"UPLOAD_POLICY"},
+	},
+	&cli.StringFlag{
+		Name:    "allowed-types",
+		Usage:   "comma separated content types, like image/*, uploads are restricted to",
+		Value:   "",
+		EnvVars: []string{"ALLOWED_TYPES"},
+	},
+	&cli.StringFlag{
+		Name:    "denied-types",
+		Usage:   "comma separated content types, like application/x-elf, uploads cannot have",
+		Value:   "",
+		EnvVars: []string{"DENIED_TYPES"},
+	},
+	&cli.StringFlag{
+		Name:    "allowed-extensions",
+		Usage:   "comma separated extensions uploads are restricted to",
+		Value:   "",
+		EnvVars: []string{"ALLOWED_EXTENSIONS"},
+	},
+	&cli.StringFlag{
+		Name:    "denied-extensions",
+		Usage:   "comma separated extensions uploads cannot have",
+		Value:   "",
+		EnvVars: []string{"DENIED_EXTENSIONS"},
+	},
+	&cli.DurationFlag{
+		Name:    "default-retention",
+		Usage:   "lifetime of files uploaded without Max-Days, Max-Hours, Max-Minutes or Expires, like 72h",
+		EnvVars: []string{"DEFAULT_RETENTION"},
+	},
+	&cli.DurationFlag{
+		Name:    "max-retention",
+		Usage:   "maximum lifetime of files, like 720h",
+		EnvVars: []string{"MAX_RETENTION"},
+	},
+	&cli.IntFlag{
+		Name:    "max-downloads",
+		Usage:   "maximum number of downloads of files",
+		Value:   0,
+		EnvVars: []string{"MAX_DOWNLOADS"},
+	},
+	&cli.IntFlag{
+		Name:    "keep-versions",
+		Usage:   "number of previous versions kept when owners upload new versions of files",
+		Value:   5,
+		EnvVars: []string{"KEEP_VERSIONS"},
+	},
+	&cli.DurationFlag{
+		Name:    "trash-retention",
+		Usage:   "keeps deleted files restorable in a trash for this long, like 72h",
+		EnvVars: []string{"TRASH_RETENTION"},
+	},
+	&cli.BoolFlag{
+		Name:    "burn-after-reading",
+		Usage:   "delete files once their last allowed download completed",
+		EnvVars: []string{"BURN_AFTER_READING"},
+	},
+	&cli.StringFlag{
+		Name:    "preview-bots",
+		Usage:   "comma separated regular expressions matching the User-Agent of link unfurlers, whose downloads are not counted, instead of the built-in list",
+		Value:   "",
+		EnvVars: []string{"PREVIEW_BOTS"},
+	},
+	&cli.StringFlag{
+		Name:    "admin-token",
+		Usage:   "token of admin requests, in the X-Admin-Token header",
+		Value:   "",
+		EnvVars: []string{"ADMIN_TOKEN"},
+	},
+	&cli.StringFlag{
+		Name:    "hash-blocklist",
+		Usage:   "path to the blocklist of SHA-256 of files which cannot be uploaded",
+		Value:   "",
+		EnvVars: []string{"HASH_BLOCKLIST"},
+	},
+	&cli.StringFlag{
+		Name:    "abuse-reports",
+		Usage:   "path to the file recording abuse reports",
+		Value:   "",
+		EnvVars: []string{"ABUSE_REPORTS"},
+	},
+	&cli.StringFlag{
+		Name:    "audit-log",
+		Usage:   "path to the file recording legal holds and their releases",
+		Value:   "",
+		EnvVars: []string{"AUDIT_LOG"},
+	},
+}
+
+// storageFlags are the global flags configuring the storage provider
+var storageFlags = map[string]bool{
+	"provider": true, "basedir": true, "purge-days": true,
+	"s3-endpoint": true, "s3-region": true, "aws-access-key": true, "aws-secret-key": true, "bucket": true,
+	"s3-no-multipart": true, "s3-path-style": true, "s3-sse": true, "s3-sse-kms-key-id": true, "s3-sse-c-key": true,
+	"s3-storage-class": true, "s3-object-tags": true,
+	"gdrive-client-json-filepath": true, "gdrive-local-config-path": true, "gdrive-chunk-size": true,
+	"gdrive-impersonate-user": true, "gdrive-shared-drive-id": true,
+	"storj-access": true, "storj-bucket": true,
+	"storage-quota": true, "basedir-min-free": true, "purge-high-watermark": true, "purge-low-watermark": true,
+}
+
+var migrateFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:     "from",
+		Usage:    "provider flags of the source storage, e.g. \"--provider local --basedir /data\"",
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:     "to",
+		Usage:    "provider flags of the destination storage, e.g. \"--provider s3 --bucket uploads ...\"",
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:  "state-file",
+		Usage: "file recording migrated uploads, to resume an interrupted migration",
+		Value: "transfersh-migrate.state",
+	},
+	&cli.BoolFlag{
+		Name:  "delete-source",
+		Usage: "delete uploads from the source once migrated and verified",
+	},
 }
 
 // Cmd wraps cli.app
@@ -319,6 +632,131 @@ func versionCommand(_ *cli.Context) error {
 	return nil
 }
 
+func s3ObjectOptions(c *cli.Context) storage.S3ObjectOptions {
+	return storage.S3ObjectOptions{
+		SSE:            c.String("s3-sse"),
+		SSEKMSKeyID:    c.String("s3-sse-kms-key-id"),
+		SSECustomerKey: c.String("s3-sse-c-key"),
+		StorageClass:   c.String("s3-storage-class"),
+		Tags:           c.String("s3-object-tags"),
+	}
+}
+
+func migrateCommand(logger *log.Logger) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		from, err := parseStorageFlags(c, "from", logger)
+		if err != nil {
+			return err
+		}
+
+		to, err := parseStorageFlags(c, "to", logger)
+		if err != nil {
+			return err
+		}
+
+		return server.Migrate(c.Context, from, to, c.String("state-file"), c.Bool("delete-source"), logger)
+	}
+}
+
+// parseStorageFlags creates the storage described by the provider flags in the named flag.
+// Environment variables are ignored, so the source and the destination don't mix.
+func parseStorageFlags(c *cli.Context, name string, logger *log.Logger) (storage.Storage, error) {
+	set := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	for _, f := range globalFlags {
+		if !storageFlags[f.Names()[0]] {
+			continue
+		}
+
+		var err error
+		switch f := f.(type) {
+		case *cli.StringFlag:
+			clone := *f
+			clone.EnvVars = nil
+			err = clone.Apply(set)
+		case *cli.BoolFlag:
+			clone := *f
+			clone.EnvVars = nil
+			err = clone.Apply(set)
+		case *cli.IntFlag:
+			clone := *f
+			clone.EnvVars = nil
+			err = clone.Apply(set)
+		case *cli.Int64Flag:
+			clone := *f
+			clone.EnvVars = nil
+			err = clone.Apply(set)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := set.Parse(strings.Fields(c.String(name))); err != nil {
+		return nil, fmt.Errorf("invalid --%s: %w", name, err)
+	}
+
+	store, err := newStorage(cli.NewContext(c.App, set, c), logger)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --%s: %w", name, err)
+	}
+
+	return store, nil
+}
+
+// newStorage creates the storage selected by the provider flags
+func newStorage(c *cli.Context, logger *log.Logger) (storage.Storage, error) {
+	switch provider := c.String("provider"); provider {
+	case "s3":
+		if accessKey := c.String("aws-access-key"); accessKey == "" {
+			return nil, errors.New("access-key not set.")
+		} else if secretKey := c.String("aws-secret-key"); secretKey == "" {
+			return nil, errors.New("secret-key not set.")
+		} else if bucket := c.String("bucket"); bucket == "" {
+			return nil, errors.New("bucket not set.")
+		} else if store, err := storage.NewS3Storage(c.Context, accessKey, secretKey, bucket, c.Int("purge-days"), c.String("s3-region"), c.String("s3-endpoint"), c.Bool("s3-no-multipart"), c.Bool("s3-path-style"), s3ObjectOptions(c), logger); err != nil {
+			return nil, err
+		} else {
+			return store, nil
+		}
+	case "gdrive":
+		chunkSize := c.Int("gdrive-chunk-size") * 1024 * 1024
+
+		if clientJSONFilepath := c.String("gdrive-client-json-filepath"); clientJSONFilepath == "" {
+			return nil, errors.New("gdrive-client-json-filepath not set.")
+		} else if localConfigPath := c.String("gdrive-local-config-path"); localConfigPath == "" {
+			return nil, errors.New("gdrive-local-config-path not set.")
+		} else if basedir := c.String("basedir"); basedir == "" {
+			return nil, errors.New("basedir not set.")
+		} else if store, err := storage.NewGDriveStorage(c.Context, clientJSONFilepath, localConfigPath, basedir, chunkSize, c.String("gdrive-impersonate-user"), c.String("gdrive-shared-drive-id"), logger); err != nil {
+			return nil, err
+		} else {
+			return store, nil
+		}
+	case "storj":
+		if access := c.String("storj-access"); access == "" {
+			return nil, errors.New("storj-access not set.")
+		} else if bucket := c.String("storj-bucket"); bucket == "" {
+			return nil, errors.New("storj-bucket not set.")
+		} else if store, err := storage.NewStorjStorage(c.Context, access, bucket, c.Int("purge-days"), logger); err != nil {
+			return nil, err
+		} else {
+			return store, nil
+		}
+	case "local":
+		if v := c.String("basedir"); v == "" {
+			return nil, errors.New("basedir not set.")
+		} else if store, err := storage.NewLocalStorage(v, uint64(c.Int64("storage-quota"))*1024*1024, uint64(c.Int64("basedir-min-free"))*1024*1024, c.Int("purge-high-watermark"), c.Int("purge-low-watermark"), logger); err != nil {
+			return nil, err
+		} else {
+			return store, nil
+		}
+	default:
+		return nil, errors.New("Provider not set or invalid.")
+	}
+}
+
 // New is the factory for transfer.sh
 func New() *Cmd {
 	logger := log.New(os.Stdout, "[transfer.sh]", log.LstdFlags)
@@ -336,6 +774,12 @@ func New() *Cmd {
 			Name:   "version",
 			Action: versionCommand,
 		},
+		{
+			Name:   "migrate",
+			Usage:  "migrate uploads between storage providers",
+			Flags:  migrateFlags,
+			Action: migrateCommand(logger),
+		},
 	}
 
 	app.Before = func(c *cli.Context) error {
@@ -391,6 +835,10 @@ func New() *Cmd {
 			options = append(options, server.TempPath(v))
 		}
 
+		if v := c.Int64("temp-path-min-free"); v > 0 {
+			options = append(options, server.TempPathMinFree(v))
+		}
+
 		if v := c.String("log"); v != "" {
 			options = append(options, server.LogFile(logger, v))
 		} else {
@@ -417,6 +865,53 @@ func New() *Cmd {
 			options = append(options, server.PerformClamavPrescan(v))
 		}
 
+		scanTimeout := time.Duration(c.Int("scan-timeout")) * time.Second
+		options = append(options, server.ScanTimeout(c.Int("scan-timeout")))
+
+		clamav := func() server.Scanner {
+			return server.NewClamAVScanner(c.String("clamav-host"), scanTimeout, c.Int("clamav-pool-size"))
+		}
+
+		if c.Bool("perform-clamav-prescan") && c.String("scanners") == "" {
+			options = append(options, server.UseScanners(clamav()))
+		}
+
+		if v := c.String("scanners"); v != "" {
+			var scanners []server.Scanner
+			for _, name := range strings.Split(v, ",") {
+				switch strings.TrimSpace(name) {
+				case "clamav":
+					if c.String("clamav-host") == "" {
+						return errors.New("clamav-host not set")
+					}
+					scanners = append(scanners, clamav())
+				case "virustotal":
+					if c.String("virustotal-key") == "" {
+						return errors.New("virustotal-key not set")
+					}
+					scanners = append(scanners, server.NewVirusTotalScanner(c.String("virustotal-key")))
+				case "yara":
+					if c.String("yara-rules") == "" {
+						return errors.New("yara-rules not set")
+					}
+					scanners = append(scanners, server.NewYARAScanner(c.String("yara-rules")))
+				case "command":
+					if c.String("scan-command") == "" {
+						return errors.New("scan-command not set")
+					}
+					scanners = append(scanners, server.NewCommandScanner(c.String("scan-command")))
+				default:
+					return fmt.Errorf("unknown scanner %q", name)
+				}
+			}
+
+			options = append(options, server.UseScanners(scanners...))
+		}
+
+		if v := c.Int("scan-workers"); v > 0 {
+			options = append(options, server.ScanAsync(v))
+		}
+
 		if v := c.Int64("max-upload-size"); v > 0 {
 			options = append(options, server.MaxUploadSize(v))
 		}
@@ -428,10 +923,95 @@ func New() *Cmd {
 		v := c.Int("random-token-length")
 		options = append(options, server.RandomTokenLength(v))
 
+		tokenSize := v
+		if c.String("token-generator") == "diceware" {
+			tokenSize = c.Int("token-words")
+		}
+
+		if generator, err := server.NewTokenGenerator(c.String("token-generator"), tokenSize); err != nil {
+			return err
+		} else {
+			options = append(options, server.UseTokenGenerator(generator))
+		}
+
+		if reservedTokens := c.String("reserved-tokens"); reservedTokens != "" {
+			options = append(options, server.ReservedTokens(strings.Split(reservedTokens, ",")))
+		}
+
+		var fetchAllowlist []string
+		if allowlist := c.String("fetch-allowlist"); allowlist != "" {
+			fetchAllowlist = strings.Split(allowlist, ",")
+		}
+		options = append(options, server.Fetch(c.Int("fetch-timeout"), c.Int("fetch-max-redirects"), fetchAllowlist))
+
+		var uploadPolicy server.UploadPolicy
+		if policyPath := c.String("upload-policy"); policyPath != "" {
+			policy, err := server.LoadUploadPolicy(policyPath)
+			if err != nil {
+				return err
+			}
+			uploadPolicy = policy
+		}
+
+		for flag, list := range map[string]*[]string{
+			"allowed-types":      &uploadPolicy.AllowedTypes,
+			"denied-types":       &uploadPolicy.DeniedTypes,
+			"allowed-extensions": &uploadPolicy.AllowedExtensions,
+			"denied-extensions":  &uploadPolicy.DeniedExtensions,
+		} {
+			if v := c.String(flag); v != "" {
+				*list = strings.Split(v, ",")
+			}
+		}
+		options = append(options, server.UseUploadPolicy(uploadPolicy))
+
+		if c.Duration("default-retention") > 0 || c.Duration("max-retention") > 0 {
+			options = append(options, server.Retention(c.Duration("default-retention"), c.Duration("max-retention")))
+		}
+
+		if v := c.Int("max-downloads"); v > 0 {
+			options = append(options, server.MaxDownloads(v))
+		}
+
+		if v := c.Int("keep-versions"); v > 0 {
+			options = append(options, server.KeepVersions(v))
+		}
+
+		if v := c.Duration("trash-retention"); v > 0 {
+			options = append(options, server.TrashRetention(v))
+		}
+
+		if c.Bool("burn-after-reading") {
+			options = append(options, server.BurnAfterReading())
+		}
+
+		if v := c.String("preview-bots"); v != "" {
+			options = append(options, server.PreviewBots(strings.Split(v, ",")))
+		}
+
+		if v := c.String("admin-token"); v != "" {
+			options = append(options, server.AdminToken(v))
+		}
+
+		if v := c.String("hash-blocklist"); v != "" {
+			options = append(options, server.HashBlocklist(v))
+		}
+
+		if v := c.String("abuse-reports"); v != "" {
+			options = append(options, server.AbuseReports(v))
+		}
+
+		if v := c.String("audit-log"); v != "" {
+			options = append(options, server.AuditLog(v))
+		}
+
 		purgeDays := c.Int("purge-days")
 		purgeInterval := c.Int("purge-interval")
+		purgeHighWatermark := c.Int("purge-high-watermark")
 		if purgeDays > 0 && purgeInterval > 0 {
 			options = append(options, server.Purge(purgeDays, purgeInterval))
+		} else if (purgeHighWatermark > 0 || c.Duration("trash-retention") > 0) && purgeInterval > 0 {
+			options = append(options, server.Purge(0, purgeInterval))
 		}
 
 		if cert := c.String("tls-cert-file"); cert == "" {
@@ -440,6 +1020,10 @@ func New() *Cmd {
 			options = append(options, server.TLSConfig(cert, pk))
 		}
 
+		if c.Bool("download-redirect") {
+			options = append(options, server.DownloadRedirect(c.Int("download-redirect-expiry")))
+		}
+
 		if c.Bool("profiler") {
 			options = append(options, server.EnableProfiler())
 		}
@@ -482,55 +1066,25 @@ func New() *Cmd {
 			options = append(options, server.FilterOptions(ipFilterOptions))
 		}
 
-		switch provider := c.String("provider"); provider {
-		case "s3":
-			if accessKey := c.String("aws-access-key"); accessKey == "" {
-				return errors.New("access-key not set.")
-			} else if secretKey := c.String("aws-secret-key"); secretKey == "" {
-				return errors.New("secret-key not set.")
-			} else if bucket := c.String("bucket"); bucket == "" {
-				return errors.New("bucket not set.")
-			} else if store, err := storage.NewS3Storage(c.Context, accessKey, secretKey, bucket, purgeDays, c.String("s3-region"), c.String("s3-endpoint"), c.Bool("s3-no-multipart"), c.Bool("s3-path-style"), logger); err != nil {
-				return err
-			} else {
-				options = append(options, server.UseStorage(store))
-			}
-		case "gdrive":
-			chunkSize := c.Int("gdrive-chunk-size") * 1024 * 1024
-
-			if clientJSONFilepath := c.String("gdrive-client-json-filepath"); clientJSONFilepath == "" {
-				return errors.New("gdrive-client-json-filepath not set.")
-			} else if localConfigPath := c.String("gdrive-local-config-path"); localConfigPath == "" {
-				return errors.New("gdrive-local-config-path not set.")
-			} else if basedir := c.String("basedir"); basedir == "" {
-				return errors.New("basedir not set.")
-			} else if store, err := storage.NewGDriveStorage(c.Context, clientJSONFilepath, localConfigPath, basedir, chunkSize, logger); err != nil {
-				return err
-			} else {
-				options = append(options, server.UseStorage(store))
-			}
-		case "storj":
-			if access := c.String("storj-access"); access == "" {
-				return errors.New("storj-access not set.")
-			} else if bucket := c.String("storj-bucket"); bucket == "" {
-				return errors.New("storj-bucket not set.")
-			} else if store, err := storage.NewStorjStorage(c.Context, access, bucket, purgeDays, logger); err != nil {
-				return err
-			} else {
-				options = append(options, server.UseStorage(store))
-			}
-		case "local":
-			if v := c.String("basedir"); v == "" {
-				return errors.New("basedir not set.")
-			} else if store, err := storage.NewLocalStorage(v, logger); err != nil {
-				return err
-			} else {
-				options = append(options, server.UseStorage(store))
-			}
-		default:
-			return errors.New("Provider not set or invalid.")
+		store, err := newStorage(c, logger)
+		if err != nil {
+			return err
 		}
 
+		if c.Int("storage-timeout") > 0 || c.Int("storage-retries") > 0 || c.Int("storage-breaker-threshold") > 0 {
+			store = storage.NewResilientStorage(
+				store,
+				time.Duration(c.Int("storage-timeout"))*time.Second,
+				c.Int("storage-retries"),
+				time.Duration(c.Int("storage-retry-backoff"))*time.Millisecond,
+				c.Int("storage-breaker-threshold"),
+				time.Duration(c.Int("storage-breaker-cooldown"))*time.Second,
+				logger,
+			)
+		}
+
+		options = append(options, server.UseStorage(store))
+
 		srvr, err := server.New(
 			options...,
 		)
@@ -0,0 +1,529 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxAbuseReportSize bounds the reason of an abuse report
+const maxAbuseReportSize = 8 << 10
+
+// maxAbuseReportsFileSize is the size past which the abuse reports file is rotated,
+// to the next free numbered file, as no report is discarded before the admin handled it
+const maxAbuseReportsFileSize = 16 << 20
+
+// abuseReportsPerMinute is the number of reports accepted from each IP address per minute
+const abuseReportsPerMinute = 5
+
+// errBlockedHash is returned for uploads whose SHA-256 is on the blocklist
+var errBlockedHash = errors.New("file is blocked")
+
+// hashBlocklist is the persistent list of SHA-256 of files taken down or imported
+// from external lists. Its file holds one hash per line, in the import format.
+type hashBlocklist struct {
+	path string
+
+	mutex  sync.RWMutex
+	hashes map[string]struct{}
+}
+
+// loadHashBlocklist reads the blocklist at path, which is created on the first takedown
+func loadHashBlocklist(path string) (*hashBlocklist, error) {
+	b := &hashBlocklist{path: path, hashes: map[string]struct{}{}}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes, err := parseHashList(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blocklist %s: %w", path, err)
+	}
+
+	for _, h := range hashes {
+		b.hashes[h] = struct{}{}
+	}
+
+	return b, nil
+}
+
+// parseHashList reads the SHA-256 hashes of a list, taking the first field of 64
+// hexadecimal characters of every line. This covers plain lists, sha256sum output
+// and CSV exports of malware databases. Empty lines, comments starting with # and
+// lines without such field, like CSV headers, are skipped.
+func parseHashList(reader io.Reader) ([]string, error) {
+	var hashes []string
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ',' || r == ';' || r == '"' || r == '\''
+		})
+
+		for _, field := range fields {
+			if isSHA256(field) {
+				hashes = append(hashes, strings.ToLower(field))
+				break
+			}
+		}
+	}
+
+	return hashes, scanner.Err()
+}
+
+func isSHA256(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// active indicates if uploads have to be hashed against the blocklist
+func (b *hashBlocklist) active() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return len(b.hashes) > 0
+}
+
+func (b *hashBlocklist) contains(hash string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	_, ok := b.hashes[hash]
+	return ok
+}
+
+// add appends the hashes not yet blocked to the blocklist, with a note, and
+// returns how many were added
+func (b *hashBlocklist) add(note string, hashes ...string) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var lines strings.Builder
+	added := map[string]struct{}{}
+	for _, h := range hashes {
+		if _, ok := b.hashes[h]; ok {
+			continue
+		} else if _, ok := added[h]; ok {
+			continue
+		}
+
+		added[h] = struct{}{}
+		fmt.Fprintf(&lines, "%s  %s\n", h, note)
+	}
+
+	if len(added) == 0 {
+		return 0, nil
+	}
+
+	file, err := os.OpenFile(b.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = file.WriteString(lines.String()); err != nil {
+		_ = file.Close()
+		return 0, err
+	}
+
+	if err = file.Close(); err != nil {
+		return 0, err
+	}
+
+	for h := range added {
+		b.hashes[h] = struct{}{}
+	}
+
+	return len(added), nil
+}
+
+// uploadHasher returns the hash computing the SHA-256 of an upload when the blocklist
+// is active or the upload is encrypted, whose stored content cannot be blocked, nil otherwise
+func (s *Server) uploadHasher(encrypted bool) hash.Hash {
+	if !s.blocklist.active() && !encrypted {
+		return nil
+	}
+
+	return sha256.New()
+}
+
+// checkBlocklist returns errBlockedHash if the upload hashed by h is blocked
+func (s *Server) checkBlocklist(h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); s.blocklist.contains(sum) {
+		return fmt.Errorf("%w: %s", errBlockedHash, sum)
+	}
+
+	return nil
+}
+
+// blockedError writes the response for an upload on the blocklist
+func (s *Server) blockedError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errBlockedHash) {
+		s.logger.Printf("Upload rejected: %s", err.Error())
+		http.Error(w, "File is blocked", http.StatusForbidden)
+		return
+	}
+
+	s.logger.Printf("%s", err.Error())
+	http.Error(w, "Could not check file", http.StatusInternalServerError)
+}
+
+// abuseReport is a report of a file violating the terms of the service
+type abuseReport struct {
+	Token      string
+	Filename   string
+	Reason     string
+	RemoteAddr string
+	Time       time.Time
+}
+
+// abuseReportHandler records a report of abuse of a file, to be reviewed by the admin
+func (s *Server) abuseReportHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	token := vars["token"]
+	filename := sanitize(vars["filename"])
+
+	if _, err := s.storage.Head(r.Context(), token, filename); s.storage.IsNotExist(err) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("%s", err.Error())
+		http.Error(w, "Could not report file", http.StatusInternalServerError)
+		return
+	}
+
+	reason, err := io.ReadAll(io.LimitReader(r.Body, maxAbuseReportSize))
+	if err != nil {
+		http.Error(w, "Could not read report", http.StatusBadRequest)
+		return
+	}
+
+	report := abuseReport{
+		Token:      token,
+		Filename:   filename,
+		Reason:     strings.TrimSpace(string(reason)),
+		RemoteAddr: ipAddrFromRemoteAddr(r.RemoteAddr),
+		Time:       time.Now().UTC(),
+	}
+
+	if err = s.recordAbuseReport(report); err != nil {
+		s.logger.Printf("Error recording abuse report: %s", err.Error())
+		http.Error(w, "Could not report file", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Printf("Abuse reported for %s/%s: %q", token, filename, report.Reason)
+
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = fmt.Fprintln(w, "Report received")
+}
+
+// recordAbuseReport appends report to the abuse reports file, as a JSON line
+func (s *Server) recordAbuseReport(report abuseReport) error {
+	return appendJSONLine(s.abuseReportsPath, &s.abuseReportsMutex, maxAbuseReportsFileSize, report)
+}
+
+// appendJSONLine appends v to the file at path as a JSON line, doing nothing without a path.
+// With a maxSize the file is first rotated to the next of path.1, path.2, ... not taken
+// when the line would grow it past maxSize.
+func appendJSONLine(path string, mutex *sync.Mutex, maxSize int64, v any) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if maxSize > 0 {
+		if fi, err := os.Stat(path); err == nil && fi.Size()+int64(len(data))+1 > maxSize {
+			if err = os.Rename(path, fmt.Sprintf("%s.%d", path, len(rotatedFiles(path))+1)); err != nil {
+				return err
+			}
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// rotatedFiles returns the files path was rotated to by appendJSONLine, oldest first
+func rotatedFiles(path string) []string {
+	var paths []string
+	for i := 1; ; i++ {
+		rotated := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(rotated); err != nil {
+			return paths
+		}
+
+		paths = append(paths, rotated)
+	}
+}
+
+// adminHandler only lets requests carrying the admin token through
+func (s *Server) adminHandler(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminToken := r.Header.Get("X-Admin-Token")
+		if s.adminToken == "" || subtle.ConstantTimeCompare([]byte(adminToken), []byte(s.adminToken)) != 1 {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}
+}
+
+// abuseReportsHandler lists the abuse reports, as JSON lines
+func (s *Server) abuseReportsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.abuseReportsPath == "" {
+		http.Error(w, "Abuse reports not recorded", http.StatusNotImplemented)
+		return
+	}
+
+	// the files are opened and sized under the lock, but streamed without it: a
+	// rotation only renames them and appends past the size are not read
+	s.abuseReportsMutex.Lock()
+	var readers []io.Reader
+	for _, path := range append(rotatedFiles(s.abuseReportsPath), s.abuseReportsPath) {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			s.abuseReportsMutex.Unlock()
+			s.logger.Printf("%s", err.Error())
+			http.Error(w, "Could not read abuse reports", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		fi, err := file.Stat()
+		if err != nil {
+			s.abuseReportsMutex.Unlock()
+			s.logger.Printf("%s", err.Error())
+			http.Error(w, "Could not read abuse reports", http.StatusInternalServerError)
+			return
+		}
+
+		readers = append(readers, io.LimitReader(file, fi.Size()))
+	}
+	s.abuseReportsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	_, _ = io.Copy(w, io.MultiReader(readers...))
+}
+
+// uploadedHashes returns the SHA-256 of the content uploaded as a file and as each of
+// its previous versions, which for encrypted content is the one recorded at upload time.
+// Encrypted content uploaded before hashes were recorded is left out.
+func (s *Server) uploadedHashes(ctx context.Context, token, filename string) ([]string, error) {
+	m, err := s.readMetadata(ctx, token, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+	for _, v := range append(m.Versions, m.asVersion()) {
+		object := filename
+		if v.Version != m.currentVersion() {
+			object = versionObject(filename, v.Version)
+		}
+
+		sum := v.SHA256
+		if sum == "" && !v.Encrypted {
+			sum, err = s.storedFileHash(ctx, token, object)
+			if s.storage.IsNotExist(err) && object != filename {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		if sum == "" {
+			s.logger.Printf("Version %d of %s/%s cannot be blocked, its content was encrypted before hashes were recorded", v.Version, token, filename)
+			continue
+		}
+
+		hashes = append(hashes, sum)
+	}
+
+	return hashes, nil
+}
+
+// takedownHandler deletes a file and blocks the SHA-256 of its content and of its
+// previous versions, so none of them can be uploaded again
+func (s *Server) takedownHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	token := vars["token"]
+	filename := sanitize(vars["filename"])
+
+	if s.blocklist == nil {
+		http.Error(w, "Blocklist not configured", http.StatusNotImplemented)
+		return
+	}
+
+	hashes, err := s.uploadedHashes(r.Context(), token, filename)
+	if s.storage.IsNotExist(err) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("%s", err.Error())
+		http.Error(w, "Could not read file", http.StatusInternalServerError)
+		return
+	}
+
+	note := fmt.Sprintf("takedown of %s/%s on %s", token, filename, time.Now().UTC().Format(time.RFC3339))
+	if _, err = s.blocklist.add(note, hashes...); err != nil {
+		s.logger.Printf("Error adding to blocklist: %s", err.Error())
+		http.Error(w, "Could not block file", http.StatusInternalServerError)
+		return
+	}
+
+	s.lock(token, filename)
+	err = s.deleteFile(r.Context(), token, filename)
+	s.unlock(token, filename)
+
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if legalHoldError(w, err) {
+		return
+	} else if err != nil && !s.storage.IsNotExist(err) {
+		s.logger.Printf("%s", err.Error())
+		http.Error(w, "Could not delete file", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Printf("Took down %s/%s: %s", token, filename, strings.Join(hashes, ", "))
+
+	for _, sum := range hashes {
+		_, _ = fmt.Fprintln(w, sum)
+	}
+}
+
+// blocklistImportHandler adds the hashes of a list in the import format to the blocklist
+func (s *Server) blocklistImportHandler(w http.ResponseWriter, r *http.Request) {
+	if s.blocklist == nil {
+		http.Error(w, "Blocklist not configured", http.StatusNotImplemented)
+		return
+	}
+
+	hashes, err := parseHashList(r.Body)
+	if err != nil {
+		http.Error(w, "Could not read hash list", http.StatusBadRequest)
+		return
+	}
+
+	note := "imported on " + time.Now().UTC().Format(time.RFC3339)
+	if source := r.URL.Query().Get("source"); source != "" {
+		note = fmt.Sprintf("imported from %s on %s", source, time.Now().UTC().Format(time.RFC3339))
+	}
+
+	added, err := s.blocklist.add(note, hashes...)
+	if err != nil {
+		s.logger.Printf("Error adding to blocklist: %s", err.Error())
+		http.Error(w, "Could not import hash list", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Printf("Imported %d hashes to the blocklist", added)
+
+	_, _ = fmt.Fprintf(w, "%d hashes added\n", added)
+}
+
+// blockUpload hashes reader and checks it against the blocklist
+func (s *Server) blockUpload(reader io.Reader) error {
+	h := s.uploadHasher(false)
+	if h == nil {
+		return nil
+	}
+
+	if _, err := io.Copy(h, reader); err != nil {
+		return err
+	}
+
+	return s.checkBlocklist(h)
+}
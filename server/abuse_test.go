@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+func TestParseHashList(t *testing.T) {
+	const (
+		a = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		b = "9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08"
+	)
+
+	list := strings.Join([]string{
+		"# exported list",
+		"",
+		a,
+		b + "  eicar.com",
+		`"first_seen_utc","sha256_hash","md5_hash"`,
+		`"2024-01-01 00:00:00","` + a + `","44d88612fea8a8f36de82e1278abb02f"`,
+		"not a hash",
+	}, "\n")
+
+	hashes, err := parseHashList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{a, strings.ToLower(b), a}; !reflect.DeepEqual(hashes, want) {
+		t.Errorf("parseHashList() = %v, want %v", hashes, want)
+	}
+}
+
+func TestAppendJSONLineKeepsRotatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports")
+
+	var mutex sync.Mutex
+	for i := 0; i < 4; i++ {
+		if err := appendJSONLine(path, &mutex, 16, fmt.Sprintf("report %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lines []string
+	for _, p := range append(rotatedFiles(path), path) {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines = append(lines, strings.TrimSpace(string(data)))
+	}
+
+	if want := []string{`"report 0"`, `"report 1"`, `"report 2"`, `"report 3"`}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("reports = %v, want %v", lines, want)
+	}
+}
+
+type suiteAbuse struct {
+	srvr *Server
+}
+
+func (s *suiteAbuse) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	dir := c.MkDir()
+	s.srvr, err = New(UseStorage(local), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10), KeepVersions(5),
+		HashBlocklist(filepath.Join(dir, "blocklist")), AbuseReports(filepath.Join(dir, "reports")))
+	c.Assert(err, IsNil)
+}
+
+// put uploads content as hello.txt, returning the route variables of its deletion URL
+func (s *suiteAbuse) put(c *C, content string) (*httptest.ResponseRecorder, map[string]string) {
+	req := httptest.NewRequest("PUT", "http://test/hello.txt", strings.NewReader(content))
+
+	w := httptest.NewRecorder()
+	s.srvr.putHandler(w, mux.SetURLVars(req, map[string]string{"filename": "hello.txt"}))
+	if w.Code != http.StatusOK {
+		return w, nil
+	}
+
+	u, err := url.Parse(w.Header().Get("X-Url-Delete"))
+	c.Assert(err, IsNil)
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	c.Assert(parts, HasLen, 3)
+
+	return w, map[string]string{"token": parts[0], "filename": parts[1], "deletionToken": parts[2]}
+}
+
+func (s *suiteAbuse) TestTakedownBlocksVersions(c *C) {
+	_, vars := s.put(c, "one")
+
+	req := httptest.NewRequest("PUT", "http://test/", strings.NewReader("two"))
+	w := httptest.NewRecorder()
+	s.srvr.versionHandler(w, mux.SetURLVars(req, vars))
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	w = httptest.NewRecorder()
+	s.srvr.takedownHandler(w, mux.SetURLVars(httptest.NewRequest("POST", "http://test/", nil), vars))
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+
+	for _, content := range []string{"one", "two"} {
+		sum := sha256.Sum256([]byte(content))
+		c.Assert(s.srvr.blocklist.contains(hex.EncodeToString(sum[:])), Equals, true, Commentf("%s", content))
+
+		w, _ = s.put(c, content)
+		c.Assert(w.Code, Equals, http.StatusForbidden, Commentf("%s", content))
+	}
+}
+
+func (s *suiteAbuse) TestReportsLimitedByIP(c *C) {
+	_, vars := s.put(c, "one")
+
+	handler := limitByIP(abuseReportsPerMinute, http.HandlerFunc(s.srvr.abuseReportHandler))
+	report := func(remoteAddr string) int {
+		req := httptest.NewRequest("POST", "http://test/", strings.NewReader("phishing"))
+		req.RemoteAddr = remoteAddr
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, mux.SetURLVars(req, vars))
+
+		return w.Code
+	}
+
+	for i := 0; i < abuseReportsPerMinute; i++ {
+		c.Assert(report("192.0.2.1:1234"), Equals, http.StatusAccepted)
+	}
+
+	c.Assert(report("192.0.2.1:1234"), Equals, http.StatusTooManyRequests)
+	c.Assert(report("192.0.2.2:1234"), Equals, http.StatusAccepted)
+}
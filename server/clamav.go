@@ -27,18 +27,22 @@ THE SOFTWARE.
 package server
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/dutchcoders/go-clamd"
 	"github.com/gorilla/mux"
-)
 
-const clamavScanStatusOK = "OK"
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
 
 func (s *Server) scanHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -50,6 +54,16 @@ func (s *Server) scanHandler(w http.ResponseWriter, r *http.Request) {
 
 	s.logger.Printf("Scanning %s %d %s", filename, contentLength, contentType)
 
+	scanners := s.scanners
+	if len(scanners) == 0 && s.ClamAVDaemonHost != "" {
+		scanners = []Scanner{NewClamAVScanner(s.ClamAVDaemonHost, s.scanTimeout, 0)}
+	}
+
+	if len(scanners) == 0 {
+		http.Error(w, "No scanner configured", http.StatusNotImplemented)
+		return
+	}
+
 	file, err := os.CreateTemp(s.tempPath, "clamav-")
 	defer s.cleanTmpFile(file)
 	if err != nil {
@@ -65,38 +79,241 @@ func (s *Server) scanHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	status, err := s.performScan(file.Name())
+	status, results := s.scanFile(r.Context(), scanners, file.Name())
+
+	_, _ = fmt.Fprintf(w, "%s\n", status)
+	for _, result := range results {
+		_, _ = fmt.Fprintf(w, "%s: %s %s\n", result.Scanner, result.Status, result.Detection)
+	}
+}
+
+// clamdChunkSize is the size of the chunks streamed to clamd
+const clamdChunkSize = 64 * 1024
+
+// clamdIdleTimeout discards pooled sessions before clamd closes them after its
+// default IdleTimeout of 30 seconds
+const clamdIdleTimeout = 20 * time.Second
+
+// defaultClamdPoolSize is the number of idle clamd sessions kept by default
+const defaultClamdPoolSize = 4
+
+// errClamdSizeLimit is returned when a file exceeds the StreamMaxLength of clamd, as
+// clamd is not expected to share the filesystem to read larger files itself
+var errClamdSizeLimit = errors.New("file exceeds the StreamMaxLength of clamd, raise it in clamd.conf up to the max-upload-size")
+
+// clamavScanner streams files to a clamd daemon with the INSTREAM command, so
+// clamd does not need to share the filesystem, reusing connections as sessions
+type clamavScanner struct {
+	network string
+	address string
+	timeout time.Duration
+	idle    chan *clamdConn
+}
+
+// clamdConn is a connection to clamd in session mode
+type clamdConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	lastUsed time.Time
+}
+
+// NewClamAVScanner returns a scanner using the clamd daemon at host, either
+// tcp://host:port, unix:///path/to/socket, host:port or /path/to/socket. Reads and
+// writes to clamd fail after timeout and up to poolSize idle connections are kept.
+func NewClamAVScanner(host string, timeout time.Duration, poolSize int) Scanner {
+	network, address := "tcp", host
+	if strings.HasPrefix(host, "unix://") {
+		network, address = "unix", strings.TrimPrefix(host, "unix://")
+	} else if strings.HasPrefix(host, "tcp://") {
+		address = strings.TrimPrefix(host, "tcp://")
+	} else if strings.HasPrefix(host, "/") {
+		network = "unix"
+	}
+
+	if timeout <= 0 {
+		timeout = defaultScanTimeout
+	}
+
+	return &clamavScanner{
+		network: network,
+		address: address,
+		timeout: timeout,
+		idle:    make(chan *clamdConn, poolSize),
+	}
+}
+
+// Name identifies the scanner in scan results
+func (c *clamavScanner) Name() string {
+	return "clamav"
+}
+
+// Scan streams the file at path to clamd
+func (c *clamavScanner) Scan(ctx context.Context, path string) (string, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		s.logger.Printf("%s", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return "", err
+	}
+	defer storage.CloseCheck(file)
+
+	return c.ScanStream(ctx, file)
+}
+
+// ScanStream streams the content read from reader to clamd
+func (c *clamavScanner) ScanStream(ctx context.Context, reader io.Reader) (string, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return "", fmt.Errorf("clamav: %w", err)
 	}
 
-	_, _ = w.Write([]byte(fmt.Sprintf("%v\n", status)))
+	healthy := false
+	defer func() {
+		c.release(conn, healthy)
+	}()
+
+	// unblock reads and writes when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	detection, err := c.instream(conn, reader)
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("clamav scan timeout: %w", ctx.Err())
+	} else if err != nil {
+		return "", fmt.Errorf("clamav: %w", err)
+	}
+
+	healthy = true
+	return detection, nil
 }
 
-func (s *Server) performScan(path string) (string, error) {
-	c := clamd.NewClamd(s.ClamAVDaemonHost)
+func (c *clamavScanner) instream(conn *clamdConn, reader io.Reader) (string, error) {
+	write := func(p []byte) error {
+		if err := conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+			return err
+		}
 
-	responseCh := make(chan chan *clamd.ScanResult)
-	errCh := make(chan error)
-	go func(responseCh chan chan *clamd.ScanResult, errCh chan error) {
-		response, err := c.ScanFile(path)
-		if err != nil {
-			errCh <- err
-			return
+		_, err := conn.Write(p)
+		return err
+	}
+
+	if err := write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := reader.Read(chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			if err := write(chunk[:4+n]); err != nil {
+				return "", c.writeError(conn, err)
+			}
 		}
 
-		responseCh <- response
-	}(responseCh, errCh)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	if err := write([]byte{0, 0, 0, 0}); err != nil {
+		return "", c.writeError(conn, err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return "", err
+	}
 
-	select {
-	case err := <-errCh:
+	reply, err := conn.reader.ReadString(0)
+	if err != nil {
 		return "", err
-	case response := <-responseCh:
-		st := <-response
-		return st.Status, nil
-	case <-time.After(time.Second * 60):
-		return "", errors.New("clamav scan timeout")
 	}
+
+	// replies in sessions are prefixed with the request number, as in "1: stream: OK"
+	reply = strings.TrimSuffix(reply, "\x00")
+	if _, rest, ok := strings.Cut(reply, ": "); ok {
+		reply = strings.TrimPrefix(rest, "stream: ")
+	}
+
+	return parseClamdReply(reply)
+}
+
+// writeError returns the reason clamd gave for closing the stream, when it did
+func (c *clamavScanner) writeError(conn *clamdConn, err error) error {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if reply, readErr := conn.reader.ReadString(0); readErr == nil && strings.Contains(reply, "size limit exceeded") {
+		return errClamdSizeLimit
+	}
+
+	return err
+}
+
+// parseClamdReply returns what clamd detected from its reply, as in "OK" or "Eicar-Signature FOUND"
+func parseClamdReply(reply string) (string, error) {
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return "", errClamdSizeLimit
+	}
+
+	return "", errors.New(reply)
+}
+
+// conn returns an idle session, or a new one
+func (c *clamavScanner) conn(ctx context.Context) (*clamdConn, error) {
+	for {
+		select {
+		case conn := <-c.idle:
+			if time.Since(conn.lastUsed) < clamdIdleTimeout {
+				return conn, nil
+			}
+
+			storage.CloseCheck(conn)
+			continue
+		default:
+		}
+
+		break
+	}
+
+	dialer := net.Dialer{Timeout: c.timeout}
+	netConn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &clamdConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	if err = conn.SetWriteDeadline(time.Now().Add(c.timeout)); err == nil {
+		_, err = conn.Write([]byte("zIDSESSION\x00"))
+	}
+
+	if err != nil {
+		storage.CloseCheck(conn)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// release returns a healthy session to the pool, closing it when the pool is full
+func (c *clamavScanner) release(conn *clamdConn, healthy bool) {
+	if healthy {
+		conn.lastUsed = time.Now()
+		_ = conn.SetDeadline(time.Time{})
+
+		select {
+		case c.idle <- conn:
+			return
+		default:
+		}
+
+		_, _ = conn.Write([]byte("zEND\x00"))
+	}
+
+	storage.CloseCheck(conn)
 }
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClamd serves the clamd session commands used by clamavScanner, detecting streams
+// containing EICAR and refusing streams over maxLength
+func fakeClamd(t *testing.T, maxLength int) (string, *atomic.Int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			conns.Add(1)
+			go serveClamdSession(conn, maxLength)
+		}
+	}()
+
+	return "tcp://" + listener.Addr().String(), &conns
+}
+
+func serveClamdSession(conn net.Conn, maxLength int) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for request := 0; ; {
+		command, err := reader.ReadString(0)
+		if err != nil {
+			return
+		}
+
+		switch command {
+		case "zIDSESSION\x00":
+			continue
+		case "zINSTREAM\x00":
+			request++
+		default:
+			return
+		}
+
+		var stream bytes.Buffer
+		for {
+			var length uint32
+			if err = binary.Read(reader, binary.BigEndian, &length); err != nil {
+				return
+			} else if length == 0 {
+				break
+			}
+
+			if stream.Len()+int(length) > maxLength {
+				_, _ = fmt.Fprintf(conn, "%d: INSTREAM size limit exceeded. ERROR\x00", request)
+				return
+			}
+
+			if _, err = io.CopyN(&stream, reader, int64(length)); err != nil {
+				return
+			}
+		}
+
+		reply := "OK"
+		if strings.Contains(stream.String(), "EICAR") {
+			reply = "Eicar-Signature FOUND"
+		}
+
+		_, _ = fmt.Fprintf(conn, "%d: stream: %s\x00", request, reply)
+	}
+}
+
+func TestClamAVScanner(t *testing.T) {
+	host, conns := fakeClamd(t, 1024)
+	scanner := NewClamAVScanner(host, time.Second, 1).(*clamavScanner)
+
+	for content, want := range map[string]string{"hello": "", "hello EICAR": "Eicar-Signature"} {
+		detection, err := scanner.ScanStream(context.Background(), strings.NewReader(content))
+		if err != nil || detection != want {
+			t.Errorf("ScanStream(%q) = %q, %v, want %q", content, detection, err, want)
+		}
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d connections to clamd, want the session to be reused", n)
+	}
+
+	_, err := scanner.ScanStream(context.Background(), strings.NewReader(strings.Repeat("x", 4096)))
+	if !errors.Is(err, errClamdSizeLimit) || !strings.Contains(err.Error(), "StreamMaxLength") {
+		t.Errorf("ScanStream of a file over StreamMaxLength = %v, want %v", err, errClamdSizeLimit)
+	}
+}
@@ -0,0 +1,332 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmlTemplate "html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+	"github.com/gorilla/mux"
+)
+
+// collectionManifest is the file listing the files uploaded under a token.
+// The .metadata suffix keeps it out of storage listings, like metadata sidecars.
+const collectionManifest = ".collection.metadata"
+
+// collection is the manifest of the files uploaded under a token
+type collection struct {
+	// OwnerKey authorizes adding files to the collection
+	OwnerKey string
+	Files    []collectionFile
+}
+
+type collectionFile struct {
+	Filename      string
+	ContentLength int64
+	Uploaded      time.Time
+}
+
+var errCollectionForbidden = errors.New("not authorized for collection")
+
+var errCollectionNotFound = errors.New("collection not found")
+
+// errFileExists is returned when adding a file under a name already taken in a collection
+var errFileExists = errors.New("file already exists")
+
+// readCollection retrieves the manifest of token. Tokens uploaded before manifests
+// existed get one built from the storage listing, without owner key.
+func (s *Server) readCollection(ctx context.Context, token string) (collection, error) {
+	var c collection
+
+	r, _, err := s.storage.Get(ctx, token, collectionManifest, nil)
+	defer storage.CloseCheck(r)
+
+	if err == nil {
+		err = json.NewDecoder(r).Decode(&c)
+		return c, err
+	} else if !s.storage.IsNotExist(err) {
+		return c, err
+	}
+
+	lister, ok := storage.Capability[storage.Lister](s.storage)
+	if !ok {
+		return c, errCollectionNotFound
+	}
+
+	err = lister.List(ctx, token, func(_ string, filename string) error {
+		contentLength, err := s.storage.Head(ctx, token, filename)
+		if err != nil {
+			return err
+		}
+
+		c.Files = append(c.Files, collectionFile{Filename: filename, ContentLength: int64(contentLength)})
+		return nil
+	})
+	if s.storage.IsNotExist(err) || err == nil && len(c.Files) == 0 {
+		return c, errCollectionNotFound
+	}
+
+	return c, err
+}
+
+func (s *Server) writeCollection(ctx context.Context, token string, c collection) error {
+	buffer := &bytes.Buffer{}
+	if err := json.NewEncoder(buffer).Encode(c); err != nil {
+		return errors.New("could not encode collection")
+	}
+
+	return s.storage.Put(ctx, token, collectionManifest, bytes.NewReader(buffer.Bytes()), "text/json", uint64(buffer.Len()))
+}
+
+// addToCollection records a file in the manifest of token, creating the manifest when
+// create is set. The owner key is returned when it was generated by this call.
+func (s *Server) addToCollection(ctx context.Context, token, filename string, contentLength int64, create bool) (string, error) {
+	s.lock(token, collectionManifest)
+	defer s.unlock(token, collectionManifest)
+
+	if !create {
+		if _, err := s.storage.Head(ctx, token, collectionManifest); s.storage.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	c, err := s.readCollection(ctx, token)
+	if err != nil && err != errCollectionNotFound {
+		return "", err
+	}
+
+	ownerKey := ""
+	if c.OwnerKey == "" {
+		c.OwnerKey = newOwnerKey(s.randomTokenLength)
+		ownerKey = c.OwnerKey
+	}
+
+	files := c.Files[:0]
+	for _, f := range c.Files {
+		if f.Filename != filename {
+			files = append(files, f)
+		}
+	}
+
+	c.Files = append(files, collectionFile{Filename: filename, ContentLength: contentLength, Uploaded: time.Now()})
+
+	if err = s.writeCollection(ctx, token, c); err != nil {
+		return "", err
+	}
+
+	return ownerKey, nil
+}
+
+// recordInCollection adds an uploaded file to the manifest of token, answering the
+// owner key of a new collection. The upload itself already succeeded, so failures are only logged.
+func (s *Server) recordInCollection(w http.ResponseWriter, r *http.Request, token, filename string, contentLength int64) {
+	ownerKey, err := s.addToCollection(r.Context(), token, filename, contentLength, true)
+	if err != nil {
+		s.logger.Printf("Error adding %s/%s to collection: %s", token, filename, err.Error())
+		return
+	}
+
+	if ownerKey != "" {
+		w.Header().Set("X-Owner-Key", ownerKey)
+	}
+}
+
+// removeFromCollection drops a deleted file from the manifest of token
+func (s *Server) removeFromCollection(ctx context.Context, token, filename string) error {
+	s.lock(token, collectionManifest)
+	defer s.unlock(token, collectionManifest)
+
+	c, err := s.readCollection(ctx, token)
+	if err == errCollectionNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	files := c.Files[:0]
+	for _, f := range c.Files {
+		if f.Filename != filename {
+			files = append(files, f)
+		}
+	}
+	c.Files = files
+
+	if len(c.Files) == 0 {
+		err = s.storage.Delete(ctx, token, collectionManifest)
+		if s.storage.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	return s.writeCollection(ctx, token, c)
+}
+
+// newOwnerKey generates the owner key of a new collection
+func newOwnerKey(length int) string {
+	return token(length) + token(length)
+}
+
+// authorizeCollection checks r carries the owner key of the collection of token,
+// or the deletion token of one of its files
+func (s *Server) authorizeCollection(ctx context.Context, token string, r *http.Request) error {
+	c, err := s.readCollection(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if ownerKey := r.Header.Get("X-Owner-Key"); ownerKey != "" && c.OwnerKey != "" {
+		if subtle.ConstantTimeCompare([]byte(ownerKey), []byte(c.OwnerKey)) == 1 {
+			return nil
+		}
+	}
+
+	if deletionToken := r.Header.Get("X-Deletion-Token"); deletionToken != "" {
+		for _, f := range c.Files {
+			m, err := s.readMetadata(ctx, token, f.Filename)
+			if isStorageUnavailable(err) {
+				return err
+			} else if err != nil {
+				continue
+			}
+
+			if subtle.ConstantTimeCompare([]byte(deletionToken), []byte(m.DeletionToken)) == 1 {
+				return nil
+			}
+		}
+	}
+
+	return errCollectionForbidden
+}
+
+// collectionTemplate renders the listing of a collection for browsers
+var collectionTemplate = htmlTemplate.Must(htmlTemplate.New("collection").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Token}} - transfer.sh</title>
+</head>
+<body>
+<h1>{{.Token}}</h1>
+<table>
+{{range .Files}}<tr><td><a href="{{.URL}}">{{.Filename}}</a></td><td>{{.ContentLength}} bytes</td></tr>
+{{end}}</table>
+<p>Download all: <a href="{{.ZipURL}}">zip</a> <a href="{{.TarGzURL}}">tar.gz</a></p>
+</body>
+</html>
+`))
+
+type collectionListingFile struct {
+	Filename      string
+	ContentLength int64
+	URL           string
+}
+
+// collectionHandler lists the files of a collection, one "<filename>\t<size>\t<url>" per line,
+// or as an HTML page for browsers
+func (s *Server) collectionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	token := vars["token"]
+
+	c, err := s.readCollection(r.Context(), token)
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error collection: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	sort.Slice(c.Files, func(i, j int) bool {
+		return c.Files[i].Filename < c.Files[j].Filename
+	})
+
+	var files []collectionListingFile
+	for _, f := range c.Files {
+		// skip expired files and files removed outside of the manifest
+		m, err := s.readMetadata(r.Context(), token, f.Filename)
+		if isStorageUnavailable(err) {
+			s.storageUnavailableError(w, err)
+			return
+		} else if err != nil || m.expired() {
+			continue
+		}
+
+		relativeURL, _ := url.Parse(path.Join(s.proxyPath, token, url.PathEscape(f.Filename)))
+		files = append(files, collectionListingFile{Filename: f.Filename, ContentLength: f.ContentLength, URL: resolveURL(r, relativeURL, s.proxyPort)})
+	}
+
+	if len(files) == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if acceptsHTML(r.Header) {
+		zipURL, _ := url.Parse(path.Join(s.proxyPath, token+".zip"))
+		tarGzURL, _ := url.Parse(path.Join(s.proxyPath, token+".tar.gz"))
+
+		data := struct {
+			Token    string
+			Files    []collectionListingFile
+			ZipURL   string
+			TarGzURL string
+		}{
+			token,
+			files,
+			resolveURL(r, zipURL, s.proxyPort),
+			resolveURL(r, tarGzURL, s.proxyPort),
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := collectionTemplate.Execute(w, data); err != nil {
+			s.logger.Printf("%s", err.Error())
+		}
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, f := range files {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\n", f.Filename, f.ContentLength, f.URL)
+	}
+}
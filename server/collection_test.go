@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+type suiteCollection struct {
+	srvr *Server
+}
+
+func (s *suiteCollection) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	s.srvr, err = New(UseStorage(local), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10))
+	c.Assert(err, IsNil)
+}
+
+// post uploads a file as a multipart form, to a new token when token is empty
+func (s *suiteCollection) post(token, filename, content, ownerKey string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", filename)
+	_, _ = fw.Write([]byte(content))
+	_ = mw.Close()
+
+	req := httptest.NewRequest("POST", "http://test/"+token, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if ownerKey != "" {
+		req.Header.Set("X-Owner-Key", ownerKey)
+	}
+
+	w := httptest.NewRecorder()
+	s.srvr.postHandler(w, mux.SetURLVars(req, map[string]string{"token": token}))
+
+	return w
+}
+
+func (s *suiteCollection) get(token, filename string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://test/"+token+"/"+filename, nil)
+
+	w := httptest.NewRecorder()
+	s.srvr.getHandler(w, mux.SetURLVars(req, map[string]string{"token": token, "filename": filename}))
+
+	return w
+}
+
+// upload creates a collection with one file, returning its token and owner key
+func (s *suiteCollection) upload(c *C) (string, string) {
+	w := s.post("", "hello.txt", "one", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	token := strings.Split(strings.TrimPrefix(strings.TrimSpace(w.Body.String()), "http://test/"), "/")[0]
+	return token, w.Header().Get("X-Owner-Key")
+}
+
+func (s *suiteCollection) TestAppendAndList(c *C) {
+	token, ownerKey := s.upload(c)
+
+	c.Assert(s.post(token, "world.txt", "two", "wrong").Code, Equals, http.StatusForbidden)
+	c.Assert(s.post(token, "world.txt", "two", ownerKey).Code, Equals, http.StatusOK)
+
+	req := httptest.NewRequest("GET", "http://test/"+token+"/", nil)
+	w := httptest.NewRecorder()
+	s.srvr.collectionHandler(w, mux.SetURLVars(req, map[string]string{"token": token}))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "hello.txt\t3\thttp://test/"+token+"/hello.txt\nworld.txt\t3\thttp://test/"+token+"/world.txt\n")
+}
+
+func (s *suiteCollection) TestAppendExistingName(c *C) {
+	token, ownerKey := s.upload(c)
+
+	c.Assert(s.post(token, "hello.txt", "two", ownerKey).Code, Equals, http.StatusConflict)
+
+	w := s.get(token, "hello.txt")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "one")
+}
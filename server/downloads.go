@@ -0,0 +1,296 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomasen/realip"
+)
+
+// rangeDownloadTTL is how long the ranges a client downloaded are remembered
+const rangeDownloadTTL = time.Hour
+
+// defaultPreviewBots match the User-Agent of link unfurlers of chat apps and social
+// networks, whose downloads are not counted
+var defaultPreviewBots = []string{
+	"Slackbot", "Slack-ImgProxy", "Twitterbot", "facebookexternalhit", "Discordbot",
+	"TelegramBot", "WhatsApp", "LinkedInBot", "SkypeUriPreview", "Mattermost-Bot",
+	"redditbot", "Iframely", "Embedly", "vkShare", "Viber", "Applebot",
+}
+
+// compilePreviewBots builds the case insensitive regular expression matching any of patterns
+func compilePreviewBots(patterns []string) (*regexp.Regexp, error) {
+	alternatives := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			alternatives = append(alternatives, "(?:"+pattern+")")
+		}
+	}
+
+	if len(alternatives) == 0 {
+		return nil, nil
+	}
+
+	return regexp.Compile("(?i)" + strings.Join(alternatives, "|"))
+}
+
+// isPreviewBot indicates if r comes from a link unfurler
+func (s *Server) isPreviewBot(r *http.Request) bool {
+	return s.previewBots != nil && s.previewBots.MatchString(r.UserAgent())
+}
+
+// downloadTracker keeps the downloads in progress and the ranges clients downloaded,
+// so that only completed downloads are counted
+type downloadTracker struct {
+	mutex    sync.Mutex
+	inFlight map[string]int
+	ranges   map[string]*rangeDownload
+}
+
+// rangeDownload is the merged byte ranges of a file a client downloaded
+type rangeDownload struct {
+	intervals [][2]uint64
+	lastSeen  time.Time
+	// held is the file whose download is reserved for the whole range sequence, if limited
+	held string
+}
+
+func newDownloadTracker() *downloadTracker {
+	return &downloadTracker{inFlight: map[string]int{}, ranges: map[string]*rangeDownload{}}
+}
+
+// take holds one of the remaining downloads of the file at key, the caller holding the mutex
+func (t *downloadTracker) take(key string, m metadata) bool {
+	if m.Downloads+t.inFlight[key] >= m.MaxDownloads {
+		return false
+	}
+
+	t.inFlight[key]++
+	return true
+}
+
+// free releases a download held with take, the caller holding the mutex
+func (t *downloadTracker) free(key string) {
+	if t.inFlight[key]--; t.inFlight[key] <= 0 {
+		delete(t.inFlight, key)
+	}
+}
+
+// expire forgets the range downloads not continued within rangeDownloadTTL, releasing
+// their reservations. The caller holds the mutex.
+func (t *downloadTracker) expire(now time.Time) {
+	for k, d := range t.ranges {
+		if now.Sub(d.lastSeen) <= rangeDownloadTTL {
+			continue
+		}
+
+		if d.held != "" {
+			t.free(d.held)
+		}
+
+		delete(t.ranges, k)
+	}
+}
+
+// reserve holds one of the remaining downloads of a file with a download limit while
+// it is being downloaded, returning false when none is left. Releasing more than once
+// releases it once.
+func (t *downloadTracker) reserve(token, filename string, m metadata) (release func(), ok bool) {
+	key := token + "/" + filename
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.take(key, m) {
+		return nil, false
+	}
+
+	return sync.OnceFunc(func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		t.free(key)
+	}), true
+}
+
+// reserveRanges holds one of the remaining downloads of a file with a download limit
+// for the range requests of client to object, which is the file or one of its versions.
+// The later ranges of the client use the same reservation, which is held until
+// endRanges or rangeDownloadTTL after the last range.
+func (t *downloadTracker) reserveRanges(client, token, filename, object string, m metadata) bool {
+	key := rangeKey(client, token, object)
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.expire(now)
+
+	download, ok := t.ranges[key]
+	if ok && download.held != "" {
+		download.lastSeen = now
+		return true
+	}
+
+	if !t.take(token+"/"+filename, m) {
+		return false
+	}
+
+	if !ok {
+		download = &rangeDownload{}
+		t.ranges[key] = download
+	}
+
+	download.lastSeen = now
+	download.held = token + "/" + filename
+
+	return true
+}
+
+func rangeKey(client, token, object string) string {
+	return client + "\x00" + token + "/" + object
+}
+
+// reserveDownload reserves one of the remaining downloads of a limited file for r, the
+// release doing nothing for files without limit and downloads that are not counted
+func (s *Server) reserveDownload(r *http.Request, token, filename string, m metadata) (release func(), ok bool) {
+	if m.MaxDownloads == -1 || s.isPreviewBot(r) {
+		return func() {}, true
+	}
+
+	return s.downloads.reserve(token, filename, m)
+}
+
+// addRange records that client downloaded bytes start to end, inclusive, of object of
+// size bytes and indicates if the client has now downloaded the whole of it
+func (t *downloadTracker) addRange(client, token, object string, start, end, size uint64) bool {
+	key := rangeKey(client, token, object)
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	download, ok := t.ranges[key]
+	if !ok {
+		t.expire(now)
+
+		download = &rangeDownload{}
+		t.ranges[key] = download
+	}
+
+	download.lastSeen = now
+	download.intervals = mergeIntervals(append(download.intervals, [2]uint64{start, end}))
+
+	return len(download.intervals) == 1 && download.intervals[0][0] == 0 && download.intervals[0][1]+1 >= size
+}
+
+// endRanges forgets the ranges client downloaded of object once its download was
+// counted, releasing the reservation held for them
+func (t *downloadTracker) endRanges(client, token, object string) {
+	key := rangeKey(client, token, object)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if download, ok := t.ranges[key]; ok {
+		if download.held != "" {
+			t.free(download.held)
+		}
+
+		delete(t.ranges, key)
+	}
+}
+
+// mergeIntervals merges the overlapping and adjacent inclusive intervals
+func mergeIntervals(intervals [][2]uint64) [][2]uint64 {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i][0] < intervals[j][0]
+	})
+
+	merged := intervals[:1]
+	for _, interval := range intervals[1:] {
+		last := &merged[len(merged)-1]
+		if interval[0] <= last[1]+1 {
+			if interval[1] > last[1] {
+				last[1] = interval[1]
+			}
+		} else {
+			merged = append(merged, interval)
+		}
+	}
+
+	return merged
+}
+
+// downloadClient identifies the client of r across the range requests of a download,
+// by its address behind proxies as the ip filter does
+func downloadClient(r *http.Request) string {
+	return realip.FromRequest(r) + "\x00" + r.UserAgent()
+}
+
+// burnsAfterReading indicates if the file is deleted once its last allowed download completed
+func (s *Server) burnsAfterReading(m metadata) bool {
+	return m.MaxDownloads != -1 && (m.BurnAfterReading || s.burnAfterReading)
+}
+
+// countDownload counts a completed download of a file. Burn-after-reading files are
+// deleted once their last allowed download completed.
+func (s *Server) countDownload(ctx context.Context, token, filename string) {
+	s.lock(token, filename)
+	defer s.unlock(token, filename)
+
+	m, err := s.readMetadata(ctx, token, filename)
+	if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		return
+	}
+
+	m.Downloads++
+	m.LastDownload = time.Now().UTC()
+
+	// the count is written before burning, so it is kept when the file cannot be deleted
+	if err = s.writeMetadata(ctx, token, filename, m); err != nil {
+		s.logger.Printf("Error counting download of %s/%s: %s", token, filename, err.Error())
+		return
+	}
+
+	if !s.burnsAfterReading(m) || m.Downloads < m.MaxDownloads {
+		return
+	}
+
+	if err = s.deleteFile(ctx, token, filename); err != nil && !s.storage.IsNotExist(err) {
+		s.logger.Printf("Error burning %s/%s: %s", token, filename, err.Error())
+		return
+	}
+
+	s.logger.Printf("Burnt %s/%s after its last download", token, filename)
+}
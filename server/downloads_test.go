@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+func TestDownloadTrackerAddRange(t *testing.T) {
+	tracker := newDownloadTracker()
+
+	for _, step := range []struct {
+		client     string
+		start, end uint64
+		complete   bool
+	}{
+		{"a", 0, 99, false},
+		{"b", 100, 999, false},
+		{"a", 500, 999, false},
+		{"a", 50, 499, true},
+		{"a", 0, 99, false},
+		{"b", 0, 99, true},
+	} {
+		if got := tracker.addRange(step.client, "token", "file", step.start, step.end, 1000); got != step.complete {
+			t.Errorf("addRange(%s, %d-%d) = %v, want %v", step.client, step.start, step.end, got, step.complete)
+		} else if got {
+			tracker.endRanges(step.client, "token", "file")
+		}
+	}
+}
+
+func TestDownloadTrackerReserveRanges(t *testing.T) {
+	tracker := newDownloadTracker()
+	m := metadata{MaxDownloads: 1}
+
+	if !tracker.reserveRanges("a", "token", "file", "file", m) {
+		t.Fatal("first range of a refused")
+	}
+
+	if !tracker.reserveRanges("a", "token", "file", "file", m) {
+		t.Error("later range of a refused, it holds the download")
+	}
+
+	if tracker.reserveRanges("b", "token", "file", "file", m) {
+		t.Error("range of b accepted while a holds the only download")
+	}
+
+	if _, ok := tracker.reserve("token", "file", m); ok {
+		t.Error("download accepted while a holds the only download")
+	}
+
+	tracker.endRanges("a", "token", "file")
+
+	if !tracker.reserveRanges("b", "token", "file", "file", m) {
+		t.Error("range of b refused after a ended its ranges")
+	}
+}
+
+// interruptedWriter is a response whose client goes away before the body is written
+type interruptedWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w interruptedWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+type suiteBurnAfterReading struct {
+	srvr *Server
+}
+
+func (s *suiteBurnAfterReading) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	s.srvr, err = New(UseStorage(local), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10))
+	c.Assert(err, IsNil)
+}
+
+// put uploads hello.txt with headers, returning its token
+func (s *suiteBurnAfterReading) put(c *C, headers map[string]string) string {
+	req := httptest.NewRequest("PUT", "http://test/hello.txt", strings.NewReader("hello"))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	s.srvr.putHandler(w, mux.SetURLVars(req, map[string]string{"filename": "hello.txt"}))
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	u, err := url.Parse(strings.TrimSpace(w.Body.String()))
+	c.Assert(err, IsNil)
+
+	return strings.Split(strings.Trim(u.Path, "/"), "/")[0]
+}
+
+func (s *suiteBurnAfterReading) get(w http.ResponseWriter, token string) {
+	req := httptest.NewRequest("GET", "http://test/"+token+"/hello.txt", nil)
+	s.srvr.getHandler(w, mux.SetURLVars(req, map[string]string{"token": token, "filename": "hello.txt"}))
+}
+
+func (s *suiteBurnAfterReading) TestBurntAfterLastDownload(c *C) {
+	token := s.put(c, map[string]string{"X-Burn-After-Reading": "true"})
+
+	w := httptest.NewRecorder()
+	s.get(w, token)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "hello")
+
+	_, _, err := s.srvr.storage.Get(context.Background(), token, "hello.txt", nil)
+	c.Assert(s.srvr.storage.IsNotExist(err), Equals, true)
+
+	w = httptest.NewRecorder()
+	s.get(w, token)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+}
+
+func (s *suiteBurnAfterReading) TestInterruptedDownloadNotBurnt(c *C) {
+	token := s.put(c, map[string]string{"X-Burn-After-Reading": "true"})
+
+	s.get(interruptedWriter{httptest.NewRecorder()}, token)
+
+	m, err := s.srvr.readMetadata(context.Background(), token, "hello.txt")
+	c.Assert(err, IsNil)
+	c.Assert(m.Downloads, Equals, 0)
+
+	w := httptest.NewRecorder()
+	s.get(w, token)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "hello")
+}
+
+func (s *suiteBurnAfterReading) TestLimitWithoutBurnKeepsFile(c *C) {
+	token := s.put(c, map[string]string{"Max-Downloads": "1"})
+
+	w := httptest.NewRecorder()
+	s.get(w, token)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	w = httptest.NewRecorder()
+	s.get(w, token)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	_, err := s.srvr.storage.Head(context.Background(), token, "hello.txt")
+	c.Assert(err, IsNil)
+}
+
+type suiteRangeDownloads struct {
+	srvr  *Server
+	token string
+}
+
+func (s *suiteRangeDownloads) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	s.srvr, err = New(UseStorage(local), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10))
+	c.Assert(err, IsNil)
+
+	req := httptest.NewRequest("PUT", "http://test/hello.txt", strings.NewReader("hello world"))
+	req.Header.Set("Max-Downloads", "1")
+
+	w := httptest.NewRecorder()
+	s.srvr.putHandler(w, mux.SetURLVars(req, map[string]string{"filename": "hello.txt"}))
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	u, err := url.Parse(strings.TrimSpace(w.Body.String()))
+	c.Assert(err, IsNil)
+	s.token = strings.Split(strings.Trim(u.Path, "/"), "/")[0]
+}
+
+// get downloads hello.txt from the client behind a proxy with the address realIP
+func (s *suiteRangeDownloads) get(realIP, rng string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://test/"+s.token+"/hello.txt", nil)
+	req.Header.Set("X-Real-Ip", realIP)
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+
+	w := httptest.NewRecorder()
+	s.srvr.getHandler(w, mux.SetURLVars(req, map[string]string{"token": s.token, "filename": "hello.txt"}))
+
+	return w
+}
+
+func (s *suiteRangeDownloads) downloads(c *C) int {
+	m, err := s.srvr.readMetadata(context.Background(), s.token, "hello.txt")
+	c.Assert(err, IsNil)
+
+	return m.Downloads
+}
+
+func (s *suiteRangeDownloads) TestLimitedFileAcceptsRanges(c *C) {
+	req := httptest.NewRequest("HEAD", "http://test/"+s.token+"/hello.txt", nil)
+	w := httptest.NewRecorder()
+	s.srvr.headHandler(w, mux.SetURLVars(req, map[string]string{"token": s.token, "filename": "hello.txt"}))
+	c.Assert(w.Header().Get("Accept-Ranges"), Equals, "bytes")
+
+	w = s.get("192.0.2.1", "bytes=0-4")
+	c.Assert(w.Code, Equals, http.StatusPartialContent)
+	c.Assert(w.Header().Get("Content-Range"), Equals, "bytes 0-4/11")
+	c.Assert(w.Body.String(), Equals, "hello")
+}
+
+func (s *suiteRangeDownloads) TestRangesHoldTheDownloadUntilComplete(c *C) {
+	c.Assert(s.get("192.0.2.1", "bytes=0-4").Code, Equals, http.StatusPartialContent)
+	c.Assert(s.downloads(c), Equals, 0)
+
+	// another client behind the same proxy cannot take the download held for the ranges
+	c.Assert(s.get("192.0.2.2", "bytes=0-4").Code, Equals, http.StatusNotFound)
+	c.Assert(s.get("192.0.2.2", "").Code, Equals, http.StatusNotFound)
+
+	w := s.get("192.0.2.1", "bytes=5-")
+	c.Assert(w.Code, Equals, http.StatusPartialContent)
+	c.Assert(w.Body.String(), Equals, " world")
+	c.Assert(s.downloads(c), Equals, 1)
+
+	c.Assert(s.get("192.0.2.1", "bytes=0-4").Code, Equals, http.StatusNotFound)
+}
@@ -0,0 +1,271 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+const (
+	defaultFetchTimeout      = 5 * time.Minute
+	defaultFetchMaxRedirects = 5
+	fetchDialTimeout         = 10 * time.Second
+)
+
+var errFetchForbidden = errors.New("fetch destination not allowed")
+
+// fetchBlockedNetworks are special purpose ranges not covered by the net.IP predicates
+var fetchBlockedNetworks = parseNetworks([]string{
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+})
+
+func parseNetworks(cidrs []string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+
+	return networks
+}
+
+// fetchPolicy decides which destinations server-side fetches may connect to
+type fetchPolicy struct {
+	hosts    map[string]bool
+	networks []*net.IPNet
+}
+
+// newFetchPolicy allows the hosts, IPs and CIDRs of allowlist on top of the public internet
+func newFetchPolicy(allowlist []string) *fetchPolicy {
+	p := &fetchPolicy{hosts: map[string]bool{}}
+	for _, entry := range allowlist {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(entry); ip != nil {
+			p.networks = append(p.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else if _, network, err := net.ParseCIDR(entry); err == nil {
+			p.networks = append(p.networks, network)
+		} else {
+			p.hosts[entry] = true
+		}
+	}
+
+	return p
+}
+
+// allowedIP blocks loopback, private, link-local and other non public addresses
+// unless they are allowlisted
+func (p *fetchPolicy) allowedIP(ip net.IP) bool {
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	for _, network := range fetchBlockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newFetchClient returns the client of server-side fetches. Addresses are checked
+// once resolved, right before connecting, so DNS answers cannot point it to
+// a blocked address, and environment proxies are ignored.
+func newFetchClient(timeout time.Duration, maxRedirects int, allowlist []string) *http.Client {
+	policy := newFetchPolicy(allowlist)
+
+	dialer := &net.Dialer{Timeout: fetchDialTimeout}
+	guardedDialer := &net.Dialer{
+		Timeout: fetchDialTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || !policy.allowedIP(ip) {
+				return fmt.Errorf("%w: %s", errFetchForbidden, host)
+			}
+
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+
+			if policy.hosts[strings.ToLower(host)] {
+				return dialer.DialContext(ctx, network, address)
+			}
+
+			return guardedDialer.DialContext(ctx, network, address)
+		},
+		TLSHandshakeTimeout:   fetchDialTimeout,
+		ResponseHeaderTimeout: timeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          10,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("%w: %s redirect", errFetchForbidden, req.URL.Scheme)
+			}
+
+			return nil
+		},
+	}
+}
+
+// fetchHandler stores the file at the http(s) URL sent as request body under a new token
+func (s *Server) fetchHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	defer storage.CloseCheck(r.Body)
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 8192))
+	if err != nil {
+		http.Error(w, "Could not read URL", http.StatusBadRequest)
+		return
+	}
+
+	source, err := url.Parse(strings.TrimSpace(string(body)))
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		http.Error(w, "Invalid URL, only absolute http and https URLs can be fetched", http.StatusBadRequest)
+		return
+	}
+
+	filename := vars["filename"]
+	if filename == "" {
+		filename = path.Base(source.Path)
+		if filename == "/" || filename == "." {
+			filename = "download"
+		}
+	}
+	filename = sanitize(filename)
+
+	token, release, err := s.uploadToken(r)
+	if err != nil {
+		s.tokenError(w, err)
+		return
+	}
+	defer release()
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, source.String(), nil)
+	if err != nil {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("User-Agent", "transfer.sh")
+
+	s.logger.Printf("Fetching %s for %s/%s", source.Redacted(), token, filename)
+
+	resp, err := s.fetchClient.Do(req)
+	if err != nil {
+		s.fetchError(w, err)
+		return
+	}
+	defer storage.CloseCheck(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		s.logger.Printf("Fetching %s returned %s", source.Redacted(), resp.Status)
+		http.Error(w, fmt.Sprintf("Could not fetch URL: %s", resp.Status), http.StatusBadGateway)
+		return
+	}
+
+	var reader io.ReadCloser = resp.Body
+	if s.maxUploadSize > 0 {
+		if resp.ContentLength > s.maxUploadSize {
+			s.logger.Print("Entity too large")
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// a body of unknown length is spooled, reading one byte past the
+		// limit is enough to reject it
+		reader = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, s.maxUploadSize+1), resp.Body}
+	}
+
+	s.storeUpload(w, r, token, filename, reader, resp.Header.Get("Content-Type"), resp.ContentLength, false)
+}
+
+// fetchError writes the response for a failed server-side fetch
+func (s *Server) fetchError(w http.ResponseWriter, err error) {
+	s.logger.Printf("Error fetching URL: %s", err.Error())
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errFetchForbidden):
+		http.Error(w, "URL destination not allowed", http.StatusForbidden)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		http.Error(w, "Timeout fetching URL", http.StatusGatewayTimeout)
+	default:
+		http.Error(w, "Could not fetch URL", http.StatusBadGateway)
+	}
+}
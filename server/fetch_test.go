@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFetchPolicyAllowedIP(t *testing.T) {
+	policy := newFetchPolicy([]string{"10.1.0.0/16", "127.0.0.2", "files.internal"})
+
+	for ip, allowed := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"127.0.0.2":        true,
+		"10.0.0.1":         false,
+		"10.1.2.3":         true,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+		"::ffff:127.0.0.1": false,
+	} {
+		if got := policy.allowedIP(net.ParseIP(ip)); got != allowed {
+			t.Errorf("allowedIP(%s) = %v, want %v", ip, got, allowed)
+		}
+	}
+
+	if !policy.hosts["files.internal"] {
+		t.Error("expected files.internal to be an allowed host")
+	}
+}
@@ -33,19 +33,19 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html"
 	htmlTemplate "html/template"
 	"io"
-	"mime"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -97,7 +97,26 @@ func initHTMLTemplates() *htmlTemplate.Template {
 	// Templates with functions available to them
 	var templates = htmlTemplate.New("").Funcs(templateMap)
 
-	return templates
+	return htmlTemplate.Must(templates.Parse(downloadDetailsTemplate))
+}
+
+// downloadDetailsTemplate renders the details of a file the bundled download pages
+// predate, like its description and VirusTotal verdict. Custom templates of the web
+// path can include it with {{template "download-details.html" .}}.
+const downloadDetailsTemplate = `{{define "download-details.html"}}{{if .Description}}
+                <p class="description">{{.Description}}</p>{{end}}{{with .VirusTotal}}
+                <h4>virustotal: <b>{{.Status}}</b>{{if .Total}}, {{.Positives}}/{{.Total}} engines detected it{{end}}{{if .Permalink}} (<a href="{{.Permalink}}">report</a>){{end}}</h4>{{end}}{{end}}`
+
+// downloadTitle is the title of the bundled download pages, followed by the download details
+const downloadTitle = `<h2 class="page-title">{{.Filename}}</h2>`
+
+// withDownloadDetails includes the download details in a bundled download page
+func withDownloadDetails(path string, page string) string {
+	if !strings.HasPrefix(stripPrefix(path), "download") {
+		return page
+	}
+
+	return strings.Replace(page, downloadTitle, downloadTitle+`{{template "download-details.html" .}}`, 1)
 }
 
 func attachEncryptionReader(reader io.ReadCloser, password string) (io.ReadCloser, error) {
@@ -234,6 +253,8 @@ func canContainsXSS(contentType string) bool {
 		fallthrough
 	case strings.Contains(contentType, "rdf"):
 		fallthrough
+	case strings.Contains(contentType, "svg"):
+		fallthrough
 	case strings.Contains(contentType, "vtt"):
 		fallthrough
 	case strings.Contains(contentType, "xml"):
@@ -256,16 +277,24 @@ func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
 	token := vars["token"]
 	filename := vars["filename"]
 
-	metadata, err := s.checkMetadata(r.Context(), token, filename, false)
+	object, metadata, err := s.checkVersion(r.Context(), token, filename, r.URL.Query().Get("version"))
 
-	if err != nil {
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if s.scanStatusError(w, err) {
+		return
+	} else if errors.Is(err, errVersionNotFound) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		s.logger.Printf("Error metadata: %s", err.Error())
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
 	contentType := metadata.ContentType
-	contentLength, err := s.storage.Head(r.Context(), token, filename)
+	contentLength, err := s.storage.Head(r.Context(), token, object)
 	if err != nil {
 		http.Error(w, http.StatusText(404), 404)
 		return
@@ -275,6 +304,9 @@ func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
 	var content htmlTemplate.HTML
 
 	switch {
+	case s.burnsAfterReading(metadata):
+		// previews would show the content without counting a download
+		templatePath = "download.html"
 	case strings.HasPrefix(contentType, "image/"):
 		templatePath = "download.image.html"
 	case strings.HasPrefix(contentType, "video/"):
@@ -284,15 +316,16 @@ func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
 	case strings.HasPrefix(contentType, "text/"):
 		templatePath = "download.markdown.html"
 
-		var reader io.ReadCloser
-		if reader, _, err = s.storage.Get(r.Context(), token, filename, nil); err != nil {
+		reader, _, err := s.storage.Get(r.Context(), token, object, nil)
+		defer storage.CloseCheck(reader)
+
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		var data []byte
-		data = make([]byte, _5M)
-		if _, err = reader.Read(data); err != io.EOF && err != nil {
+		data, err := io.ReadAll(io.LimitReader(reader, _5M))
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -312,8 +345,15 @@ func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	relativeURL, _ := url.Parse(path.Join(s.proxyPath, token, filename))
-	resolvedURL := resolveURL(r, relativeURL, s.proxyPort)
 	relativeURLGet, _ := url.Parse(path.Join(s.proxyPath, getPathPart, token, filename))
+
+	// previews of previous versions link to their downloads
+	if version := r.URL.Query().Get("version"); version != "" {
+		relativeURL.RawQuery = url.Values{"version": {version}}.Encode()
+		relativeURLGet.RawQuery = relativeURL.RawQuery
+	}
+
+	resolvedURL := resolveURL(r, relativeURL, s.proxyPort)
 	resolvedURLGet := resolveURL(r, relativeURLGet, s.proxyPort)
 	var png []byte
 	png, err = qrcode.Encode(resolvedURL, qrcode.High, 150)
@@ -340,10 +380,12 @@ func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
 		GAKey          string
 		UserVoiceKey   string
 		QRCode         string
+		VirusTotal     *virusTotalVerdict
+		Description    string
 	}{
 		contentType,
 		content,
-		filename,
+		metadata.downloadName(filename),
 		resolvedURL,
 		resolvedURLGet,
 		token,
@@ -353,8 +395,12 @@ func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
 		s.gaKey,
 		s.userVoiceKey,
 		qrCode,
+		metadata.VirusTotal,
+		metadata.Description,
 	}
 
+	setVirusTotalHeaders(w, metadata)
+
 	if err := htmlTemplates.ExecuteTemplate(w, templatePath, data); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -439,18 +485,58 @@ func sanitize(fileName string) string {
 	if len(newName) == 0 {
 		newName = "_"
 	}
-	return path.Base(newName)
+	// names of sidecars and previous versions are never given to files
+	newName = path.Base(newName)
+	if strings.HasSuffix(newName, ".metadata") {
+		newName += "_"
+	}
+	return newName
 }
 
+// postHandler uploads the files of a multipart form under a new token or,
+// when authorized, appends them to the collection of an existing token
 func (s *Server) postHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	token := vars["token"]
+	if token == "" {
+		var release func()
+		var err error
+		if token, release, err = s.uploadToken(r); err != nil {
+			s.tokenError(w, err)
+			return
+		}
+		defer release()
+	} else {
+		if err := s.authorizeCollection(r.Context(), token, r); isStorageUnavailable(err) {
+			s.storageUnavailableError(w, err)
+			return
+		} else if err == errCollectionNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			s.logger.Printf("Error collection: %s", err.Error())
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	contentLength := r.ContentLength
+	if contentLength < 0 {
+		contentLength = 0
+	}
+
+	if err := s.checkStorageSpace(r.Context(), contentLength, true); err != nil {
+		s.storageSpaceError(w, err)
+		return
+	}
+
 	if err := r.ParseMultipartForm(_24K); nil != err {
 		s.logger.Printf("%s", err.Error())
 		http.Error(w, "Error occurred copying to output stream", http.StatusInternalServerError)
 		return
 	}
 
-	token := token(s.randomTokenLength)
-
 	w.Header().Set("Content-Type", "text/plain")
 
 	responseBody := ""
@@ -458,11 +544,15 @@ func (s *Server) postHandler(w http.ResponseWriter, r *http.Request) {
 	for _, fHeaders := range r.MultipartForm.File {
 		for _, fHeader := range fHeaders {
 			filename := sanitize(fHeader.Filename)
-			contentType := mime.TypeByExtension(filepath.Ext(fHeader.Filename))
 
 			var f io.Reader
 			var err error
 
+			if err = s.checkStorageSpace(r.Context(), fHeader.Size, true); err != nil {
+				s.storageSpaceError(w, err)
+				return
+			}
+
 			if f, err = fHeader.Open(); err != nil {
 				s.logger.Printf("%s", err.Error())
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -478,7 +568,13 @@ func (s *Server) postHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			n, err := io.Copy(file, f)
+			h := s.uploadHasher(r.Header.Get("X-Encrypt-Password") != "")
+			src := io.Reader(f)
+			if h != nil {
+				src = io.TeeReader(f, h)
+			}
+
+			n, err := io.Copy(file, src)
 			if err != nil {
 				s.logger.Printf("%s", err.Error())
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -499,36 +595,49 @@ func (s *Server) postHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if s.performClamavPrescan {
-				status, err := s.performScan(file.Name())
-				if err != nil {
-					s.logger.Printf("%s", err.Error())
-					http.Error(w, "Could not perform prescan", http.StatusInternalServerError)
-					return
-				}
-
-				if status != clamavScanStatusOK {
-					s.logger.Printf("prescan positive: %s", status)
-					http.Error(w, "Clamav prescan found a virus", http.StatusPreconditionFailed)
-					return
-				}
+			head, _, err := readHead(file)
+			if err != nil {
+				s.logger.Printf("%s", err.Error())
+				http.Error(w, "Could not read file", http.StatusInternalServerError)
+				return
 			}
 
-			metadata := metadataForRequest(contentType, contentLength, s.randomTokenLength, r)
+			contentType := detectContentType(head, fHeader.Filename, fHeader.Header.Get("Content-Type"))
 
-			buffer := &bytes.Buffer{}
-			if err := json.NewEncoder(buffer).Encode(metadata); err != nil {
-				s.logger.Printf("%s", err.Error())
-				http.Error(w, "Could not encode metadata", http.StatusInternalServerError)
+			rule := s.uploadRule(r)
+			if err = rule.check(filename, contentType, head); err == nil && rule.inspectsArchive(head) {
+				err = rule.checkArchive(file, head)
+			}
 
+			if err != nil {
+				s.policyError(w, err)
 				return
-			} else if err := s.storage.Put(r.Context(), token, fmt.Sprintf("%s.metadata", filename), buffer, "text/json", uint64(buffer.Len())); err != nil {
-				s.logger.Printf("%s", err.Error())
-				http.Error(w, "Could not save metadata", http.StatusInternalServerError)
+			}
+
+			if err = s.checkBlocklist(h); err != nil {
+				s.blockedError(w, err)
+				return
+			}
 
+			metadata, err := s.metadataForRequest(contentType, contentLength, r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
+			if h != nil {
+				metadata.SHA256 = hex.EncodeToString(h.Sum(nil))
+			}
+
+			if s.scanBeforeStoring(r) {
+				if metadata.ScanStatus, metadata.ScanResults = s.scanFile(r.Context(), s.scanners, file.Name()); metadata.ScanStatus != scanStatusClean {
+					s.scanVerdictError(w, metadata.ScanStatus, metadata.ScanResults)
+					return
+				}
+			} else if s.scanAfterStoring(r) {
+				metadata.ScanStatus = scanStatusPending
+			}
+
 			s.logger.Printf("Uploading %s %s %d %s", token, filename, contentLength, contentType)
 
 			reader, err := attachEncryptionReader(file, r.Header.Get("X-Encrypt-Password"))
@@ -537,17 +646,44 @@ func (s *Server) postHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if err = s.storage.Put(r.Context(), token, filename, reader, contentType, uint64(contentLength)); err != nil {
+			// files already in the collection are only replaced through new versions
+			s.lock(token, filename)
+			existing, err := s.readMetadata(r.Context(), token, filename)
+			if err == nil && existing.held() {
+				err = storage.ErrLegalHold
+			} else if err == nil {
+				err = errFileExists
+			} else if s.storage.IsNotExist(err) {
+				err = s.putWithMetadata(r.Context(), token, filename, reader, contentType, uint64(contentLength), metadata)
+			}
+			s.unlock(token, filename)
+
+			if legalHoldError(w, err) {
+				return
+			} else if err == errFileExists {
+				http.Error(w, fmt.Sprintf("%s already exists in the collection", filename), http.StatusConflict)
+				return
+			} else if isStorageUnavailable(err) {
+				s.storageUnavailableError(w, err)
+				return
+			} else if err != nil {
 				s.logger.Printf("Backend storage error: %s", err.Error())
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 
 			}
 
+			if metadata.ScanStatus == scanStatusPending {
+				s.enqueueScan(token, filename)
+			}
+
+			s.recordInCollection(w, r, token, filename, contentLength)
+
 			filename = url.PathEscape(filename)
 			relativeURL, _ := url.Parse(path.Join(s.proxyPath, token, filename))
 			deleteURL, _ := url.Parse(path.Join(s.proxyPath, token, filename, metadata.DeletionToken))
 			w.Header().Add("X-Url-Delete", resolveURL(r, deleteURL, s.proxyPort))
+			setLimitHeaders(w, metadata)
 			responseBody += fmt.Sprintln(getURL(r, s.proxyPort).ResolveReference(relativeURL).String())
 		}
 	}
@@ -572,6 +708,57 @@ func (s *Server) cleanTmpFile(f *os.File) {
 	}
 }
 
+// checkStorageSpace returns storage.ErrInsufficientStorage if contentLength
+// bytes would breach the free space of the temp path, when spooled, or the quota
+// of the storage. A contentLength of 0 only checks the configured minimums.
+func (s *Server) checkStorageSpace(ctx context.Context, contentLength int64, spool bool) error {
+	if spool && s.tempPathMinFree > 0 {
+		_, free, err := storage.DiskUsage(s.tempPath)
+		if err != nil {
+			return err
+		}
+
+		if free < uint64(contentLength+s.tempPathMinFree) {
+			return storage.ErrInsufficientStorage
+		}
+	}
+
+	if quotaChecker, ok := storage.Capability[storage.QuotaChecker](s.storage); ok {
+		return quotaChecker.CheckQuota(ctx, uint64(contentLength))
+	}
+
+	return nil
+}
+
+// storageSpaceError writes the response for a failed checkStorageSpace
+func (s *Server) storageSpaceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrInsufficientStorage) {
+		s.logger.Print("Insufficient storage")
+		http.Error(w, http.StatusText(http.StatusInsufficientStorage), http.StatusInsufficientStorage)
+		return
+	}
+
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	}
+
+	s.logger.Printf("%s", err.Error())
+	http.Error(w, "Could not check available storage", http.StatusInternalServerError)
+}
+
+// isStorageUnavailable indicates if err comes from an unhealthy storage backend
+func isStorageUnavailable(err error) bool {
+	return errors.Is(err, storage.ErrUnavailable) || errors.Is(err, storage.ErrTimeout)
+}
+
+// storageUnavailableError writes the response for a request failing on an unhealthy storage backend
+func (s *Server) storageUnavailableError(w http.ResponseWriter, err error) {
+	s.logger.Printf("Storage unavailable: %s", err.Error())
+	w.Header().Set("Retry-After", "30")
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
 type metadata struct {
 	// ContentType is the original uploading content type
 	ContentType string
@@ -589,16 +776,246 @@ type metadata struct {
 	Encrypted bool
 	// DecryptedContentType is the original uploading content type
 	DecryptedContentType string
+	// Uploaded is the time the upload started
+	Uploaded time.Time
+	// LastDownload is the time the last counted download completed
+	LastDownload time.Time
+	// DisplayName is the filename downloads are saved as, instead of the one in the URL
+	DisplayName string
+	// Description is a free text set by the owner
+	Description string
+	// BurnAfterReading deletes the file once its last allowed download completed
+	BurnAfterReading bool
+	// ScanStatus is the verdict of the scanners, files not clean cannot be downloaded
+	ScanStatus string
+	// ScanResults are the verdicts of every scanner
+	ScanResults []scanResult
+	// VirusTotal is the verdict of the last VirusTotal check
+	VirusTotal *virusTotalVerdict
+	// SHA256 is the hash of the uploaded content before encryption, when it was computed
+	SHA256 string
+	// Version is the version of the current content, starting at 1
+	Version int
+	// Versions are the previous versions kept, oldest first
+	Versions []fileVersion
+	// Trashed is the time the owner deleted the file, kept in the trash until then
+	Trashed time.Time
+	// LegalHold freezes the file, which cannot be deleted or replaced while held
+	LegalHold *legalHold
+
+	// sidecar is set when the metadata is kept in a .metadata file instead of on the object
+	sidecar bool
+	// immutable is the encoding of the fields other than the mutable ones, as read from the object
+	immutable string
+}
+
+// mutableMetadata are the fields updated on downloads and scans, and the length of uploads
+// assembled by the storage. Files with their metadata on the object keep them in the
+// .metadata sidecar, updating them not to copy the object, for the Version of the content
+// they were written for.
+type mutableMetadata struct {
+	Version       int
+	ContentLength int64
+	Downloads     int
+	LastDownload  time.Time
+	ScanStatus    string
+	ScanResults   []scanResult
+	VirusTotal    *virusTotalVerdict
+}
+
+// mutable returns the mutable fields of the metadata
+func (m metadata) mutable() mutableMetadata {
+	return mutableMetadata{
+		Version:       m.Version,
+		ContentLength: m.ContentLength,
+		Downloads:     m.Downloads,
+		LastDownload:  m.LastDownload,
+		ScanStatus:    m.ScanStatus,
+		ScanResults:   m.ScanResults,
+		VirusTotal:    m.VirusTotal,
+	}
+}
+
+// encodeImmutable encodes the metadata without its mutable fields
+func (m metadata) encodeImmutable() string {
+	m.ContentLength, m.Downloads, m.LastDownload, m.ScanStatus, m.ScanResults, m.VirusTotal = 0, 0, time.Time{}, "", nil, nil
+
+	data, _ := json.Marshal(m)
+	return string(data)
+}
+
+// metadataKey is the object metadata key holding the encoded metadata on storages supporting it
+const metadataKey = "transfer-metadata"
+
+// readMetadata retrieves the metadata of a file, either stored on the object itself
+// or in its legacy .metadata sidecar
+func (s *Server) readMetadata(ctx context.Context, token, filename string) (metadata, error) {
+	var m metadata
+
+	if metadataStorage, ok := storage.Capability[storage.MetadataStorage](s.storage); ok {
+		objectMetadata, err := metadataStorage.GetMetadata(ctx, token, filename)
+		if isStorageUnavailable(err) {
+			return m, err
+		} else if err == nil && objectMetadata[metadataKey] != "" {
+			data, err := base64.StdEncoding.DecodeString(objectMetadata[metadataKey])
+			if err != nil {
+				return m, err
+			}
+
+			if err = json.Unmarshal(data, &m); err != nil {
+				return m, err
+			}
+
+			m.immutable = m.encodeImmutable()
+			return m, s.readMutable(ctx, token, filename, &m)
+		}
+	}
+
+	r, _, err := s.storage.Get(ctx, token, fmt.Sprintf("%s.metadata", filename), nil)
+	defer storage.CloseCheck(r)
+
+	if err != nil {
+		return m, err
+	}
+
+	err = json.NewDecoder(r).Decode(&m)
+	m.sidecar = true
+
+	return m, err
+}
+
+// readMutable applies the mutable fields kept in the .metadata sidecar of a file with its
+// metadata on the object, unless they were written for another version of the content
+func (s *Server) readMutable(ctx context.Context, token, filename string, m *metadata) error {
+	r, _, err := s.storage.Get(ctx, token, fmt.Sprintf("%s.metadata", filename), nil)
+	defer storage.CloseCheck(r)
+
+	if s.storage.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var mutable mutableMetadata
+	if err = json.NewDecoder(r).Decode(&mutable); err != nil {
+		return err
+	}
+
+	if mutable.Version == m.Version {
+		m.ContentLength, m.Downloads, m.LastDownload = mutable.ContentLength, mutable.Downloads, mutable.LastDownload
+		m.ScanStatus, m.ScanResults, m.VirusTotal = mutable.ScanStatus, mutable.ScanResults, mutable.VirusTotal
+	}
+
+	return nil
+}
+
+// writeMetadata saves the metadata of an existing file where it was read from, moving
+// it to a .metadata sidecar once it outgrows the object metadata. Changes of the mutable
+// fields only are written to the sidecar, the object being copied to update its metadata.
+func (s *Server) writeMetadata(ctx context.Context, token, filename string, m metadata) error {
+	metadataStorage, ok := storage.Capability[storage.MetadataStorage](s.storage)
+	if !ok || m.sidecar {
+		return s.writeSidecar(ctx, token, filename, m)
+	}
+
+	if m.immutable != "" && m.encodeImmutable() == m.immutable {
+		return s.writeSidecar(ctx, token, filename, m.mutable())
+	}
+
+	objectMetadata, err := m.objectMetadata()
+	if err == errMetadataTooLarge {
+		if err = s.writeSidecar(ctx, token, filename, m); err != nil {
+			return err
+		}
+
+		// the object metadata is cleared for the sidecar to be read
+		return metadataStorage.UpdateMetadata(ctx, token, filename, map[string]string{})
+	} else if err != nil {
+		return errors.New("could not encode metadata")
+	}
+
+	if err = metadataStorage.UpdateMetadata(ctx, token, filename, objectMetadata); err != nil {
+		return err
+	}
+
+	// mutable fields already in the sidecar would override the ones on the object
+	return s.writeSidecar(ctx, token, filename, m.mutable())
+}
+
+// writeSidecar saves the metadata, or its mutable fields, of a file in its .metadata sidecar
+func (s *Server) writeSidecar(ctx context.Context, token, filename string, m any) error {
+	buffer := &bytes.Buffer{}
+	if err := json.NewEncoder(buffer).Encode(m); err != nil {
+		return errors.New("could not encode metadata")
+	}
+
+	return s.storage.Put(ctx, token, fmt.Sprintf("%s.metadata", filename), bytes.NewReader(buffer.Bytes()), "text/json", uint64(buffer.Len()))
+}
+
+// putWithMetadata saves a new file along with its metadata, on the object itself
+// when the storage supports it and the metadata fits, or in a .metadata sidecar otherwise
+func (s *Server) putWithMetadata(ctx context.Context, token, filename string, reader io.Reader, contentType string, contentLength uint64, m metadata) error {
+	if metadataStorage, ok := storage.Capability[storage.MetadataStorage](s.storage); ok {
+		objectMetadata, err := m.objectMetadata()
+		if err == nil {
+			return metadataStorage.PutWithMetadata(ctx, token, filename, reader, contentType, contentLength, objectMetadata)
+		} else if err != errMetadataTooLarge {
+			return errors.New("could not encode metadata")
+		}
+	}
+
+	m.sidecar = true
+	if err := s.writeMetadata(ctx, token, filename, m); err != nil {
+		return err
+	}
+
+	return s.storage.Put(ctx, token, filename, reader, contentType, contentLength)
+}
+
+// maxObjectMetadataSize bounds the encoded metadata kept on objects, S3 limiting the
+// user metadata of an object to 2 KB
+const maxObjectMetadataSize = 1800
+
+// errMetadataTooLarge is returned for metadata not fitting in the object metadata
+var errMetadataTooLarge = errors.New("metadata too large for the object metadata")
+
+// objectMetadata encodes the metadata as object metadata, base64 keeping it ascii-safe
+func (m metadata) objectMetadata() (map[string]string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if len(encoded) > maxObjectMetadataSize {
+		return nil, errMetadataTooLarge
+	}
+
+	return map[string]string{metadataKey: encoded}, nil
 }
 
-func metadataForRequest(contentType string, contentLength int64, randomTokenLength int, r *http.Request) metadata {
+// errInvalidExpiry is returned for expiry request headers which cannot be honoured
+var errInvalidExpiry = errors.New("invalid expiry")
+
+// expiryHeaders are the request headers giving the lifetime of a file in a unit
+var expiryHeaders = []struct {
+	name string
+	unit time.Duration
+}{
+	{"Max-Days", 24 * time.Hour},
+	{"Max-Hours", time.Hour},
+	{"Max-Minutes", time.Minute},
+}
+
+func (s *Server) metadataForRequest(contentType string, contentLength int64, r *http.Request) (metadata, error) {
 	metadata := metadata{
 		ContentType:   strings.ToLower(contentType),
 		ContentLength: contentLength,
 		MaxDate:       time.Time{},
 		Downloads:     0,
 		MaxDownloads:  -1,
-		DeletionToken: token(randomTokenLength) + token(randomTokenLength),
+		DeletionToken: token(s.randomTokenLength) + token(s.randomTokenLength),
+		Uploaded:      time.Now().UTC(),
 	}
 
 	if v := r.Header.Get("Max-Downloads"); v == "" {
@@ -607,12 +1024,34 @@ func metadataForRequest(contentType string, contentLength int64, randomTokenLeng
 		metadata.MaxDownloads = v
 	}
 
-	if v := r.Header.Get("Max-Days"); v == "" {
-	} else if v, err := strconv.Atoi(v); err != nil {
-	} else {
-		metadata.MaxDate = time.Now().Add(time.Hour * 24 * time.Duration(v))
+	if v, err := strconv.ParseBool(r.Header.Get("X-Burn-After-Reading")); err == nil && v {
+		metadata.BurnAfterReading = true
+		if metadata.MaxDownloads == -1 {
+			metadata.MaxDownloads = 1
+		}
+	}
+
+	if s.maxDownloads > 0 && (metadata.MaxDownloads == -1 || metadata.MaxDownloads > s.maxDownloads) {
+		metadata.MaxDownloads = s.maxDownloads
+	}
+
+	now := time.Now()
+
+	maxDate, err := requestMaxDate(r, now)
+	if err != nil {
+		return metadata, err
+	}
+
+	if maxDate.IsZero() && s.defaultRetention > 0 {
+		maxDate = now.Add(s.defaultRetention)
+	}
+
+	if s.maxRetention > 0 && (maxDate.IsZero() || maxDate.After(now.Add(s.maxRetention))) {
+		maxDate = now.Add(s.maxRetention)
 	}
 
+	metadata.MaxDate = maxDate
+
 	if password := r.Header.Get("X-Encrypt-Password"); password != "" {
 		metadata.Encrypted = true
 		metadata.ContentType = "text/plain; charset=utf-8"
@@ -621,7 +1060,56 @@ func metadataForRequest(contentType string, contentLength int64, randomTokenLeng
 		metadata.Encrypted = false
 	}
 
-	return metadata
+	return metadata, nil
+}
+
+// requestMaxDate returns the expiry date requested by the Max-Days, Max-Hours,
+// Max-Minutes and Expires headers of r, the earliest one if several are given
+func requestMaxDate(r *http.Request, now time.Time) (time.Time, error) {
+	var maxDate time.Time
+	earliest := func(date time.Time) {
+		if maxDate.IsZero() || date.Before(maxDate) {
+			maxDate = date
+		}
+	}
+
+	for _, header := range expiryHeaders {
+		v := r.Header.Get(header.name)
+		if v == "" {
+			continue
+		}
+
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || n > int64(math.MaxInt64/header.unit) {
+			return maxDate, fmt.Errorf("%w: %s must be a positive number smaller than 290 years", errInvalidExpiry, header.name)
+		}
+
+		earliest(now.Add(time.Duration(n) * header.unit))
+	}
+
+	if v := r.Header.Get("Expires"); v != "" {
+		date, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return maxDate, fmt.Errorf("%w: Expires must be an RFC 3339 date", errInvalidExpiry)
+		} else if !date.After(now) {
+			return maxDate, fmt.Errorf("%w: Expires must be in the future", errInvalidExpiry)
+		}
+
+		earliest(date)
+	}
+
+	return maxDate, nil
+}
+
+// setLimitHeaders echoes the expiry date and download limit applied to a file
+func setLimitHeaders(w http.ResponseWriter, m metadata) {
+	if !m.MaxDate.IsZero() {
+		w.Header().Set("X-Expires", m.MaxDate.UTC().Format(time.RFC3339))
+	}
+
+	if m.MaxDownloads != -1 {
+		w.Header().Set("X-Max-Downloads", strconv.Itoa(m.MaxDownloads))
+	}
 }
 
 func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
@@ -633,9 +1121,54 @@ func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
 
 	defer storage.CloseCheck(r.Body)
 
-	reader := r.Body
+	token, release, err := s.uploadToken(r)
+	if err != nil {
+		s.tokenError(w, err)
+		return
+	}
+	defer release()
+
+	s.storeUpload(w, r, token, filename, r.Body, r.Header.Get("Content-Type"), contentLength, false)
+}
+
+// storeUpload runs an upload of contentLength bytes, or of unknown length when
+// not positive, through the prescan, size checks, content type detection and
+// encryption before storing it under token and answering with its URL. A new
+// version replaces the content of an existing file, keeping its limits.
+func (s *Server) storeUpload(w http.ResponseWriter, r *http.Request, token, filename string, reader io.ReadCloser, declaredContentType string, contentLength int64, newVersion bool) {
+	head, reader, err := readHead(reader)
+	if err != nil {
+		s.logger.Printf("%s", err.Error())
+		http.Error(w, "Could not read file", http.StatusInternalServerError)
+		return
+	}
+
+	contentType := detectContentType(head, filename, declaredContentType)
+
+	rule := s.uploadRule(r)
+	if err := rule.check(filename, contentType, head); err != nil {
+		s.policyError(w, err)
+		return
+	}
+
+	var scanStatus string
+	var scanResults []scanResult
+	if s.scanAfterStoring(r) {
+		scanStatus = scanStatusPending
+	}
 
-	if contentLength < 1 || s.performClamavPrescan {
+	h := s.uploadHasher(r.Header.Get("X-Encrypt-Password") != "")
+	spool := contentLength < 1 || s.scanBeforeStoring(r) || rule.inspectsArchive(head) || h != nil
+	if contentLength < 0 {
+		contentLength = 0
+	}
+
+	if err := s.checkStorageSpace(r.Context(), contentLength, spool); err != nil {
+		s.storageSpaceError(w, err)
+		return
+	}
+
+	if spool {
 		file, err := os.CreateTemp(s.tempPath, "transfer-")
 		defer s.cleanTmpFile(file)
 		if err != nil {
@@ -644,9 +1177,20 @@ func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// queue file to disk, because s3 needs content length
-		// and clamav prescan scans a file
-		n, err := io.Copy(file, r.Body)
+		// queue file to disk, because s3 needs content length,
+		// scanning and hashing it meanwhile
+		src := io.Reader(reader)
+		if h != nil {
+			src = io.TeeReader(reader, h)
+		}
+
+		var n int64
+		if s.scanBeforeStoring(r) {
+			n, scanStatus, scanResults, err = s.copyAndScan(r.Context(), file, src)
+		} else {
+			n, err = io.Copy(file, src)
+		}
+
 		if err != nil {
 			s.logger.Printf("%s", err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -664,21 +1208,23 @@ func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
 
 		contentLength = n
 
-		if s.performClamavPrescan {
-			status, err := s.performScan(file.Name())
-			if err != nil {
-				s.logger.Printf("%s", err.Error())
-				http.Error(w, "Could not perform prescan", http.StatusInternalServerError)
-				return
-			}
+		if err := s.checkBlocklist(h); err != nil {
+			s.blockedError(w, err)
+			return
+		}
 
-			if status != clamavScanStatusOK {
-				s.logger.Printf("prescan positive: %s", status)
-				http.Error(w, "Clamav prescan found a virus", http.StatusPreconditionFailed)
+		if rule.inspectsArchive(head) {
+			if err := rule.checkArchive(file, head); err != nil {
+				s.policyError(w, err)
 				return
 			}
 		}
 
+		if s.scanBeforeStoring(r) && scanStatus != scanStatusClean {
+			s.scanVerdictError(w, scanStatus, scanResults)
+			return
+		}
+
 		reader = file
 	}
 
@@ -694,41 +1240,58 @@ func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	contentType := mime.TypeByExtension(filepath.Ext(vars["filename"]))
-
-	token := token(s.randomTokenLength)
-
-	metadata := metadataForRequest(contentType, contentLength, s.randomTokenLength, r)
-
-	buffer := &bytes.Buffer{}
-	if err := json.NewEncoder(buffer).Encode(metadata); err != nil {
-		s.logger.Printf("%s", err.Error())
-		http.Error(w, "Could not encode metadata", http.StatusInternalServerError)
-		return
-	} else if !metadata.MaxDate.IsZero() && time.Now().After(metadata.MaxDate) {
-		s.logger.Print("Invalid MaxDate")
-		http.Error(w, "Invalid MaxDate, make sure Max-Days is smaller than 290 years", http.StatusBadRequest)
+	if err := s.checkStorageSpace(r.Context(), contentLength, false); err != nil {
+		s.storageSpaceError(w, err)
 		return
-	} else if err := s.storage.Put(r.Context(), token, fmt.Sprintf("%s.metadata", filename), buffer, "text/json", uint64(buffer.Len())); err != nil {
-		s.logger.Printf("%s", err.Error())
-		http.Error(w, "Could not save metadata", http.StatusInternalServerError)
+	}
+
+	metadata, err := s.metadataForRequest(contentType, contentLength, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	metadata.ScanStatus, metadata.ScanResults = scanStatus, scanResults
+	if h != nil {
+		metadata.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+
 	s.logger.Printf("Uploading %s %s %d %s", token, filename, contentLength, contentType)
 
-	reader, err := attachEncryptionReader(reader, r.Header.Get("X-Encrypt-Password"))
+	reader, err = attachEncryptionReader(reader, r.Header.Get("X-Encrypt-Password"))
 	if err != nil {
 		http.Error(w, "Could not crypt file", http.StatusInternalServerError)
 		return
 	}
 
-	if err = s.storage.Put(r.Context(), token, filename, reader, contentType, uint64(contentLength)); err != nil {
+	if newVersion {
+		metadata, err = s.storeVersion(r.Context(), token, filename, reader, contentType, uint64(contentLength), metadata)
+	} else {
+		err = s.putWithMetadata(r.Context(), token, filename, reader, contentType, uint64(contentLength), metadata)
+	}
+
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if legalHoldError(w, err) {
+		return
+	} else if err != nil {
 		s.logger.Printf("Error putting new file: %s", err.Error())
 		http.Error(w, "Could not save file", http.StatusInternalServerError)
 		return
 	}
 
+	if metadata.ScanStatus == scanStatusPending {
+		s.enqueueScan(token, filename)
+	}
+
+	// new versions update the size listed in the collection of the file, if any
+	if newVersion {
+		if _, err = s.addToCollection(r.Context(), token, filename, contentLength, false); err != nil {
+			s.logger.Printf("Error updating %s/%s in collection: %s", token, filename, err.Error())
+		}
+	}
+
 	// w.Statuscode = 200
 
 	w.Header().Set("Content-Type", "text/plain")
@@ -738,6 +1301,8 @@ func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
 	deleteURL, _ := url.Parse(path.Join(s.proxyPath, token, filename, metadata.DeletionToken))
 
 	w.Header().Set("X-Url-Delete", resolveURL(r, deleteURL, s.proxyPort))
+	w.Header().Set("X-Version", strconv.Itoa(metadata.currentVersion()))
+	setLimitHeaders(w, metadata)
 
 	_, _ = w.Write([]byte(resolveURL(r, relativeURL, s.proxyPort)))
 }
@@ -851,6 +1416,11 @@ func (metadata metadata) remainingLimitHeaderValues() (remainingDownloads, remai
 	return remainingDownloads, remainingDays
 }
 
+// expired indicates if the download limit or the expiry date of the file was reached
+func (m metadata) expired() bool {
+	return m.MaxDownloads != -1 && m.Downloads >= m.MaxDownloads || !m.MaxDate.IsZero() && time.Now().After(m.MaxDate) || m.trashed()
+}
+
 func (s *Server) lock(token, filename string) {
 	key := path.Join(token, filename)
 
@@ -867,61 +1437,55 @@ func (s *Server) unlock(token, filename string) {
 	lock.(*sync.Mutex).Unlock()
 }
 
-func (s *Server) checkMetadata(ctx context.Context, token, filename string, increaseDownload bool) (metadata, error) {
+func (s *Server) checkMetadata(ctx context.Context, token, filename string) (metadata, error) {
+	_, metadata, err := s.checkVersion(ctx, token, filename, "")
+	return metadata, err
+}
+
+// checkVersion is checkMetadata for the version of a file requested, the current one when
+// empty, returning the object holding it. The scans checked are the ones of that version.
+func (s *Server) checkVersion(ctx context.Context, token, filename, requested string) (string, metadata, error) {
 	s.lock(token, filename)
 	defer s.unlock(token, filename)
 
-	var metadata metadata
-
-	r, _, err := s.storage.Get(ctx, token, fmt.Sprintf("%s.metadata", filename), nil)
-	defer storage.CloseCheck(r)
-
+	metadata, err := s.readMetadata(ctx, token, filename)
 	if err != nil {
-		return metadata, err
+		return "", metadata, err
 	}
 
-	if err := json.NewDecoder(r).Decode(&metadata); err != nil {
-		return metadata, err
+	if metadata.trashed() {
+		return "", metadata, errors.New("file is in the trash")
 	} else if metadata.MaxDownloads != -1 && metadata.Downloads >= metadata.MaxDownloads {
-		return metadata, errors.New("maxDownloads expired")
+		return "", metadata, errors.New("maxDownloads expired")
 	} else if !metadata.MaxDate.IsZero() && time.Now().After(metadata.MaxDate) {
-		return metadata, errors.New("maxDate expired")
-	} else if metadata.MaxDownloads != -1 && increaseDownload {
-		// todo(nl5887): mutex?
-
-		// update number of downloads
-		metadata.Downloads++
-
-		buffer := &bytes.Buffer{}
-		if err := json.NewEncoder(buffer).Encode(metadata); err != nil {
-			return metadata, errors.New("could not encode metadata")
-		} else if err := s.storage.Put(ctx, token, fmt.Sprintf("%s.metadata", filename), buffer, "text/json", uint64(buffer.Len())); err != nil {
-			return metadata, errors.New("could not save metadata")
-		}
+		return "", metadata, errors.New("maxDate expired")
 	}
 
-	return metadata, nil
+	object, metadata, err := metadata.requestedVersion(filename, requested)
+	if err != nil {
+		return "", metadata, err
+	} else if err := metadata.scanError(); err != nil {
+		return "", metadata, err
+	}
+
+	return object, metadata, nil
 }
 
 func (s *Server) checkDeletionToken(ctx context.Context, deletionToken, token, filename string) error {
 	s.lock(token, filename)
 	defer s.unlock(token, filename)
 
-	var metadata metadata
-
-	r, _, err := s.storage.Get(ctx, token, fmt.Sprintf("%s.metadata", filename), nil)
-	defer storage.CloseCheck(r)
-
+	metadata, err := s.readMetadata(ctx, token, filename)
 	if s.storage.IsNotExist(err) {
 		return errors.New("metadata doesn't exist")
 	} else if err != nil {
 		return err
 	}
 
-	if err := json.NewDecoder(r).Decode(&metadata); err != nil {
-		return err
-	} else if metadata.DeletionToken != deletionToken {
+	if metadata.DeletionToken != deletionToken {
 		return errors.New("deletion token doesn't match")
+	} else if metadata.trashed() {
+		return errors.New("file is in the trash")
 	}
 
 	return nil
@@ -932,9 +1496,24 @@ func (s *Server) purgeHandler() {
 	go func() {
 		for {
 			<-ticker.C
-			err := s.storage.Purge(context.TODO(), s.purgeDays)
-			if err != nil {
-				s.logger.Printf("error cleaning up expired files: %v", err)
+			if s.purgeDays > 0 {
+				err := s.storage.Purge(context.TODO(), s.purgeDays)
+				if err != nil {
+					s.logger.Printf("error cleaning up expired files: %v", err)
+				}
+			}
+
+			if s.trashRetention > 0 {
+				if err := s.emptyTrash(context.TODO()); err != nil {
+					s.logger.Printf("error emptying the trash: %v", err)
+				}
+			}
+
+			if evicter, ok := storage.Capability[storage.Evicter](s.storage); ok {
+				err := evicter.Evict(context.TODO())
+				if err != nil {
+					s.logger.Printf("error evicting files: %v", err)
+				}
 			}
 		}
 	}()
@@ -947,16 +1526,41 @@ func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	filename := vars["filename"]
 	deletionToken := vars["deletionToken"]
 
-	if err := s.checkDeletionToken(r.Context(), deletionToken, token, filename); err != nil {
+	if err := s.checkDeletionToken(r.Context(), deletionToken, token, filename); isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
 		s.logger.Printf("Error metadata: %s", err.Error())
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
-	err := s.storage.Delete(r.Context(), token, filename)
+	if s.trashRetention > 0 {
+		m, err := s.trashFile(r.Context(), token, filename)
+		if isStorageUnavailable(err) {
+			s.storageUnavailableError(w, err)
+			return
+		} else if legalHoldError(w, err) {
+			return
+		} else if err != nil {
+			s.logger.Printf("%s", err.Error())
+			http.Error(w, "Could not delete file.", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("X-Restore-Until", m.Trashed.Add(s.trashRetention).Format(time.RFC3339))
+		return
+	}
+
+	err := s.deleteFile(r.Context(), token, filename)
 	if s.storage.IsNotExist(err) {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
+	} else if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if legalHoldError(w, err) {
+		return
 	} else if err != nil {
 		s.logger.Printf("%s", err.Error())
 		http.Error(w, "Could not delete file.", http.StatusInternalServerError)
@@ -964,61 +1568,116 @@ func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) zipHandler(w http.ResponseWriter, r *http.Request) {
+// archiveFiles returns the keys to bundle in an archive along with its filename:
+// the files listed in the path, or every file of the collection of the token
+func (s *Server) archiveFiles(r *http.Request, extension string) ([]string, string, error) {
 	vars := mux.Vars(r)
 
-	files := vars["files"]
+	token := vars["token"]
+	if token == "" {
+		return strings.Split(vars["files"], ","), fmt.Sprintf("transfersh-%d.%s", uint16(time.Now().UnixNano()), extension), nil
+	}
 
-	zipfilename := fmt.Sprintf("transfersh-%d.zip", uint16(time.Now().UnixNano()))
+	c, err := s.readCollection(r.Context(), token)
+	if err != nil {
+		return nil, "", err
+	}
 
-	w.Header().Set("Content-Type", "application/zip")
-	commonHeader(w, zipfilename)
+	var keys []string
+	for _, f := range c.Files {
+		keys = append(keys, path.Join(token, f.Filename))
+	}
 
-	zw := zip.NewWriter(w)
+	return keys, fmt.Sprintf("%s.%s", token, extension), nil
+}
 
-	for _, key := range strings.Split(files, ",") {
-		key = resolveKey(key, s.proxyPath)
+// archiveFile adds the file of key to an archive through add, files which cannot be
+// downloaded being skipped. Its download reservation and reader are only held while
+// it is added, not until the whole archive is written.
+func (s *Server) archiveFile(r *http.Request, key string, add func(filename string, contentLength uint64, reader io.Reader) error) error {
+	key = resolveKey(key, s.proxyPath)
 
-		token := strings.Split(key, "/")[0]
-		filename := sanitize(strings.Split(key, "/")[1])
+	token := strings.Split(key, "/")[0]
+	filename := sanitize(strings.Split(key, "/")[1])
 
-		if _, err := s.checkMetadata(r.Context(), token, filename, true); err != nil {
-			s.logger.Printf("Error metadata: %s", err.Error())
-			continue
-		}
+	metadata, err := s.checkMetadata(r.Context(), token, filename)
+	if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		return nil
+	}
 
-		reader, _, err := s.storage.Get(r.Context(), token, filename, nil)
-		defer storage.CloseCheck(reader)
+	release, ok := s.reserveDownload(r, token, filename, metadata)
+	if !ok {
+		s.logger.Printf("No download left of %s/%s, skipping it", token, filename)
+		return nil
+	}
+	defer release()
 
-		if err != nil {
-			if s.storage.IsNotExist(err) {
-				http.Error(w, "File not found", 404)
-				return
-			}
+	reader, contentLength, err := s.storage.Get(r.Context(), token, filename, nil)
+	defer storage.CloseCheck(reader)
 
-			s.logger.Printf("%s", err.Error())
-			http.Error(w, "Could not retrieve file.", http.StatusInternalServerError)
-			return
-		}
+	if err != nil {
+		return err
+	}
 
-		header := &zip.FileHeader{
-			Name:   strings.Split(key, "/")[1],
-			Method: zip.Store,
+	if err = add(filename, contentLength, reader); err != nil {
+		return err
+	}
 
-			Modified: time.Now().UTC(),
-		}
+	release()
+	if !s.isPreviewBot(r) {
+		s.countDownload(context.WithoutCancel(r.Context()), token, filename)
+	}
 
-		fw, err := zw.CreateHeader(header)
+	return nil
+}
 
-		if err != nil {
-			s.logger.Printf("%s", err.Error())
-			http.Error(w, "Internal server error.", http.StatusInternalServerError)
-			return
-		}
+// archiveError writes the response for a file which could not be added to an archive
+func (s *Server) archiveError(w http.ResponseWriter, err error) {
+	if s.storage.IsNotExist(err) {
+		http.Error(w, "File not found", 404)
+		return
+	}
 
-		if _, err = io.Copy(fw, reader); err != nil {
-			s.logger.Printf("%s", err.Error())
-			http.Error(w, "Internal server error.", http.StatusInternalServerError)
+	s.logger.Printf("%s", err.Error())
+	http.Error(w, "Could not retrieve file.", http.StatusInternalServerError)
+}
+
+func (s *Server) zipHandler(w http.ResponseWriter, r *http.Request) {
+	keys, zipfilename, err := s.archiveFiles(r, "zip")
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error collection: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	commonHeader(w, zipfilename)
+
+	zw := zip.NewWriter(w)
+
+	for _, key := range keys {
+		err = s.archiveFile(r, key, func(filename string, _ uint64, reader io.Reader) error {
+			header := &zip.FileHeader{
+				Name:   filename,
+				Method: zip.Store,
+
+				Modified: time.Now().UTC(),
+			}
+
+			fw, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(fw, reader)
+			return err
+		})
+		if err != nil {
+			s.archiveError(w, err)
 			return
 		}
 	}
@@ -1030,12 +1689,33 @@ func (s *Server) zipHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) tarGzHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
+// addToTar returns an archiveFile callback adding files to zw
+func addToTar(zw *tar.Writer) func(filename string, contentLength uint64, reader io.Reader) error {
+	return func(filename string, contentLength uint64, reader io.Reader) error {
+		header := &tar.Header{
+			Name: filename,
+			Size: int64(contentLength),
+		}
+
+		if err := zw.WriteHeader(header); err != nil {
+			return err
+		}
 
-	files := vars["files"]
+		_, err := io.Copy(zw, reader)
+		return err
+	}
+}
 
-	tarfilename := fmt.Sprintf("transfersh-%d.tar.gz", uint16(time.Now().UnixNano()))
+func (s *Server) tarGzHandler(w http.ResponseWriter, r *http.Request) {
+	keys, tarfilename, err := s.archiveFiles(r, "tar.gz")
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error collection: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/x-gzip")
 	commonHeader(w, tarfilename)
@@ -1046,57 +1726,24 @@ func (s *Server) tarGzHandler(w http.ResponseWriter, r *http.Request) {
 	zw := tar.NewWriter(gw)
 	defer storage.CloseCheck(zw)
 
-	for _, key := range strings.Split(files, ",") {
-		key = resolveKey(key, s.proxyPath)
-
-		token := strings.Split(key, "/")[0]
-		filename := sanitize(strings.Split(key, "/")[1])
-
-		if _, err := s.checkMetadata(r.Context(), token, filename, true); err != nil {
-			s.logger.Printf("Error metadata: %s", err.Error())
-			continue
-		}
-
-		reader, contentLength, err := s.storage.Get(r.Context(), token, filename, nil)
-		defer storage.CloseCheck(reader)
-
-		if err != nil {
-			if s.storage.IsNotExist(err) {
-				http.Error(w, "File not found", 404)
-				return
-			}
-
-			s.logger.Printf("%s", err.Error())
-			http.Error(w, "Could not retrieve file.", http.StatusInternalServerError)
-			return
-		}
-
-		header := &tar.Header{
-			Name: strings.Split(key, "/")[1],
-			Size: int64(contentLength),
-		}
-
-		err = zw.WriteHeader(header)
-		if err != nil {
-			s.logger.Printf("%s", err.Error())
-			http.Error(w, "Internal server error.", http.StatusInternalServerError)
-			return
-		}
-
-		if _, err = io.Copy(zw, reader); err != nil {
-			s.logger.Printf("%s", err.Error())
-			http.Error(w, "Internal server error.", http.StatusInternalServerError)
+	for _, key := range keys {
+		if err = s.archiveFile(r, key, addToTar(zw)); err != nil {
+			s.archiveError(w, err)
 			return
 		}
 	}
 }
 
 func (s *Server) tarHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	files := vars["files"]
-
-	tarfilename := fmt.Sprintf("transfersh-%d.tar", uint16(time.Now().UnixNano()))
+	keys, tarfilename, err := s.archiveFiles(r, "tar")
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error collection: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/x-tar")
 	commonHeader(w, tarfilename)
@@ -1104,46 +1751,9 @@ func (s *Server) tarHandler(w http.ResponseWriter, r *http.Request) {
 	zw := tar.NewWriter(w)
 	defer storage.CloseCheck(zw)
 
-	for _, key := range strings.Split(files, ",") {
-		key = resolveKey(key, s.proxyPath)
-
-		token := strings.Split(key, "/")[0]
-		filename := strings.Split(key, "/")[1]
-
-		if _, err := s.checkMetadata(r.Context(), token, filename, true); err != nil {
-			s.logger.Printf("Error metadata: %s", err.Error())
-			continue
-		}
-
-		reader, contentLength, err := s.storage.Get(r.Context(), token, filename, nil)
-		defer storage.CloseCheck(reader)
-
-		if err != nil {
-			if s.storage.IsNotExist(err) {
-				http.Error(w, "File not found", 404)
-				return
-			}
-
-			s.logger.Printf("%s", err.Error())
-			http.Error(w, "Could not retrieve file.", http.StatusInternalServerError)
-			return
-		}
-
-		header := &tar.Header{
-			Name: strings.Split(key, "/")[1],
-			Size: int64(contentLength),
-		}
-
-		err = zw.WriteHeader(header)
-		if err != nil {
-			s.logger.Printf("%s", err.Error())
-			http.Error(w, "Internal server error.", http.StatusInternalServerError)
-			return
-		}
-
-		if _, err = io.Copy(zw, reader); err != nil {
-			s.logger.Printf("%s", err.Error())
-			http.Error(w, "Internal server error.", http.StatusInternalServerError)
+	for _, key := range keys {
+		if err = s.archiveFile(r, key, addToTar(zw)); err != nil {
+			s.archiveError(w, err)
 			return
 		}
 	}
@@ -1155,19 +1765,30 @@ func (s *Server) headHandler(w http.ResponseWriter, r *http.Request) {
 	token := vars["token"]
 	filename := vars["filename"]
 
-	metadata, err := s.checkMetadata(r.Context(), token, filename, false)
+	object, metadata, err := s.checkVersion(r.Context(), token, filename, r.URL.Query().Get("version"))
 
-	if err != nil {
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if s.scanStatusError(w, err) {
+		return
+	} else if errors.Is(err, errVersionNotFound) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		s.logger.Printf("Error metadata: %s", err.Error())
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
 	contentType := metadata.ContentType
-	contentLength, err := s.storage.Head(r.Context(), token, filename)
+	contentLength, err := s.storage.Head(r.Context(), token, object)
 	if s.storage.IsNotExist(err) {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
+	} else if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
 	} else if err != nil {
 		s.logger.Printf("%s", err.Error())
 		http.Error(w, "Could not retrieve file.", http.StatusInternalServerError)
@@ -1181,7 +1802,10 @@ func (s *Server) headHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "close")
 	w.Header().Set("X-Remaining-Downloads", remainingDownloads)
 	w.Header().Set("X-Remaining-Days", remainingDays)
+	w.Header().Set("X-Version", strconv.Itoa(metadata.currentVersion()))
+	setLimitHeaders(w, metadata)
 	w.Header().Set("Vary", "Range, Referer, X-Decrypt-Password")
+	setVirusTotalHeaders(w, metadata)
 
 	if s.storage.IsRangeSupported() {
 		w.Header().Set("Accept-Ranges", "bytes")
@@ -1195,26 +1819,95 @@ func (s *Server) getHandler(w http.ResponseWriter, r *http.Request) {
 	token := vars["token"]
 	filename := vars["filename"]
 
-	metadata, err := s.checkMetadata(r.Context(), token, filename, true)
+	// previous versions are served from their own objects, their downloads counting for the file
+	object, metadata, err := s.checkVersion(r.Context(), token, filename, r.URL.Query().Get("version"))
 
-	if err != nil {
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if s.scanStatusError(w, err) {
+		return
+	} else if errors.Is(err, errVersionNotFound) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		s.logger.Printf("Error metadata: %s", err.Error())
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
-	var rng *storage.Range
-	if r.Header.Get("Range") != "" {
-		rng = storage.ParseRange(r.Header.Get("Range"))
+	rng := storage.ParseRange(r.Header.Get("Range"))
+	client := downloadClient(r)
+
+	// downloads are counted once completed, the range requests of a client once they
+	// covered the whole file, holding a single download of limited files meanwhile
+	limited := metadata.MaxDownloads != -1
+	counted := !s.isPreviewBot(r)
+	if !counted && s.burnsAfterReading(metadata) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	} else if limited && counted && rng != nil {
+		if !s.downloads.reserveRanges(client, token, filename, object, metadata) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+	} else if limited && counted {
+		release, ok := s.downloads.reserve(token, filename, metadata)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		defer release()
 	}
 
 	contentType := metadata.ContentType
-	reader, contentLength, err := s.storage.Get(r.Context(), token, filename, rng)
+
+	var disposition string
+	if action == "inline" {
+		disposition = "inline"
+		/*
+			metadata.ContentType is unable to determine the type of the content,
+			So add text/plain in this case to fix XSS related issues/
+		*/
+		if strings.TrimSpace(contentType) == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+	} else {
+		disposition = "attachment"
+	}
+
+	password := r.Header.Get("X-Decrypt-Password")
+
+	downloadName := metadata.downloadName(filename)
+
+	// decryption, sanitizing and enforcing download limits need the bytes to flow through us
+	if presigner, ok := storage.Capability[storage.Presigner](s.storage); ok && s.downloadRedirectExpiry > 0 && len(password) == 0 && !(disposition == "inline" && canContainsXSS(contentType)) && !limited {
+		contentDisposition := fmt.Sprintf(`%s; filename="%s"`, disposition, downloadName)
+
+		presignedURL, err := presigner.PresignGet(r.Context(), token, object, contentType, contentDisposition, s.downloadRedirectExpiry)
+		if err == nil {
+			// whether redirected downloads complete is unknown, they count when redirected
+			if counted {
+				s.countDownload(context.WithoutCancel(r.Context()), token, filename)
+			}
+
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, presignedURL, http.StatusFound)
+			return
+		}
+
+		s.logger.Printf("Error presigning download, falling back to streaming: %s", err.Error())
+	}
+
+	reader, contentLength, err := s.storage.Get(r.Context(), token, object, rng)
 	defer storage.CloseCheck(reader)
 
 	if s.storage.IsNotExist(err) {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
+	} else if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
 	} else if err != nil {
 		s.logger.Printf("%s", err.Error())
 		http.Error(w, "Could not retrieve file.", http.StatusInternalServerError)
@@ -1231,29 +1924,16 @@ func (s *Server) getHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var disposition string
-	if action == "inline" {
-		disposition = "inline"
-		/*
-			metadata.ContentType is unable to determine the type of the content,
-			So add text/plain in this case to fix XSS related issues/
-		*/
-		if strings.TrimSpace(contentType) == "" {
-			contentType = "text/plain; charset=utf-8"
-		}
-	} else {
-		disposition = "attachment"
-	}
-
 	remainingDownloads, remainingDays := metadata.remainingLimitHeaderValues()
 
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`%s; filename="%s"`, disposition, filename))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`%s; filename="%s"`, disposition, downloadName))
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("X-Remaining-Downloads", remainingDownloads)
 	w.Header().Set("X-Remaining-Days", remainingDays)
+	w.Header().Set("X-Version", strconv.Itoa(metadata.currentVersion()))
+	setLimitHeaders(w, metadata)
 
-	password := r.Header.Get("X-Decrypt-Password")
 	reader, err = attachDecryptionReader(reader, password)
 	if err != nil {
 		http.Error(w, "Could not decrypt file", http.StatusInternalServerError)
@@ -1266,6 +1946,7 @@ func (s *Server) getHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Content-Length", strconv.FormatUint(contentLength, 10))
 	w.Header().Set("Vary", "Range, Referer, X-Decrypt-Password")
 
@@ -1277,7 +1958,30 @@ func (s *Server) getHandler(w http.ResponseWriter, r *http.Request) {
 		reader = io.NopCloser(bluemonday.UGCPolicy().SanitizeReader(reader))
 	}
 
-	if _, err = io.Copy(w, reader); err != nil {
+	_, err = io.Copy(w, reader)
+	if err == nil {
+		// the end of the file has to reach the client for the download to complete
+		if flushErr := http.NewResponseController(w).Flush(); !errors.Is(flushErr, http.ErrNotSupported) {
+			err = flushErr
+		}
+	}
+
+	if err == nil && counted {
+		completed := true
+		if rng != nil {
+			if start, end, total, ok := rng.Bounds(); ok {
+				// chunks merge into one download once the client got the whole file
+				completed = s.downloads.addRange(client, token, object, start, end, total)
+			}
+		}
+
+		if completed {
+			s.countDownload(context.WithoutCancel(r.Context()), token, filename)
+			s.downloads.endRanges(client, token, object)
+		}
+	}
+
+	if err != nil {
 		s.logger.Printf("%s", err.Error())
 		http.Error(w, "Error occurred copying to output stream", http.StatusInternalServerError)
 		return
@@ -1335,6 +2039,43 @@ func LoveHandler(h http.Handler) http.HandlerFunc {
 	}
 }
 
+// storageHealthHandler fails fast with 503 on requests needing the storage while its backend is unhealthy
+func (s *Server) storageHealthHandler(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		healthReporter, ok := s.storage.(storage.HealthReporter)
+		if !ok || healthReporter.Available() || !needsStorage(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		s.storageUnavailableError(w, storage.ErrUnavailable)
+	}
+}
+
+// needsStorage indicates if serving r requires the storage backend
+func needsStorage(r *http.Request) bool {
+	if r.Method == http.MethodOptions {
+		return false
+	}
+
+	if r.Method != http.MethodGet {
+		return true
+	}
+
+	switch r.URL.Path {
+	case "/", "/health.html", "/favicon.ico", "/robots.txt":
+		return false
+	}
+
+	for _, prefix := range []string{"/images/", "/styles/", "/scripts/", "/fonts/", "/ico/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func ipFilterHandler(h http.Handler, ipFilterOptions *IPFilterOptions) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if ipFilterOptions == nil {
@@ -1382,10 +2123,13 @@ func (s *Server) basicAuthHandler(h http.Handler) http.HandlerFunc {
 
 		if !authorized && username == s.authUser && password == s.authPass {
 			authorized = true
+			r = withAuthUser(r, username)
 		}
 
 		if !authorized && s.htpasswdFile != nil {
-			authorized = s.htpasswdFile.Match(username, password)
+			if authorized = s.htpasswdFile.Match(username, password); authorized {
+				r = withAuthUser(r, username)
+			}
 		}
 
 		if !authorized {
@@ -1,12 +1,21 @@
 package server
 
 import (
+	"archive/tar"
+	"context"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
 	. "gopkg.in/check.v1"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -15,6 +24,20 @@ func Test(t *testing.T) { TestingT(t) }
 var (
 	_ = Suite(&suiteRedirectWithForceHTTPS{})
 	_ = Suite(&suiteRedirectWithoutForceHTTPS{})
+	_ = Suite(&suiteMetadataForRequest{})
+	_ = Suite(&suiteDownloadRedirect{})
+	_ = Suite(&suiteObjectMetadata{})
+	_ = Suite(&suiteUploadSession{})
+	_ = Suite(&suiteCollection{})
+	_ = Suite(&suiteArchive{})
+	_ = Suite(&suiteScanner{})
+	_ = Suite(&suiteAbuse{})
+	_ = Suite(&suiteBurnAfterReading{})
+	_ = Suite(&suiteRangeDownloads{})
+	_ = Suite(&suiteOwner{})
+	_ = Suite(&suiteVersions{})
+	_ = Suite(&suiteTrash{})
+	_ = Suite(&suiteLegalHold{})
 )
 
 type suiteRedirectWithForceHTTPS struct {
@@ -108,3 +131,300 @@ func (s *suiteRedirectWithoutForceHTTPS) TestHTTPs(c *C) {
 	resp := w.Result()
 	c.Assert(resp.StatusCode, Equals, http.StatusOK)
 }
+
+type suiteMetadataForRequest struct {
+	srvr *Server
+}
+
+func (s *suiteMetadataForRequest) SetUpTest(c *C) {
+	srvr, err := New(Retention(24*time.Hour, 72*time.Hour), MaxDownloads(10))
+	c.Assert(err, IsNil)
+
+	s.srvr = srvr
+}
+
+func (s *suiteMetadataForRequest) metadata(c *C, headers map[string]string) (metadata, error) {
+	req := httptest.NewRequest("PUT", "http://test/test.txt", nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	return s.srvr.metadataForRequest("text/plain", 1, req)
+}
+
+func (s *suiteMetadataForRequest) TestDefaults(c *C) {
+	m, err := s.metadata(c, nil)
+	c.Assert(err, IsNil)
+	c.Assert(m.MaxDownloads, Equals, 10)
+	c.Assert(time.Until(m.MaxDate) > 23*time.Hour && time.Until(m.MaxDate) <= 24*time.Hour, Equals, true)
+}
+
+func (s *suiteMetadataForRequest) TestEarliestExpiry(c *C) {
+	m, err := s.metadata(c, map[string]string{"Max-Days": "2", "Max-Hours": "3", "Max-Downloads": "5"})
+	c.Assert(err, IsNil)
+	c.Assert(m.MaxDownloads, Equals, 5)
+	c.Assert(time.Until(m.MaxDate) > 2*time.Hour && time.Until(m.MaxDate) <= 3*time.Hour, Equals, true)
+
+	expires := time.Now().Add(30 * time.Minute).UTC().Format(time.RFC3339)
+	m, err = s.metadata(c, map[string]string{"Max-Minutes": "45", "Expires": expires})
+	c.Assert(err, IsNil)
+	c.Assert(m.MaxDate.UTC().Format(time.RFC3339), Equals, expires)
+}
+
+func (s *suiteMetadataForRequest) TestCeilings(c *C) {
+	m, err := s.metadata(c, map[string]string{"Max-Days": "30", "Max-Downloads": "100"})
+	c.Assert(err, IsNil)
+	c.Assert(m.MaxDownloads, Equals, 10)
+	c.Assert(time.Until(m.MaxDate) > 71*time.Hour && time.Until(m.MaxDate) <= 72*time.Hour, Equals, true)
+}
+
+func (s *suiteMetadataForRequest) TestInvalid(c *C) {
+	for _, headers := range []map[string]string{
+		{"Max-Hours": "0"},
+		{"Max-Minutes": "soon"},
+		{"Max-Days": "9999999999"},
+		{"Expires": "tomorrow"},
+		{"Expires": "2001-01-01T00:00:00Z"},
+	} {
+		_, err := s.metadata(c, headers)
+		c.Assert(err, NotNil, Commentf("%v", headers))
+	}
+}
+
+// presignStorage is a local storage presigning downloads, recording what it presigned
+type presignStorage struct {
+	*storage.LocalStorage
+	presigned []string
+}
+
+func (p *presignStorage) PresignGet(_ context.Context, token string, filename string, contentType string, contentDisposition string, _ time.Duration) (string, error) {
+	p.presigned = append(p.presigned, fmt.Sprintf("%s/%s %s %s", token, filename, contentType, contentDisposition))
+	return "https://storage.example/" + token + "/" + filename, nil
+}
+
+type suiteDownloadRedirect struct {
+	srvr    *Server
+	storage *presignStorage
+}
+
+func (s *suiteDownloadRedirect) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	s.storage = &presignStorage{LocalStorage: local}
+
+	s.srvr, err = New(UseStorage(s.storage), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10), DownloadRedirect(60))
+	c.Assert(err, IsNil)
+}
+
+func (s *suiteDownloadRedirect) upload(c *C, headers map[string]string) string {
+	req := httptest.NewRequest("PUT", "http://test/hello.txt", strings.NewReader("hello"))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	s.srvr.putHandler(w, mux.SetURLVars(req, map[string]string{"filename": "hello.txt"}))
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	return strings.Split(strings.TrimPrefix(w.Body.String(), "http://test/"), "/")[0]
+}
+
+func (s *suiteDownloadRedirect) get(token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://test/"+token+"/hello.txt", nil)
+
+	w := httptest.NewRecorder()
+	s.srvr.getHandler(w, mux.SetURLVars(req, map[string]string{"token": token, "filename": "hello.txt"}))
+
+	return w
+}
+
+func (s *suiteDownloadRedirect) TestRedirect(c *C) {
+	token := s.upload(c, nil)
+
+	w := s.get(token)
+	c.Assert(w.Code, Equals, http.StatusFound)
+	c.Assert(w.Header().Get("Location"), Equals, "https://storage.example/"+token+"/hello.txt")
+	c.Assert(s.storage.presigned, DeepEquals, []string{token + `/hello.txt text/plain; charset=utf-8 attachment; filename="hello.txt"`})
+}
+
+func (s *suiteDownloadRedirect) TestLimitedDownloadsStreamed(c *C) {
+	token := s.upload(c, map[string]string{"Max-Downloads": "1"})
+
+	w := s.get(token)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "hello")
+	c.Assert(s.storage.presigned, HasLen, 0)
+}
+
+// objectMetadataStorage is a local storage keeping metadata on objects, counting updates
+type objectMetadataStorage struct {
+	*storage.LocalStorage
+	metadata map[string]map[string]string
+	updates  int
+}
+
+func (o *objectMetadataStorage) PutWithMetadata(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64, metadata map[string]string) error {
+	o.metadata[token+"/"+filename] = metadata
+	return o.Put(ctx, token, filename, reader, contentType, contentLength)
+}
+
+func (o *objectMetadataStorage) GetMetadata(_ context.Context, token string, filename string) (map[string]string, error) {
+	return o.metadata[token+"/"+filename], nil
+}
+
+func (o *objectMetadataStorage) UpdateMetadata(_ context.Context, token string, filename string, metadata map[string]string) error {
+	o.updates++
+	o.metadata[token+"/"+filename] = metadata
+	return nil
+}
+
+type suiteObjectMetadata struct {
+	srvr    *Server
+	storage *objectMetadataStorage
+}
+
+func (s *suiteObjectMetadata) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	s.storage = &objectMetadataStorage{LocalStorage: local, metadata: map[string]map[string]string{}}
+
+	s.srvr, err = New(UseStorage(s.storage), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10))
+	c.Assert(err, IsNil)
+}
+
+func (s *suiteObjectMetadata) TestMutableFieldsInSidecar(c *C) {
+	ctx := context.Background()
+	c.Assert(s.srvr.putWithMetadata(ctx, "token", "hello.txt", strings.NewReader("hello"), "text/plain", 5, metadata{ContentType: "text/plain", MaxDownloads: 5}), IsNil)
+
+	for i := 0; i < 3; i++ {
+		s.srvr.countDownload(ctx, "token", "hello.txt")
+	}
+
+	m, err := s.srvr.readMetadata(ctx, "token", "hello.txt")
+	c.Assert(err, IsNil)
+	c.Assert(m.Downloads, Equals, 3)
+	c.Assert(m.LastDownload.IsZero(), Equals, false)
+	c.Assert(s.storage.updates, Equals, 0)
+
+	m.Description = "greetings"
+	c.Assert(s.srvr.writeMetadata(ctx, "token", "hello.txt", m), IsNil)
+	c.Assert(s.storage.updates, Equals, 1)
+
+	m, err = s.srvr.readMetadata(ctx, "token", "hello.txt")
+	c.Assert(err, IsNil)
+	c.Assert(m.Description, Equals, "greetings")
+	c.Assert(m.Downloads, Equals, 3)
+}
+
+func (s *suiteObjectMetadata) TestMutableFieldsOfReplacedContent(c *C) {
+	ctx := context.Background()
+	c.Assert(s.srvr.putWithMetadata(ctx, "token", "hello.txt", strings.NewReader("hello"), "text/plain", 5, metadata{Version: 1, ScanStatus: scanStatusClean}), IsNil)
+
+	m, err := s.srvr.readMetadata(ctx, "token", "hello.txt")
+	c.Assert(err, IsNil)
+	m.Downloads = 1
+	c.Assert(s.srvr.writeMetadata(ctx, "token", "hello.txt", m), IsNil)
+
+	// the sidecar written for version 1 does not apply to the content replacing it
+	c.Assert(s.srvr.putWithMetadata(ctx, "token", "hello.txt", strings.NewReader("world"), "text/plain", 5, metadata{Version: 2, ScanStatus: scanStatusPending}), IsNil)
+
+	m, err = s.srvr.readMetadata(ctx, "token", "hello.txt")
+	c.Assert(err, IsNil)
+	c.Assert(m.ScanStatus, Equals, scanStatusPending)
+	c.Assert(m.Downloads, Equals, 0)
+}
+
+// readerCountingStorage is a local storage counting the readers of files, not of their
+// metadata, it returned which are still open
+type readerCountingStorage struct {
+	*storage.LocalStorage
+	open, maxOpen int
+}
+
+type countedReader struct {
+	io.ReadCloser
+	storage *readerCountingStorage
+}
+
+func (r *countedReader) Close() error {
+	r.storage.open--
+	return r.ReadCloser.Close()
+}
+
+func (s *readerCountingStorage) Get(ctx context.Context, token string, filename string, rng *storage.Range) (io.ReadCloser, uint64, error) {
+	reader, contentLength, err := s.LocalStorage.Get(ctx, token, filename, rng)
+	if err != nil || strings.HasSuffix(filename, ".metadata") {
+		return reader, contentLength, err
+	}
+
+	s.open++
+	s.maxOpen = max(s.maxOpen, s.open)
+
+	return &countedReader{ReadCloser: reader, storage: s}, contentLength, nil
+}
+
+type suiteArchive struct {
+	srvr    *Server
+	storage *readerCountingStorage
+}
+
+func (s *suiteArchive) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	s.storage = &readerCountingStorage{LocalStorage: local}
+
+	s.srvr, err = New(UseStorage(s.storage), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10))
+	c.Assert(err, IsNil)
+
+	ctx := context.Background()
+	for _, f := range []struct {
+		filename     string
+		maxDownloads int
+	}{{"a.txt", 1}, {"b.txt", -1}, {"c.txt", -1}} {
+		c.Assert(s.srvr.putWithMetadata(ctx, "token", f.filename, strings.NewReader(f.filename), "text/plain", 5, metadata{ContentType: "text/plain", MaxDownloads: f.maxDownloads}), IsNil)
+
+		_, err = s.srvr.addToCollection(ctx, "token", f.filename, 5, true)
+		c.Assert(err, IsNil)
+	}
+}
+
+// tar downloads the collection as a tar archive, returning the names of its files
+func (s *suiteArchive) tar(c *C) []string {
+	req := httptest.NewRequest("GET", "http://test/token.tar", nil)
+
+	w := httptest.NewRecorder()
+	s.srvr.tarHandler(w, mux.SetURLVars(req, map[string]string{"token": "token"}))
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	var names []string
+	tr := tar.NewReader(w.Body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+
+		c.Assert(err, IsNil)
+		names = append(names, header.Name)
+	}
+}
+
+func (s *suiteArchive) TestFilesReadOneAtATime(c *C) {
+	c.Assert(s.tar(c), DeepEquals, []string{"a.txt", "b.txt", "c.txt"})
+	c.Assert(s.storage.open, Equals, 0)
+	c.Assert(s.storage.maxOpen, Equals, 1)
+}
+
+func (s *suiteArchive) TestDownloadsCounted(c *C) {
+	c.Assert(s.tar(c), DeepEquals, []string{"a.txt", "b.txt", "c.txt"})
+	c.Assert(s.tar(c), DeepEquals, []string{"b.txt", "c.txt"})
+}
@@ -0,0 +1,195 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+// maxLegalHoldReasonLength bounds the reason of a legal hold, in bytes once JSON encoded,
+// as it is kept in the metadata of the file
+const maxLegalHoldReasonLength = 256
+
+// legalHold freezes a file, as evidence, until an admin releases it
+type legalHold struct {
+	Reason string
+	Time   time.Time
+}
+
+// legalHoldEntry is an entry of the audit log of legal holds
+type legalHoldEntry struct {
+	// Action is hold or release
+	Action     string
+	Token      string
+	Filename   string
+	Reason     string
+	RemoteAddr string
+	Time       time.Time
+}
+
+// held indicates if the file is under legal hold, so it cannot be deleted or replaced
+func (m metadata) held() bool {
+	return m.LegalHold != nil
+}
+
+// setLegalHold holds or releases the content of a file and its previous versions on the
+// storage. A failed hold releases the objects already held.
+func (s *Server) setLegalHold(ctx context.Context, holder storage.LegalHolder, token, filename string, m metadata, hold bool) error {
+	objects := []string{filename}
+	for _, v := range m.Versions {
+		objects = append(objects, versionObject(filename, v.Version))
+	}
+
+	for i, object := range objects {
+		err := holder.SetLegalHold(ctx, token, object, hold)
+		if err == nil || object != filename && s.storage.IsNotExist(err) {
+			continue
+		}
+
+		if hold {
+			for _, held := range objects[:i] {
+				if releaseErr := holder.SetLegalHold(ctx, token, held, false); releaseErr != nil && !s.storage.IsNotExist(releaseErr) {
+					s.logger.Printf("Error releasing %s/%s after the storage failed to hold %s: %s", token, held, object, releaseErr.Error())
+				}
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// legalHoldHandler places a legal hold on a file with POST, or releases it with DELETE,
+// both on the server and the storage, recording both in the audit log. Storages which
+// cannot hold files, and would expire or purge them regardless, refuse holds.
+func (s *Server) legalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	token := vars["token"]
+	filename := sanitize(vars["filename"])
+	hold := r.Method == http.MethodPost
+
+	holder, ok := storage.Capability[storage.LegalHolder](s.storage)
+	if !ok {
+		http.Error(w, "Legal holds not supported by the storage", http.StatusNotImplemented)
+		return
+	}
+
+	reason, err := io.ReadAll(io.LimitReader(r.Body, 4*maxLegalHoldReasonLength))
+	if err != nil {
+		http.Error(w, "Could not read reason", http.StatusBadRequest)
+		return
+	} else if encodedLength(strings.TrimSpace(string(reason))) > maxLegalHoldReasonLength {
+		http.Error(w, fmt.Sprintf("Reason must be at most %d bytes", maxLegalHoldReasonLength), http.StatusBadRequest)
+		return
+	}
+
+	s.lock(token, filename)
+	defer s.unlock(token, filename)
+
+	m, err := s.readMetadata(r.Context(), token, filename)
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if hold == m.held() {
+		http.Error(w, "Legal hold already in this state", http.StatusConflict)
+		return
+	}
+
+	entry := legalHoldEntry{
+		Action:     "release",
+		Token:      token,
+		Filename:   filename,
+		Reason:     strings.TrimSpace(string(reason)),
+		RemoteAddr: ipAddrFromRemoteAddr(r.RemoteAddr),
+		Time:       time.Now().UTC(),
+	}
+
+	if hold {
+		// the metadata holds the file first, so the storage never protects an unheld file
+		entry.Action = "hold"
+		m.LegalHold = &legalHold{Reason: entry.Reason, Time: entry.Time}
+		err = s.writeMetadata(r.Context(), token, filename, m)
+		if err == nil {
+			if err = s.setLegalHold(r.Context(), holder, token, filename, m, true); err != nil {
+				m.LegalHold = nil
+				if rollbackErr := s.writeMetadata(r.Context(), token, filename, m); rollbackErr != nil {
+					s.logger.Printf("Error releasing %s/%s after the storage failed to hold it: %s", token, filename, rollbackErr.Error())
+				}
+			}
+		}
+	} else {
+		// the storage releases the file first, so the server never deletes a file the storage holds
+		err = s.setLegalHold(r.Context(), holder, token, filename, m, false)
+		if err == nil {
+			m.LegalHold = nil
+			err = s.writeMetadata(r.Context(), token, filename, m)
+		}
+	}
+
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error setting legal hold of %s/%s: %s", token, filename, err.Error())
+		http.Error(w, "Could not set legal hold", http.StatusInternalServerError)
+		return
+	}
+
+	if err = appendJSONLine(s.auditLogPath, &s.auditLogMutex, 0, entry); err != nil {
+		s.logger.Printf("Error recording legal hold in the audit log: %s", err.Error())
+	}
+
+	s.logger.Printf("Legal %s of %s/%s by %s: %q", entry.Action, token, filename, entry.RemoteAddr, entry.Reason)
+
+	setLimitHeaders(w, m)
+	s.writeStats(w, filename, m)
+}
+
+// legalHoldError writes the response refusing to delete or replace a file under legal
+// hold, returning false for other errors
+func legalHoldError(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, storage.ErrLegalHold) {
+		return false
+	}
+
+	http.Error(w, "File is under legal hold", http.StatusForbidden)
+	return true
+}
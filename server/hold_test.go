@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+type suiteLegalHold struct {
+	srvr *Server
+	vars map[string]string
+}
+
+func (s *suiteLegalHold) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	s.srvr, err = New(UseStorage(local), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10), KeepVersions(5))
+	c.Assert(err, IsNil)
+
+	// hello.txt is uploaded as a collection, whose owner key is kept for appends
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "hello.txt")
+	_, _ = fw.Write([]byte("one"))
+	_ = mw.Close()
+
+	req := httptest.NewRequest("POST", "http://test/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	w := httptest.NewRecorder()
+	s.srvr.postHandler(w, mux.SetURLVars(req, map[string]string{}))
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	u, err := url.Parse(w.Header().Get("X-Url-Delete"))
+	c.Assert(err, IsNil)
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	c.Assert(parts, HasLen, 3)
+	s.vars = map[string]string{"token": parts[0], "filename": parts[1], "deletionToken": parts[2], "ownerKey": w.Header().Get("X-Owner-Key")}
+}
+
+func (s *suiteLegalHold) serve(handler http.HandlerFunc, method, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://test/"+s.vars["token"]+"/"+s.vars["filename"], strings.NewReader(body))
+
+	w := httptest.NewRecorder()
+	handler(w, mux.SetURLVars(req, s.vars))
+
+	return w
+}
+
+func (s *suiteLegalHold) hold(c *C, method string) {
+	w := s.serve(s.srvr.legalHoldHandler, method, "litigation")
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+}
+
+func (s *suiteLegalHold) TestRefusesChanges(c *C) {
+	s.hold(c, "POST")
+
+	c.Assert(s.serve(s.srvr.deleteHandler, "DELETE", "").Code, Equals, http.StatusForbidden)
+	c.Assert(s.serve(s.srvr.versionHandler, "PUT", "two").Code, Equals, http.StatusForbidden)
+
+	w := s.serve(s.srvr.getHandler, "GET", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "one")
+}
+
+func (s *suiteLegalHold) TestRefusesCollectionAppend(c *C) {
+	s.hold(c, "POST")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "hello.txt")
+	_, _ = fw.Write([]byte("two"))
+	_ = mw.Close()
+
+	req := httptest.NewRequest("POST", "http://test/"+s.vars["token"], &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-Owner-Key", s.vars["ownerKey"])
+
+	w := httptest.NewRecorder()
+	s.srvr.postHandler(w, mux.SetURLVars(req, map[string]string{"token": s.vars["token"]}))
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+}
+
+func (s *suiteLegalHold) TestHoldsVersions(c *C) {
+	c.Assert(s.serve(s.srvr.versionHandler, "PUT", "two").Code, Equals, http.StatusOK)
+	s.hold(c, "POST")
+	c.Assert(s.serve(s.srvr.rollbackHandler, "POST", "").Code, Equals, http.StatusForbidden)
+
+	// a purge deleting every file spares the held file and its previous version
+	c.Assert(s.srvr.storage.Purge(context.Background(), 0), IsNil)
+
+	for _, object := range []string{s.vars["filename"], versionObject(s.vars["filename"], 1)} {
+		_, err := s.srvr.storage.Head(context.Background(), s.vars["token"], object)
+		c.Assert(err, IsNil, Commentf("%s", object))
+	}
+
+	c.Assert(s.srvr.storage.Delete(context.Background(), s.vars["token"], versionObject(s.vars["filename"], 1)), Equals, storage.ErrLegalHold)
+
+	s.hold(c, "DELETE")
+	c.Assert(s.srvr.storage.Delete(context.Background(), s.vars["token"], versionObject(s.vars["filename"], 1)), IsNil)
+}
@@ -0,0 +1,263 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+// Migrate copies every file, along with its metadata and previous versions, from one storage to another.
+// Sizes and checksums are verified on the destination. Migrated files are recorded
+// in stateFile, so an interrupted migration resumes where it stopped.
+func Migrate(ctx context.Context, from, to storage.Storage, stateFile string, deleteSource bool, logger *log.Logger) error {
+	lister, ok := storage.Capability[storage.Lister](from)
+	if !ok {
+		return fmt.Errorf("%s storage cannot list its files", from.Type())
+	}
+
+	done, err := readMigrateState(stateFile)
+	if err != nil {
+		return err
+	}
+
+	state, err := os.OpenFile(stateFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer storage.CloseCheck(state)
+
+	var keys []string
+	err = lister.List(ctx, "", func(token string, filename string) error {
+		keys = append(keys, path.Join(token, filename))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	src := &Server{storage: from, logger: logger}
+	dst := &Server{storage: to, logger: logger}
+
+	var migrated, skipped, resumed int
+	for _, key := range keys {
+		token, filename := path.Split(key)
+		token = path.Clean(token)
+
+		// the collection manifest goes with the first file of its token, so deleting
+		// the source does not strand it when the migration is interrupted
+		if manifest := path.Join(token, collectionManifest); !done[manifest] {
+			if err := migrateCollection(ctx, from, to, token, deleteSource); err != nil {
+				return err
+			}
+
+			if _, err := fmt.Fprintln(state, manifest); err != nil {
+				return err
+			}
+
+			done[manifest] = true
+		}
+
+		if done[key] {
+			resumed++
+			continue
+		}
+
+		m, err := src.readMetadata(ctx, token, filename)
+		if err != nil {
+			logger.Printf("Skipping %s, no metadata: %s", key, err.Error())
+			skipped++
+			continue
+		}
+
+		if err := migrateVersions(ctx, from, to, token, filename, m, logger); err != nil {
+			return fmt.Errorf("migrating versions of %s: %w", key, err)
+		}
+
+		if err := migrateFile(ctx, src, dst, token, filename, m); err != nil {
+			return fmt.Errorf("migrating %s: %w", key, err)
+		}
+
+		// recorded once deleted, so a resumed migration deletes sources left behind
+		if deleteSource {
+			for _, v := range m.Versions {
+				if err := from.Delete(ctx, token, versionObject(filename, v.Version)); err != nil && !from.IsNotExist(err) {
+					return fmt.Errorf("deleting version %d of %s from source: %w", v.Version, key, err)
+				}
+			}
+
+			if err := from.Delete(ctx, token, filename); err != nil {
+				return fmt.Errorf("deleting %s from source: %w", key, err)
+			}
+		}
+
+		if _, err := fmt.Fprintln(state, key); err != nil {
+			return err
+		}
+
+		logger.Printf("Migrated %s", key)
+		migrated++
+	}
+
+	logger.Printf("Migration finished: %d migrated, %d skipped, %d already done", migrated, skipped, resumed)
+
+	return nil
+}
+
+func migrateFile(ctx context.Context, src, dst *Server, token, filename string, m metadata) error {
+	reader, contentLength, err := src.storage.Get(ctx, token, filename, nil)
+	defer storage.CloseCheck(reader)
+
+	if err != nil {
+		return err
+	}
+
+	contentType := m.ContentType
+	if m.Encrypted {
+		contentType = m.DecryptedContentType
+	}
+
+	sourceHash := sha256.New()
+	if err = dst.putWithMetadata(ctx, token, filename, io.TeeReader(reader, sourceHash), contentType, contentLength, m); err != nil {
+		return err
+	}
+
+	return verifyMigrated(ctx, dst.storage, token, filename, contentLength, sourceHash.Sum(nil))
+}
+
+// verifyMigrated checks the size and checksum of an object copied to the destination
+func verifyMigrated(ctx context.Context, to storage.Storage, token, object string, contentLength uint64, sourceSum []byte) error {
+	length, err := to.Head(ctx, token, object)
+	if err != nil {
+		return err
+	} else if length != contentLength {
+		return fmt.Errorf("size mismatch: source %d, destination %d", contentLength, length)
+	}
+
+	migrated, _, err := to.Get(ctx, token, object, nil)
+	defer storage.CloseCheck(migrated)
+
+	if err != nil {
+		return err
+	}
+
+	destinationHash := sha256.New()
+	if _, err = io.Copy(destinationHash, migrated); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(sourceSum, destinationHash.Sum(nil)) {
+		return errors.New("checksum mismatch")
+	}
+
+	return nil
+}
+
+// migrateVersions copies the objects keeping the previous versions of a file, which
+// storage listings leave out like metadata sidecars. Versions already deleted from the
+// source by an interrupted migration are skipped.
+func migrateVersions(ctx context.Context, from, to storage.Storage, token, filename string, m metadata, logger *log.Logger) error {
+	for _, v := range m.Versions {
+		object := versionObject(filename, v.Version)
+
+		reader, contentLength, err := from.Get(ctx, token, object, nil)
+		if from.IsNotExist(err) {
+			logger.Printf("Skipping version %d of %s/%s, not in source", v.Version, token, filename)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		sourceHash := sha256.New()
+		err = to.Put(ctx, token, object, io.TeeReader(reader, sourceHash), "application/octet-stream", contentLength)
+		storage.CloseCheck(reader)
+		if err != nil {
+			return err
+		}
+
+		if err = verifyMigrated(ctx, to, token, object, contentLength, sourceHash.Sum(nil)); err != nil {
+			return fmt.Errorf("version %d: %w", v.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateCollection copies the collection manifest of token, when it has one,
+// which storage listings leave out like metadata sidecars
+func migrateCollection(ctx context.Context, from, to storage.Storage, token string, deleteSource bool) error {
+	reader, contentLength, err := from.Get(ctx, token, collectionManifest, nil)
+	if from.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading collection %s: %w", token, err)
+	}
+
+	err = to.Put(ctx, token, collectionManifest, reader, "text/json", contentLength)
+	storage.CloseCheck(reader)
+	if err != nil {
+		return fmt.Errorf("migrating collection %s: %w", token, err)
+	}
+
+	if deleteSource {
+		if err = from.Delete(ctx, token, collectionManifest); err != nil {
+			return fmt.Errorf("deleting collection %s from source: %w", token, err)
+		}
+	}
+
+	return nil
+}
+
+// readMigrateState returns the keys recorded as migrated in stateFile
+func readMigrateState(stateFile string) (map[string]bool, error) {
+	done := map[string]bool{}
+
+	f, err := os.Open(stateFile)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer storage.CloseCheck(f)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := scanner.Text(); key != "" {
+			done[key] = true
+		}
+	}
+
+	return done, scanner.Err()
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+// failingStorage is a local storage failing to save one file
+type failingStorage struct {
+	*storage.LocalStorage
+	failing string
+}
+
+func (f *failingStorage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
+	if filename == f.failing {
+		return errors.New("interrupted")
+	}
+
+	return f.LocalStorage.Put(ctx, token, filename, reader, contentType, contentLength)
+}
+
+func TestMigrateResumesAfterDeletingSource(t *testing.T) {
+	ctx := context.Background()
+	logger := log.New(io.Discard, "", 0)
+
+	from, err := storage.NewLocalStorage(t.TempDir(), 0, 0, 0, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to, err := storage.NewLocalStorage(t.TempDir(), 0, 0, 0, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := &Server{storage: from, logger: logger}
+	for _, filename := range []string{"a.txt", "b.txt"} {
+		m := metadata{ContentType: "text/plain", Version: 2, Versions: []fileVersion{{Version: 1}}}
+		if err = src.putWithMetadata(ctx, "token", filename, strings.NewReader(filename), "text/plain", uint64(len(filename)), m); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = from.Put(ctx, "token", versionObject(filename, 1), strings.NewReader("old"), "text/plain", 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = src.writeCollection(ctx, "token", collection{OwnerKey: "key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stateFile := filepath.Join(t.TempDir(), "state")
+	if err = Migrate(ctx, from, &failingStorage{LocalStorage: to, failing: "b.txt"}, stateFile, true, logger); err == nil {
+		t.Fatal("interrupted migration succeeded")
+	}
+
+	if _, err = from.Head(ctx, "token", collectionManifest); !from.IsNotExist(err) {
+		t.Errorf("collection manifest not deleted from source along with a.txt: %v", err)
+	}
+
+	if err = Migrate(ctx, from, to, stateFile, true, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &Server{storage: to, logger: logger}
+	if c, err := dst.readCollection(ctx, "token"); err != nil || c.OwnerKey != "key" {
+		t.Errorf("collection manifest on destination = %+v, %v", c, err)
+	}
+
+	for _, filename := range []string{"a.txt", "b.txt", versionObject("a.txt", 1), versionObject("b.txt", 1)} {
+		if _, err = to.Head(ctx, "token", filename); err != nil {
+			t.Errorf("%s not migrated: %v", filename, err)
+		}
+
+		if _, err = from.Head(ctx, "token", filename); !from.IsNotExist(err) {
+			t.Errorf("%s not deleted from source: %v", filename, err)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxPatchSize bounds the body of metadata patches
+	maxPatchSize = 16 << 10
+	// maxDisplayNameLength and maxDescriptionLength bound the display name and description
+	// of files, in bytes once JSON encoded, so that with the rest of the metadata they fit
+	// in the object metadata
+	maxDisplayNameLength = 255
+	maxDescriptionLength = 256
+)
+
+// metadataPatch holds the changes the owner of a file requests. Missing fields are
+// left unchanged, a max_downloads of -1 or an empty expires removes the limit.
+type metadataPatch struct {
+	MaxDownloads *int    `json:"max_downloads"`
+	Expires      *string `json:"expires"`
+	DisplayName  *string `json:"display_name"`
+	Description  *string `json:"description"`
+}
+
+// fileStats is what the owner of a file sees of it
+type fileStats struct {
+	Filename      string         `json:"filename"`
+	DisplayName   string         `json:"display_name,omitempty"`
+	Description   string         `json:"description,omitempty"`
+	ContentType   string         `json:"content_type"`
+	ContentLength int64          `json:"content_length"`
+	Uploaded      *time.Time     `json:"uploaded,omitempty"`
+	Downloads     int            `json:"downloads"`
+	MaxDownloads  int            `json:"max_downloads"`
+	LastDownload  *time.Time     `json:"last_download,omitempty"`
+	Expires       *time.Time     `json:"expires,omitempty"`
+	Version       int            `json:"version"`
+	Versions      []versionStats `json:"versions,omitempty"`
+	LegalHold     bool           `json:"legal_hold,omitempty"`
+}
+
+// downloadName returns the name downloads of filename are saved as
+func (m metadata) downloadName(filename string) string {
+	if m.DisplayName == "" {
+		return filename
+	}
+
+	return m.DisplayName
+}
+
+// apply changes m as requested by the owner, within the limits of the server
+func (p metadataPatch) apply(s *Server, m *metadata) error {
+	if p.MaxDownloads != nil {
+		if *p.MaxDownloads < -1 || *p.MaxDownloads == 0 {
+			return errors.New("max_downloads must be positive, or -1 for unlimited")
+		}
+
+		m.MaxDownloads = *p.MaxDownloads
+		if s.maxDownloads > 0 && (m.MaxDownloads == -1 || m.MaxDownloads > s.maxDownloads) {
+			m.MaxDownloads = s.maxDownloads
+		}
+	}
+
+	if p.Expires != nil {
+		m.MaxDate = time.Time{}
+		if *p.Expires != "" {
+			date, err := time.Parse(time.RFC3339, *p.Expires)
+			if err != nil {
+				return errors.New("expires must be an RFC 3339 date")
+			} else if !date.After(time.Now()) {
+				return errors.New("expires must be in the future")
+			}
+
+			m.MaxDate = date
+		}
+
+		uploaded := m.Uploaded
+		if uploaded.IsZero() {
+			uploaded = time.Now()
+		}
+
+		if s.maxRetention > 0 && (m.MaxDate.IsZero() || m.MaxDate.After(uploaded.Add(s.maxRetention))) {
+			m.MaxDate = uploaded.Add(s.maxRetention)
+		}
+	}
+
+	if p.DisplayName != nil {
+		name := strings.TrimSpace(*p.DisplayName)
+		if name != "" {
+			name = strings.ReplaceAll(sanitize(name), `"`, "'")
+		}
+
+		if encodedLength(name) > maxDisplayNameLength {
+			return fmt.Errorf("display_name must be at most %d bytes", maxDisplayNameLength)
+		}
+
+		m.DisplayName = name
+	}
+
+	if p.Description != nil {
+		description := strings.TrimSpace(*p.Description)
+		if encodedLength(description) > maxDescriptionLength {
+			return fmt.Errorf("description must be at most %d bytes", maxDescriptionLength)
+		}
+
+		m.Description = description
+	}
+
+	return nil
+}
+
+// encodedLength returns the length of s encoded as a JSON string, without its quotes
+func encodedLength(s string) int {
+	data, _ := json.Marshal(s)
+	return len(data) - 2
+}
+
+// patchHandler lets the owner of a file, authorized by its deletion token, change its
+// download limit, expiry date, display name and description
+func (s *Server) patchHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	token := vars["token"]
+	filename := vars["filename"]
+
+	if err := s.checkDeletionToken(r.Context(), vars["deletionToken"], token, filename); isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	var patch metadataPatch
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxPatchSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		http.Error(w, "Invalid patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.lock(token, filename)
+	defer s.unlock(token, filename)
+
+	m, err := s.readMetadata(r.Context(), token, filename)
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if err = patch.apply(s, &m); err != nil {
+		http.Error(w, "Invalid patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = s.writeMetadata(r.Context(), token, filename, m); isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error updating metadata of %s/%s: %s", token, filename, err.Error())
+		http.Error(w, "Could not update file", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Printf("Updated %s/%s", token, filename)
+
+	setLimitHeaders(w, m)
+	s.writeStats(w, filename, m)
+}
+
+// statsHandler shows the owner of a file, authorized by its deletion token, its limits
+// and downloads
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	token := vars["token"]
+	filename := vars["filename"]
+
+	if err := s.checkDeletionToken(r.Context(), vars["deletionToken"], token, filename); isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	m, err := s.readMetadata(r.Context(), token, filename)
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	setLimitHeaders(w, m)
+	s.writeStats(w, filename, m)
+}
+
+func (s *Server) writeStats(w http.ResponseWriter, filename string, m metadata) {
+	stats := fileStats{
+		Filename:      filename,
+		DisplayName:   m.DisplayName,
+		Description:   m.Description,
+		ContentType:   m.ContentType,
+		ContentLength: m.ContentLength,
+		Downloads:     m.Downloads,
+		MaxDownloads:  m.MaxDownloads,
+	}
+
+	optionalTime := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+
+		return &t
+	}
+
+	stats.Uploaded = optionalTime(m.Uploaded)
+	stats.LastDownload = optionalTime(m.LastDownload)
+	stats.Expires = optionalTime(m.MaxDate)
+
+	stats.LegalHold = m.held()
+	stats.Version = m.currentVersion()
+	for _, v := range m.Versions {
+		stats.Versions = append(stats.Versions, versionStats{
+			Version:       v.Version,
+			ContentType:   v.ContentType,
+			ContentLength: v.ContentLength,
+			Uploaded:      optionalTime(v.Uploaded),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		s.logger.Printf("%s", err.Error())
+	}
+}
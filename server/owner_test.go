@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+func TestMetadataPatchApply(t *testing.T) {
+	s := &Server{maxDownloads: 10, maxRetention: 7 * 24 * time.Hour}
+	uploaded := time.Now().Add(-time.Hour)
+
+	for _, tc := range []struct {
+		patch        string
+		maxDownloads int
+		valid        bool
+	}{
+		{`{"max_downloads": 3}`, 3, true},
+		{`{"max_downloads": -1}`, 10, true},
+		{`{"max_downloads": 50}`, 10, true},
+		{`{"max_downloads": 0}`, 0, false},
+		{`{"expires": "2000-01-01T00:00:00Z"}`, 0, false},
+		{`{"expires": "tomorrow"}`, 0, false},
+		{`{"display_name": "` + strings.Repeat("x", maxDisplayNameLength+1) + `"}`, 0, false},
+		{`{"description": "` + strings.Repeat("é", maxDescriptionLength) + `"}`, 0, false},
+	} {
+		var patch metadataPatch
+		if err := json.Unmarshal([]byte(tc.patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+
+		m := metadata{MaxDownloads: -1, Uploaded: uploaded}
+		if err := patch.apply(s, &m); (err == nil) != tc.valid {
+			t.Errorf("apply(%.40s) = %v, want valid %v", tc.patch, err, tc.valid)
+		} else if tc.valid && m.MaxDownloads != tc.maxDownloads {
+			t.Errorf("apply(%.40s) MaxDownloads = %d, want %d", tc.patch, m.MaxDownloads, tc.maxDownloads)
+		}
+	}
+
+	var patch metadataPatch
+	_ = json.Unmarshal([]byte(`{"expires": ""}`), &patch)
+
+	m := metadata{MaxDownloads: -1, Uploaded: uploaded}
+	if err := patch.apply(s, &m); err != nil || !m.MaxDate.Equal(uploaded.Add(s.maxRetention)) {
+		t.Errorf("removing the expiry = %v, %v, want the max retention %v", err, m.MaxDate, uploaded.Add(s.maxRetention))
+	}
+}
+
+type suiteOwner struct {
+	srvr *Server
+	vars map[string]string
+}
+
+func (s *suiteOwner) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	s.srvr, err = New(UseStorage(local), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10))
+	c.Assert(err, IsNil)
+
+	req := httptest.NewRequest("PUT", "http://test/hello.txt", strings.NewReader("hello"))
+	w := httptest.NewRecorder()
+	s.srvr.putHandler(w, mux.SetURLVars(req, map[string]string{"filename": "hello.txt"}))
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	u, err := url.Parse(w.Header().Get("X-Url-Delete"))
+	c.Assert(err, IsNil)
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	c.Assert(parts, HasLen, 3)
+	s.vars = map[string]string{"token": parts[0], "filename": parts[1], "deletionToken": parts[2]}
+}
+
+func (s *suiteOwner) serve(handler http.HandlerFunc, method, body string, vars map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, mux.SetURLVars(httptest.NewRequest(method, "http://test/", strings.NewReader(body)), vars))
+
+	return w
+}
+
+func (s *suiteOwner) stats(c *C) fileStats {
+	w := s.serve(s.srvr.statsHandler, "GET", "", s.vars)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	var stats fileStats
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &stats), IsNil)
+
+	return stats
+}
+
+func (s *suiteOwner) TestPatch(c *C) {
+	w := s.serve(s.srvr.patchHandler, "PATCH", `{"max_downloads": 2, "display_name": "report.txt", "description": "Q3 report"}`, s.vars)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+
+	stats := s.stats(c)
+	c.Assert(stats.MaxDownloads, Equals, 2)
+	c.Assert(stats.DisplayName, Equals, "report.txt")
+	c.Assert(stats.Description, Equals, "Q3 report")
+
+	w = s.serve(s.srvr.getHandler, "GET", "", s.vars)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Disposition"), Equals, `attachment; filename="report.txt"`)
+	c.Assert(w.Header().Get("X-Remaining-Downloads"), Equals, "2")
+
+	stats = s.stats(c)
+	c.Assert(stats.Downloads, Equals, 1)
+	c.Assert(stats.LastDownload, NotNil)
+
+	c.Assert(s.serve(s.srvr.patchHandler, "PATCH", `{"max_downloads": "many"}`, s.vars).Code, Equals, http.StatusBadRequest)
+	c.Assert(s.serve(s.srvr.patchHandler, "PATCH", `{"owner": "me"}`, s.vars).Code, Equals, http.StatusBadRequest)
+}
+
+func (s *suiteOwner) TestDeletionTokenRequired(c *C) {
+	vars := map[string]string{"token": s.vars["token"], "filename": s.vars["filename"], "deletionToken": "wrong"}
+
+	c.Assert(s.serve(s.srvr.patchHandler, "PATCH", `{"max_downloads": 1}`, vars).Code, Equals, http.StatusNotFound)
+	c.Assert(s.serve(s.srvr.statsHandler, "GET", "", vars).Code, Equals, http.StatusNotFound)
+	c.Assert(s.stats(c).MaxDownloads, Equals, -1)
+}
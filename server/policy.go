@@ -0,0 +1,350 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxInspectedEntries bounds the entries of an archive inspected for denied files,
+// larger archives are rejected
+const maxInspectedEntries = 10000
+
+// UploadRule allows or denies uploads by sniffed content type, with wildcards like
+// image/*, and by extension. Denied entries win over allowed ones and empty allow
+// lists allow everything. Files inside zip and tar archives are checked against
+// the deny lists.
+type UploadRule struct {
+	AllowedTypes      []string `json:"allowed_types,omitempty"`
+	DeniedTypes       []string `json:"denied_types,omitempty"`
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
+	DeniedExtensions  []string `json:"denied_extensions,omitempty"`
+}
+
+// UploadPolicy is the rule applied to uploads, replaced by the rule of the route
+// (put, post, fetch or uploads) and then by the rule of the authenticated user
+type UploadPolicy struct {
+	UploadRule
+	Routes map[string]UploadRule `json:"routes,omitempty"`
+	Users  map[string]UploadRule `json:"users,omitempty"`
+}
+
+// LoadUploadPolicy reads an upload policy from a JSON file
+func LoadUploadPolicy(filepath string) (UploadPolicy, error) {
+	var policy UploadPolicy
+
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return policy, err
+	}
+
+	if err = json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("invalid upload policy %s: %w", filepath, err)
+	}
+
+	return policy, nil
+}
+
+// errPolicyViolation is returned for uploads the policy does not allow
+var errPolicyViolation = errors.New("file type not allowed")
+
+// policyViolation explains why a file is not allowed
+func policyViolation(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", errPolicyViolation, fmt.Sprintf(format, a...))
+}
+
+// uploadRule returns the rule applying to r
+func (s *Server) uploadRule(r *http.Request) UploadRule {
+	rule := s.uploadPolicy.UploadRule
+
+	if routeRule, ok := s.uploadPolicy.Routes[uploadRoute(r)]; ok {
+		rule = routeRule
+	}
+
+	if user, ok := r.Context().Value(authUserKey).(string); ok {
+		if userRule, ok := s.uploadPolicy.Users[user]; ok {
+			rule = userRule
+		}
+	}
+
+	return rule
+}
+
+// uploadRoute names the kind of upload r is, for per-route policy overrides
+func uploadRoute(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/fetch"):
+		return "fetch"
+	case strings.HasPrefix(r.URL.Path, "/uploads/"):
+		return "uploads"
+	case r.Method == http.MethodPost:
+		return "post"
+	}
+
+	return "put"
+}
+
+// empty indicates if the policy allows everything
+func (p UploadPolicy) empty() bool {
+	return p.UploadRule.empty() && len(p.Routes) == 0 && len(p.Users) == 0
+}
+
+// empty indicates if the rule allows everything
+func (rule UploadRule) empty() bool {
+	return len(rule.AllowedTypes) == 0 && len(rule.DeniedTypes) == 0 &&
+		len(rule.AllowedExtensions) == 0 && len(rule.DeniedExtensions) == 0
+}
+
+// check returns a policy violation if a file named filename of contentType is not
+// allowed. The type sniffed from head is checked as well, as contentType may be a
+// more specific type claimed by the client.
+func (rule UploadRule) check(filename, contentType string, head []byte) error {
+	contentTypes := []string{contentType}
+	if len(head) > 0 {
+		contentTypes = append(contentTypes, sniffContentType(head))
+	}
+
+	for _, contentType := range contentTypes {
+		if err := rule.checkDenied(filename, contentType); err != nil {
+			return err
+		}
+	}
+
+	if len(rule.AllowedExtensions) > 0 && !matchExtension(rule.AllowedExtensions, filename) {
+		return policyViolation("extension of %s", filename)
+	}
+
+	if len(rule.AllowedTypes) == 0 {
+		return nil
+	}
+
+	for _, contentType := range contentTypes {
+		if matchType(rule.AllowedTypes, contentType) {
+			return nil
+		}
+	}
+
+	return policyViolation("%s", policyMediaType(contentType))
+}
+
+// checkDenied only checks the deny lists of the rule
+func (rule UploadRule) checkDenied(filename, contentType string) error {
+	if matchExtension(rule.DeniedExtensions, filename) {
+		return policyViolation("extension of %s", filename)
+	}
+
+	if matchType(rule.DeniedTypes, contentType) {
+		return policyViolation("%s", policyMediaType(contentType))
+	}
+
+	return nil
+}
+
+// inspectsArchive indicates if the files inside an archive starting with head must be checked
+func (rule UploadRule) inspectsArchive(head []byte) bool {
+	if len(rule.DeniedTypes) == 0 && len(rule.DeniedExtensions) == 0 {
+		return false
+	}
+
+	switch policyMediaType(sniffContentType(head)) {
+	case "application/zip", "application/x-tar", "application/x-gzip":
+		return true
+	}
+
+	return false
+}
+
+// checkArchive checks the files inside the zip, tar or gzipped tar archive file,
+// starting with head, against the deny lists of the rule
+func (rule UploadRule) checkArchive(file *os.File, head []byte) error {
+	switch policyMediaType(sniffContentType(head)) {
+	case "application/zip":
+		fi, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		archive, err := zip.NewReader(file, fi.Size())
+		if err != nil {
+			return policyViolation("unreadable zip archive")
+		}
+
+		if len(archive.File) > maxInspectedEntries {
+			return policyViolation("too many files in archive")
+		}
+
+		for _, f := range archive.File {
+			if err := rule.checkArchiveEntry(f.Name, f.Open); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case "application/x-gzip":
+		gz, err := gzip.NewReader(io.NewSectionReader(file, 0, 1<<62))
+		if err != nil {
+			return policyViolation("unreadable gzip file")
+		}
+		defer gz.Close()
+
+		innerHead, reader, err := readHead(io.NopCloser(gz))
+		if err != nil {
+			return policyViolation("unreadable gzip file")
+		}
+
+		// only gzipped tar archives hold several files
+		if innerType := sniffContentType(innerHead); policyMediaType(innerType) != "application/x-tar" {
+			return rule.checkDenied(gz.Name, innerType)
+		}
+
+		return rule.checkTar(reader)
+	}
+
+	return rule.checkTar(io.NewSectionReader(file, 0, 1<<62))
+}
+
+func (rule UploadRule) checkTar(reader io.Reader) error {
+	archive := tar.NewReader(reader)
+	for entries := 0; ; entries++ {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return policyViolation("unreadable tar archive")
+		}
+
+		if entries >= maxInspectedEntries {
+			return policyViolation("too many files in archive")
+		}
+
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		if err := rule.checkArchiveEntry(header.Name, func() (io.ReadCloser, error) {
+			return io.NopCloser(archive), nil
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+func (rule UploadRule) checkArchiveEntry(name string, open func() (io.ReadCloser, error)) error {
+	if strings.HasSuffix(name, "/") {
+		return nil
+	}
+
+	if matchExtension(rule.DeniedExtensions, name) {
+		return policyViolation("extension of %s in archive", path.Base(name))
+	}
+
+	reader, err := open()
+	if err != nil {
+		return policyViolation("unreadable file %s in archive", path.Base(name))
+	}
+	defer reader.Close()
+
+	head, _, err := readHead(reader)
+	if err != nil {
+		return policyViolation("unreadable file %s in archive", path.Base(name))
+	}
+
+	if contentType := sniffContentType(head); matchType(rule.DeniedTypes, contentType) {
+		return policyViolation("%s in archive", policyMediaType(contentType))
+	}
+
+	return nil
+}
+
+// policyMediaType returns the lower cased media type of contentType, unknown ones
+// being application/octet-stream
+func policyMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "application/octet-stream"
+	}
+
+	return mediaType
+}
+
+func matchType(patterns []string, contentType string) bool {
+	mediaType := policyMediaType(contentType)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == mediaType || pattern == "*/*" ||
+			strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchExtension(extensions []string, filename string) bool {
+	filename = strings.ToLower(filename)
+	for _, extension := range extensions {
+		extension = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(extension)), ".")
+		if extension != "" && strings.HasSuffix(filename, "."+extension) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contextKey keys the values handlers put in request contexts
+type contextKey string
+
+// authUserKey keys the user authenticated by basicAuthHandler
+const authUserKey contextKey = "authUser"
+
+// withAuthUser records the user authenticated for r
+func withAuthUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authUserKey, user))
+}
+
+// policyError writes the response for an upload violating the policy
+func (s *Server) policyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPolicyViolation) {
+		s.logger.Printf("Upload rejected: %s", err.Error())
+		http.Error(w, "Unsupported Media Type, "+err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s.logger.Printf("%s", err.Error())
+	http.Error(w, "Could not check file type", http.StatusInternalServerError)
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"archive/zip"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadRuleCheck(t *testing.T) {
+	rule := UploadRule{
+		AllowedTypes:     []string{"image/*", "text/plain"},
+		DeniedTypes:      []string{"image/svg+xml"},
+		DeniedExtensions: []string{".exe"},
+	}
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+	for _, tc := range []struct {
+		filename    string
+		contentType string
+		head        []byte
+		allowed     bool
+	}{
+		{"photo.png", "image/png", png, true},
+		{"notes.txt", "text/plain; charset=utf-8", []byte("notes"), true},
+		{"logo.svg", "image/svg+xml", nil, false},
+		{"setup.exe", "image/png", png, false},
+		{"SETUP.EXE", "image/png", png, false},
+		{"data.json", "application/json", nil, false},
+		// the sniffed type is checked besides the claimed one
+		{"photo.png", "image/png", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), false},
+	} {
+		err := rule.check(tc.filename, tc.contentType, tc.head)
+		if allowed := err == nil; allowed != tc.allowed {
+			t.Errorf("check(%q, %q) = %v, want allowed %v", tc.filename, tc.contentType, err, tc.allowed)
+		} else if err != nil && !errors.Is(err, errPolicyViolation) {
+			t.Errorf("check(%q, %q) = %v, want a policy violation", tc.filename, tc.contentType, err)
+		}
+	}
+}
+
+func TestUploadRuleOverrides(t *testing.T) {
+	s := &Server{uploadPolicy: UploadPolicy{
+		UploadRule: UploadRule{DeniedExtensions: []string{"exe"}},
+		Routes:     map[string]UploadRule{"fetch": {DeniedExtensions: []string{"iso"}}},
+		Users:      map[string]UploadRule{"admin": {}},
+	}}
+
+	if err := s.uploadRule(httptest.NewRequest("PUT", "/setup.exe", nil)).check("setup.exe", "", nil); err == nil {
+		t.Error("default rule allowed setup.exe")
+	}
+
+	fetch := s.uploadRule(httptest.NewRequest("POST", "/fetch/setup.exe", nil))
+	if fetch.check("setup.exe", "", nil) != nil || fetch.check("disk.iso", "", nil) == nil {
+		t.Error("route rule did not replace the default rule")
+	}
+
+	admin := s.uploadRule(withAuthUser(httptest.NewRequest("PUT", "/setup.exe", nil), "admin"))
+	if err := admin.check("setup.exe", "", nil); err != nil {
+		t.Errorf("user rule did not replace the default rule: %v", err)
+	}
+}
+
+func TestUploadRuleCheckArchive(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+	for _, name := range []string{"docs/readme.txt", "bin/setup.exe"} {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _ = fw.Write([]byte("content"))
+	}
+
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	head := make([]byte, 512)
+	n, _ := file.ReadAt(head, 0)
+	head = head[:n]
+
+	rule := UploadRule{DeniedExtensions: []string{"exe"}}
+	if !rule.inspectsArchive(head) {
+		t.Fatal("zip archive not inspected")
+	}
+
+	if err = rule.checkArchive(file, head); !errors.Is(err, errPolicyViolation) {
+		t.Errorf("checkArchive = %v, want a policy violation", err)
+	}
+
+	if err = (UploadRule{DeniedExtensions: []string{"iso"}}).checkArchive(file, head); err != nil {
+		t.Errorf("checkArchive without denied entries = %v", err)
+	}
+}
@@ -0,0 +1,514 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+// Scanner inspects files for malware
+type Scanner interface {
+	// Name identifies the scanner in scan results
+	Name() string
+	// Scan scans the file at path, returning what was detected, like a signature
+	// name, or an empty string when the file is clean
+	Scan(ctx context.Context, path string) (detection string, err error)
+}
+
+// StreamScanner is implemented by scanners able to scan files while they are uploaded
+type StreamScanner interface {
+	Scanner
+	// ScanStream scans the content read from reader
+	ScanStream(ctx context.Context, reader io.Reader) (detection string, err error)
+}
+
+const (
+	scanStatusPending  = "pending"
+	scanStatusClean    = "clean"
+	scanStatusInfected = "infected"
+	scanStatusError    = "error"
+)
+
+// defaultScanTimeout bounds the time a scanner takes on a file
+const defaultScanTimeout = 60 * time.Second
+
+// scanQueueSize bounds the stored files waiting for an asynchronous scan
+const scanQueueSize = 1000
+
+var (
+	errScanPending = errors.New("file has not passed its scan yet")
+	errQuarantined = errors.New("file is quarantined")
+)
+
+// scanResult is the verdict of a scanner on a file
+type scanResult struct {
+	Scanner   string
+	Status    string
+	Detection string
+	Time      time.Time
+}
+
+// scanJob is a stored file waiting for an asynchronous scan
+type scanJob struct {
+	token    string
+	filename string
+	// attempt is the number of scans of the file which failed
+	attempt int
+}
+
+const (
+	// scanRetryDelay is the delay before scanning again a file whose scan failed,
+	// doubling with every attempt up to maxScanRetryDelay
+	scanRetryDelay    = time.Minute
+	maxScanRetryDelay = time.Hour
+)
+
+// scanFile runs the scanners on the file at path, up to the first detection, and
+// returns the overall status along with the result of every scanner
+func (s *Server) scanFile(ctx context.Context, scanners []Scanner, path string) (string, []scanResult) {
+	timeout := s.scanTimeout
+	if timeout <= 0 {
+		timeout = defaultScanTimeout
+	}
+
+	results := make([]scanResult, 0, len(scanners))
+	for _, scanner := range scanners {
+		scanCtx, cancel := context.WithTimeout(ctx, timeout)
+		detection, err := scanner.Scan(scanCtx, path)
+		cancel()
+
+		results = append(results, s.newScanResult(scanner, detection, err))
+		if detection != "" && err == nil {
+			break
+		}
+	}
+
+	return scanStatusOf(results), results
+}
+
+// copyAndScan spools src into file while the stream scanners scan it, then runs the
+// other scanners on the spooled file
+func (s *Server) copyAndScan(ctx context.Context, file *os.File, src io.Reader) (int64, string, []scanResult, error) {
+	type outcome struct {
+		index     int
+		detection string
+		err       error
+	}
+
+	var streamScanners, fileScanners []Scanner
+	for _, scanner := range s.scanners {
+		if _, ok := scanner.(StreamScanner); ok {
+			streamScanners = append(streamScanners, scanner)
+		} else {
+			fileScanners = append(fileScanners, scanner)
+		}
+	}
+
+	writers := []io.Writer{file}
+	pipes := make([]*io.PipeWriter, 0, len(streamScanners))
+	outcomes := make(chan outcome, len(streamScanners))
+
+	for i, scanner := range streamScanners {
+		pr, pw := io.Pipe()
+		writers = append(writers, pw)
+		pipes = append(pipes, pw)
+
+		go func(i int, scanner StreamScanner) {
+			detection, err := scanner.ScanStream(ctx, pr)
+			// keep the upload going when the scanner stopped early
+			_, _ = io.Copy(io.Discard, pr)
+			outcomes <- outcome{i, detection, err}
+		}(i, scanner.(StreamScanner))
+	}
+
+	n, err := io.Copy(io.MultiWriter(writers...), src)
+	for _, pw := range pipes {
+		_ = pw.CloseWithError(err)
+	}
+
+	outcomeList := make([]outcome, len(streamScanners))
+	for range streamScanners {
+		o := <-outcomes
+		outcomeList[o.index] = o
+	}
+
+	if err != nil {
+		return n, "", nil, err
+	}
+
+	results := make([]scanResult, len(streamScanners))
+	for i, o := range outcomeList {
+		results[i] = s.newScanResult(streamScanners[i], o.detection, o.err)
+	}
+
+	if status := scanStatusOf(results); status != scanStatusInfected && len(fileScanners) > 0 {
+		_, fileResults := s.scanFile(ctx, fileScanners, file.Name())
+		results = append(results, fileResults...)
+	}
+
+	return n, scanStatusOf(results), results, nil
+}
+
+// newScanResult records the verdict of scanner
+func (s *Server) newScanResult(scanner Scanner, detection string, err error) scanResult {
+	result := scanResult{Scanner: scanner.Name(), Status: scanStatusClean, Time: time.Now().UTC()}
+	if err != nil {
+		s.logger.Printf("Error scanning with %s: %s", scanner.Name(), err.Error())
+		result.Status = scanStatusError
+	} else if detection != "" {
+		result.Status = scanStatusInfected
+		result.Detection = detection
+	}
+
+	return result
+}
+
+// scanStatusOf returns the overall status of scan results: infected if any scanner
+// detected something, error if any failed and clean otherwise
+func scanStatusOf(results []scanResult) string {
+	status := scanStatusClean
+	for _, result := range results {
+		if result.Status == scanStatusInfected {
+			return scanStatusInfected
+		} else if result.Status == scanStatusError {
+			status = scanStatusError
+		}
+	}
+
+	return status
+}
+
+// scanBeforeStoring indicates if the upload of r is scanned before being stored.
+// Encrypted uploads always are, as their stored content cannot be scanned.
+func (s *Server) scanBeforeStoring(r *http.Request) bool {
+	return len(s.scanners) > 0 && (s.scanWorkers == 0 || r.Header.Get("X-Encrypt-Password") != "")
+}
+
+// scanAfterStoring indicates if the upload of r is quarantined once stored until
+// an asynchronous scan passes
+func (s *Server) scanAfterStoring(r *http.Request) bool {
+	return len(s.scanners) > 0 && !s.scanBeforeStoring(r)
+}
+
+// scanVerdictError writes the response for an upload failing its scan before being stored
+func (s *Server) scanVerdictError(w http.ResponseWriter, status string, results []scanResult) {
+	if status != scanStatusInfected {
+		http.Error(w, "Could not perform prescan", http.StatusInternalServerError)
+		return
+	}
+
+	result := infectedResult(results)
+	s.logger.Printf("prescan positive: %s %s", result.Scanner, result.Detection)
+	http.Error(w, fmt.Sprintf("Scan found a virus: %s", result.Detection), http.StatusPreconditionFailed)
+}
+
+// infectedResult returns the result of the scanner which detected something
+func infectedResult(results []scanResult) scanResult {
+	for _, result := range results {
+		if result.Status == scanStatusInfected {
+			return result
+		}
+	}
+
+	return scanResult{}
+}
+
+// scanError returns why a file cannot be downloaded because of its scans, if it cannot
+func (m metadata) scanError() error {
+	switch m.ScanStatus {
+	case "", scanStatusClean:
+		return nil
+	case scanStatusInfected:
+		return errQuarantined
+	}
+
+	return errScanPending
+}
+
+// scanStatusError writes the response for a file which cannot be downloaded because
+// of its scans, returning false for other errors
+func (s *Server) scanStatusError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, errScanPending):
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "File is being scanned, retry later", http.StatusLocked)
+	case errors.Is(err, errQuarantined):
+		http.Error(w, "File is quarantined", http.StatusForbidden)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// enqueueScan queues the asynchronous scan of a stored file, which stays pending,
+// to be picked up on the next start, if the queue is full
+func (s *Server) enqueueScan(token, filename string) {
+	select {
+	case s.scanQueue <- scanJob{token: token, filename: filename}:
+	default:
+		s.logger.Printf("Scan queue full, %s/%s stays pending", token, filename)
+	}
+}
+
+// startScanWorkers scans queued files until ctx is done, after queueing the files
+// left pending or failed by a previous run
+func (s *Server) startScanWorkers(ctx context.Context) {
+	for i := 0; i < s.scanWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-s.scanQueue:
+					if s.scanStoredFile(ctx, job.token, job.filename) == scanStatusError {
+						s.retryScan(ctx, job)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	lister, ok := storage.Capability[storage.Lister](s.storage)
+	if !ok {
+		return
+	}
+
+	go func() {
+		err := lister.List(ctx, "", func(token, filename string) error {
+			m, err := s.readMetadata(ctx, token, filename)
+			if err != nil || (m.ScanStatus != scanStatusPending && m.ScanStatus != scanStatusError) {
+				return nil
+			}
+
+			select {
+			case s.scanQueue <- scanJob{token: token, filename: filename}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil {
+			s.logger.Printf("Error listing files pending a scan: %s", err.Error())
+		}
+	}()
+}
+
+// retryScan queues again a file whose scan failed, after a delay growing with the attempts
+func (s *Server) retryScan(ctx context.Context, job scanJob) {
+	delay := maxScanRetryDelay
+	if job.attempt < 6 {
+		delay = min(scanRetryDelay<<job.attempt, maxScanRetryDelay)
+	}
+
+	job.attempt++
+	s.logger.Printf("Scanning %s/%s again in %s", job.token, job.filename, delay)
+
+	time.AfterFunc(delay, func() {
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case s.scanQueue <- job:
+		default:
+			s.logger.Printf("Scan queue full, %s/%s stays failed", job.token, job.filename)
+		}
+	})
+}
+
+// scanStoredFile scans a stored file and records the verdict in its metadata, returning
+// it. Verdicts on a version replaced while scanning are discarded, the new version
+// being scanned on its own.
+func (s *Server) scanStoredFile(ctx context.Context, token, filename string) string {
+	file, err := os.CreateTemp(s.tempPath, "scan-")
+	defer s.cleanTmpFile(file)
+	if err != nil {
+		s.logger.Printf("Error scanning %s/%s: %s", token, filename, err.Error())
+		return scanStatusError
+	}
+
+	s.lock(token, filename)
+	m, err := s.readMetadata(ctx, token, filename)
+	s.unlock(token, filename)
+
+	if s.storage.IsNotExist(err) {
+		return ""
+	} else if err != nil {
+		s.logger.Printf("Error scanning %s/%s: %s", token, filename, err.Error())
+		return scanStatusError
+	}
+
+	version := m.currentVersion()
+
+	reader, _, err := s.storage.Get(ctx, token, filename, nil)
+	if s.storage.IsNotExist(err) {
+		return ""
+	} else if err != nil {
+		s.logger.Printf("Error scanning %s/%s: %s", token, filename, err.Error())
+		return scanStatusError
+	}
+
+	_, err = io.Copy(file, reader)
+	storage.CloseCheck(reader)
+	if err != nil {
+		s.logger.Printf("Error scanning %s/%s: %s", token, filename, err.Error())
+		return scanStatusError
+	}
+
+	status, results := s.scanFile(ctx, s.scanners, file.Name())
+
+	s.lock(token, filename)
+	defer s.unlock(token, filename)
+
+	m, err = s.readMetadata(ctx, token, filename)
+	if s.storage.IsNotExist(err) {
+		return ""
+	} else if err != nil {
+		s.logger.Printf("Error scanning %s/%s: %s", token, filename, err.Error())
+		return scanStatusError
+	} else if m.currentVersion() != version {
+		// the verdict goes to the previous version the scanned content became, if still kept
+		i := slices.IndexFunc(m.Versions, func(v fileVersion) bool { return v.Version == version })
+		if i == -1 {
+			s.logger.Printf("Discarding scan of %s/%s, version %d was replaced", token, filename, version)
+			return ""
+		}
+
+		m.Versions[i].ScanStatus, m.Versions[i].ScanResults = status, results
+		if err = s.writeMetadata(ctx, token, filename, m); err != nil {
+			s.logger.Printf("Error recording scan of version %d of %s/%s: %s", version, token, filename, err.Error())
+		}
+
+		return ""
+	}
+
+	m.ScanStatus = status
+	m.ScanResults = results
+	if err = s.writeMetadata(ctx, token, filename, m); err != nil {
+		s.logger.Printf("Error recording scan of %s/%s: %s", token, filename, err.Error())
+		return scanStatusError
+	}
+
+	if status == scanStatusInfected {
+		s.logger.Printf("Quarantined %s/%s: %s", token, filename, infectedResult(results).Detection)
+	}
+
+	return status
+}
+
+// commandScanner scans files with an external command, getting the path of the
+// file as last argument. Like clamdscan, it exits with 0 for clean files and with 1
+// for infected ones, printing what was detected.
+type commandScanner struct {
+	name string
+	args []string
+}
+
+// NewCommandScanner returns a scanner running command, split on spaces
+func NewCommandScanner(command string) Scanner {
+	return commandScanner{name: "command", args: strings.Fields(command)}
+}
+
+// Name identifies the scanner in scan results
+func (c commandScanner) Name() string {
+	return c.name
+}
+
+// Scan runs the command on the file at path
+func (c commandScanner) Scan(ctx context.Context, path string) (string, error) {
+	if len(c.args) == 0 {
+		return "", errors.New("no scan command")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.args[0], append(c.args[1:], path)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		detection, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), "\n")
+		if detection == "" {
+			detection = "detected by " + c.args[0]
+		}
+
+		return detection, nil
+	} else if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", c.args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return "", nil
+}
+
+// yaraScanner matches files against YARA rules with the yara command
+type yaraScanner struct {
+	rules string
+}
+
+// NewYARAScanner returns a scanner matching files against the compiled or source rules file
+func NewYARAScanner(rules string) Scanner {
+	return yaraScanner{rules: rules}
+}
+
+// Name identifies the scanner in scan results
+func (y yaraScanner) Name() string {
+	return "yara"
+}
+
+// Scan matches the file at path, reporting the matching rules
+func (y yaraScanner) Scan(ctx context.Context, path string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "yara", "--no-warnings", y.rules, path)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("yara: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var rules []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if rule, _, ok := strings.Cut(line, " "); ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	return strings.Join(rules, ", "), nil
+}
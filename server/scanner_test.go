@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+// signatureScanner detects files containing its signature, counting its scans
+type signatureScanner struct {
+	name, signature string
+	scans           *int
+}
+
+func (f signatureScanner) Name() string {
+	return f.name
+}
+
+func (f signatureScanner) Scan(_ context.Context, path string) (string, error) {
+	*f.scans++
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return f.detect(data), nil
+}
+
+func (f signatureScanner) detect(data []byte) string {
+	if bytes.Contains(data, []byte(f.signature)) {
+		return f.signature + "-Test"
+	}
+
+	return ""
+}
+
+// streamSignatureScanner is a signatureScanner scanning uploads while they are spooled
+type streamSignatureScanner struct {
+	signatureScanner
+}
+
+func (f streamSignatureScanner) ScanStream(_ context.Context, reader io.Reader) (string, error) {
+	*f.scans++
+
+	data, err := io.ReadAll(reader)
+	return f.detect(data), err
+}
+
+type suiteScanner struct {
+	fileScans, streamScans int
+}
+
+func (s *suiteScanner) SetUpTest(c *C) {
+	s.fileScans, s.streamScans = 0, 0
+}
+
+func (s *suiteScanner) server(c *C, options ...OptionFn) *Server {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	srvr, err := New(append([]OptionFn{UseStorage(local), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10)}, options...)...)
+	c.Assert(err, IsNil)
+
+	return srvr
+}
+
+func (s *suiteScanner) scanners() []Scanner {
+	return []Scanner{
+		streamSignatureScanner{signatureScanner{"stream", "STREAM", &s.streamScans}},
+		signatureScanner{"file", "EICAR", &s.fileScans},
+	}
+}
+
+func (s *suiteScanner) put(srvr *Server, content string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", "http://test/hello.txt", strings.NewReader(content))
+
+	w := httptest.NewRecorder()
+	srvr.putHandler(w, mux.SetURLVars(req, map[string]string{"filename": "hello.txt"}))
+
+	return w
+}
+
+func (s *suiteScanner) get(srvr *Server, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://test/"+token+"/hello.txt", nil)
+
+	w := httptest.NewRecorder()
+	srvr.getHandler(w, mux.SetURLVars(req, map[string]string{"token": token, "filename": "hello.txt"}))
+
+	return w
+}
+
+func (s *suiteScanner) TestPrescan(c *C) {
+	srvr := s.server(c, UseScanners(s.scanners()...))
+
+	c.Assert(s.put(srvr, "hello").Code, Equals, http.StatusOK)
+	c.Assert(s.streamScans, Equals, 1)
+	c.Assert(s.fileScans, Equals, 1)
+
+	w := s.put(srvr, "hello EICAR")
+	c.Assert(w.Code, Equals, http.StatusPreconditionFailed)
+	c.Assert(w.Body.String(), Matches, "Scan found a virus: EICAR-Test\n")
+}
+
+func (s *suiteScanner) TestStreamDetectionSkipsFileScanners(c *C) {
+	srvr := s.server(c, UseScanners(s.scanners()...))
+
+	w := s.put(srvr, "hello STREAM")
+	c.Assert(w.Code, Equals, http.StatusPreconditionFailed)
+	c.Assert(w.Body.String(), Matches, "Scan found a virus: STREAM-Test\n")
+	c.Assert(s.fileScans, Equals, 0)
+}
+
+func (s *suiteScanner) TestQuarantinedUntilScanned(c *C) {
+	srvr := s.server(c, UseScanners(s.scanners()...), ScanAsync(1))
+
+	for content, status := range map[string]int{"hello": http.StatusOK, "hello EICAR": http.StatusForbidden} {
+		w := s.put(srvr, content)
+		c.Assert(w.Code, Equals, http.StatusOK)
+
+		token := strings.Split(strings.TrimPrefix(w.Body.String(), "http://test/"), "/")[0]
+		c.Assert(s.get(srvr, token).Code, Equals, http.StatusLocked)
+
+		srvr.scanStoredFile(context.Background(), token, "hello.txt")
+		c.Assert(s.get(srvr, token).Code, Equals, status, Commentf("%s", content))
+	}
+}
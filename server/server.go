@@ -26,12 +26,10 @@ package server
 
 import (
 	"context"
-	cryptoRand "crypto/rand"
 	"crypto/tls"
-	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
-	"math/rand"
 	"mime"
 	"net/http"
 	_ "net/http/pprof"
@@ -39,6 +37,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"syscall"
@@ -80,6 +79,105 @@ func PerformClamavPrescan(b bool) OptionFn {
 	}
 }
 
+// UseScanners sets the scanners uploads have to pass before being downloadable
+func UseScanners(scanners ...Scanner) OptionFn {
+	return func(srvr *Server) {
+		srvr.scanners = scanners
+	}
+}
+
+// ScanAsync scans uploads with workers goroutines once stored, quarantining them
+// until they pass, instead of before storing them
+func ScanAsync(workers int) OptionFn {
+	return func(srvr *Server) {
+		srvr.scanWorkers = workers
+	}
+}
+
+// ScanTimeout sets the timeout in seconds of a scanner on a file, or of every read
+// and write of streaming scanners
+func ScanTimeout(seconds int) OptionFn {
+	return func(srvr *Server) {
+		srvr.scanTimeout = time.Duration(seconds) * time.Second
+	}
+}
+
+// Retention sets the lifetime of files uploaded without expiry headers and the
+// maximum lifetime of files, zero meaning unlimited
+func Retention(defaultRetention, maxRetention time.Duration) OptionFn {
+	return func(srvr *Server) {
+		srvr.defaultRetention = defaultRetention
+		srvr.maxRetention = maxRetention
+	}
+}
+
+// MaxDownloads caps the number of downloads of files, zero meaning unlimited
+func MaxDownloads(maxDownloads int) OptionFn {
+	return func(srvr *Server) {
+		srvr.maxDownloads = maxDownloads
+	}
+}
+
+// KeepVersions sets how many previous versions of files are kept when their owners
+// upload new ones, zero keeping none
+func KeepVersions(keepVersions int) OptionFn {
+	return func(srvr *Server) {
+		srvr.keepVersions = keepVersions
+	}
+}
+
+// TrashRetention keeps deleted files in a trash for retention, during which their owners
+// and admins can restore them, instead of deleting them at once
+func TrashRetention(retention time.Duration) OptionFn {
+	return func(srvr *Server) {
+		srvr.trashRetention = retention
+	}
+}
+
+// BurnAfterReading deletes files once their last allowed download completed, instead
+// of only refusing further downloads
+func BurnAfterReading() OptionFn {
+	return func(srvr *Server) {
+		srvr.burnAfterReading = true
+	}
+}
+
+// PreviewBots sets the regular expressions matching the User-Agent of link unfurlers,
+// whose downloads are not counted, instead of the built-in list
+func PreviewBots(patterns []string) OptionFn {
+	return func(srvr *Server) {
+		srvr.previewBotPatterns = patterns
+	}
+}
+
+// AdminToken sets the token admin requests carry in the X-Admin-Token header
+func AdminToken(token string) OptionFn {
+	return func(srvr *Server) {
+		srvr.adminToken = token
+	}
+}
+
+// HashBlocklist sets the path of the blocklist of SHA-256 of files which cannot be uploaded
+func HashBlocklist(path string) OptionFn {
+	return func(srvr *Server) {
+		srvr.blocklistPath = path
+	}
+}
+
+// AbuseReports sets the path of the file recording abuse reports
+func AbuseReports(path string) OptionFn {
+	return func(srvr *Server) {
+		srvr.abuseReportsPath = path
+	}
+}
+
+// AuditLog sets the path of the file recording legal holds and their releases
+func AuditLog(path string) OptionFn {
+	return func(srvr *Server) {
+		srvr.auditLogPath = path
+	}
+}
+
 // VirustotalKey sets virus total key
 func VirustotalKey(s string) OptionFn {
 	return func(srvr *Server) {
@@ -180,6 +278,13 @@ func TempPath(s string) OptionFn {
 	}
 }
 
+// TempPathMinFree sets the free space to keep on temp path, in megabytes
+func TempPathMinFree(mbytes int64) OptionFn {
+	return func(srvr *Server) {
+		srvr.tempPathMinFree = mbytes * 1024 * 1024
+	}
+}
+
 // LogFile sets log file
 func LogFile(logger *log.Logger, s string) OptionFn {
 	return func(srvr *Server) {
@@ -230,6 +335,13 @@ func Purge(days, interval int) OptionFn {
 	}
 }
 
+// DownloadRedirect enables redirecting downloads to presigned storage URLs valid for expiry seconds
+func DownloadRedirect(expiry int) OptionFn {
+	return func(srvr *Server) {
+		srvr.downloadRedirectExpiry = time.Duration(expiry) * time.Second
+	}
+}
+
 // ForceHTTPS sets forcing https
 func ForceHTTPS() OptionFn {
 	return func(srvr *Server) {
@@ -244,6 +356,35 @@ func EnableProfiler() OptionFn {
 	}
 }
 
+// UseTokenGenerator sets the generator of upload tokens
+func UseTokenGenerator(generator TokenGenerator) OptionFn {
+	return func(srvr *Server) {
+		srvr.tokenGenerator = generator
+	}
+}
+
+// ReservedTokens sets tokens, besides the ones clashing with routes, uploads cannot use
+func ReservedTokens(tokens []string) OptionFn {
+	return func(srvr *Server) {
+		srvr.reservedTokens = tokens
+	}
+}
+
+// Fetch sets the timeout in seconds, redirect limit and allowlist of hosts, IPs
+// and CIDRs of server-side fetches
+func Fetch(timeout, maxRedirects int, allowlist []string) OptionFn {
+	return func(srvr *Server) {
+		srvr.fetchClient = newFetchClient(time.Duration(timeout)*time.Second, maxRedirects, allowlist)
+	}
+}
+
+// UseUploadPolicy sets the policy allowing or denying uploads by content type and extension
+func UseUploadPolicy(policy UploadPolicy) OptionFn {
+	return func(srvr *Server) {
+		srvr.uploadPolicy = policy
+	}
+}
+
 // UseStorage set storage to use
 func UseStorage(s storage.Storage) OptionFn {
 	return func(srvr *Server) {
@@ -358,9 +499,18 @@ type Server struct {
 
 	storage storage.Storage
 
+	downloadRedirectExpiry time.Duration
+
 	forceHTTPS bool
 
 	randomTokenLength int
+	tokenGenerator    TokenGenerator
+	reservedTokens    []string
+	tokenReservations sync.Map
+
+	fetchClient *http.Client
+
+	uploadPolicy UploadPolicy
 
 	ipFilterOptions *IPFilterOptions
 
@@ -368,7 +518,32 @@ type Server struct {
 	ClamAVDaemonHost     string
 	performClamavPrescan bool
 
-	tempPath string
+	scanners    []Scanner
+	scanWorkers int
+	scanTimeout time.Duration
+	scanQueue   chan scanJob
+
+	defaultRetention time.Duration
+	maxRetention     time.Duration
+	maxDownloads     int
+	keepVersions     int
+	trashRetention   time.Duration
+
+	burnAfterReading   bool
+	previewBotPatterns []string
+	previewBots        *regexp.Regexp
+	downloads          *downloadTracker
+
+	adminToken        string
+	blocklistPath     string
+	blocklist         *hashBlocklist
+	abuseReportsPath  string
+	abuseReportsMutex sync.Mutex
+	auditLogPath      string
+	auditLogMutex     sync.Mutex
+
+	tempPath        string
+	tempPathMinFree int64
 
 	webPath      string
 	proxyPath    string
@@ -399,18 +574,47 @@ func New(options ...OptionFn) (*Server, error) {
 		optionFn(s)
 	}
 
-	return s, nil
-}
+	if s.performClamavPrescan && len(s.scanners) == 0 {
+		s.scanners = []Scanner{NewClamAVScanner(s.ClamAVDaemonHost, s.scanTimeout, defaultClamdPoolSize)}
+	}
+
+	s.scanQueue = make(chan scanJob, scanQueueSize)
+
+	if s.previewBotPatterns == nil {
+		s.previewBotPatterns = defaultPreviewBots
+	}
+
+	previewBots, err := compilePreviewBots(s.previewBotPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid preview bot pattern: %w", err)
+	}
+
+	s.previewBots = previewBots
+
+	if s.trashRetention > 0 && s.purgeInterval == 0 {
+		return nil, errors.New("trash retention needs a purge interval, the purge empties the trash")
+	}
+	s.downloads = newDownloadTracker()
+
+	if s.blocklistPath != "" {
+		blocklist, err := loadHashBlocklist(s.blocklistPath)
+		if err != nil {
+			return nil, err
+		}
 
-var theRand *rand.Rand
+		s.blocklist = blocklist
+	}
 
-func init() {
-	var seedBytes [8]byte
-	if _, err := cryptoRand.Read(seedBytes[:]); err != nil {
-		panic("cannot obtain cryptographically secure seed")
+	if s.fetchClient == nil {
+		s.fetchClient = newFetchClient(defaultFetchTimeout, defaultFetchMaxRedirects, nil)
 	}
 
-	theRand = rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seedBytes[:]))))
+	return s, nil
+}
+
+// limitByIP limits the requests of each IP address to h to requests per minute
+func limitByIP(requests int, h http.Handler) http.Handler {
+	return ratelimit.Request(ratelimit.IP).Rate(requests, 60*time.Second).LimitBy(memory.New())(h)
 }
 
 // Run starts Server
@@ -455,7 +659,7 @@ func (s *Server) Run() {
 			}
 
 			if strings.HasSuffix(path, ".html") {
-				_, err = htmlTemplates.New(stripPrefix(path)).Parse(string(bytes))
+				_, err = htmlTemplates.New(stripPrefix(path)).Parse(withDownloadDetails(path, string(bytes)))
 				if err != nil {
 					s.logger.Println("Unable to parse html template", err)
 				}
@@ -488,6 +692,11 @@ func (s *Server) Run() {
 	r.HandleFunc("/({files:.*}).tar", s.tarHandler).Methods("GET")
 	r.HandleFunc("/({files:.*}).tar.gz", s.tarGzHandler).Methods("GET")
 
+	r.HandleFunc("/{token}/", s.collectionHandler).Methods("GET")
+	r.HandleFunc("/{token}.zip", s.zipHandler).Methods("GET")
+	r.HandleFunc("/{token}.tar.gz", s.tarGzHandler).Methods("GET")
+	r.HandleFunc("/{token}.tar", s.tarHandler).Methods("GET")
+
 	r.HandleFunc("/{token}/{filename}", s.headHandler).Methods("HEAD")
 	r.HandleFunc("/{action:(?:download|get|inline)}/{token}/{filename}", s.headHandler).Methods("HEAD")
 
@@ -513,21 +722,43 @@ func (s *Server) Run() {
 
 	getHandlerFn := s.getHandler
 	if s.rateLimitRequests > 0 {
-		getHandlerFn = ratelimit.Request(ratelimit.IP).Rate(s.rateLimitRequests, 60*time.Second).LimitBy(memory.New())(http.HandlerFunc(getHandlerFn)).ServeHTTP
+		getHandlerFn = limitByIP(s.rateLimitRequests, http.HandlerFunc(getHandlerFn)).ServeHTTP
 	}
 
+	r.HandleFunc("/admin/reports", s.adminHandler(http.HandlerFunc(s.abuseReportsHandler))).Methods("GET")
+	r.HandleFunc("/admin/blocklist", s.adminHandler(http.HandlerFunc(s.blocklistImportHandler))).Methods("POST")
+	r.HandleFunc("/admin/takedown/{token}/{filename}", s.adminHandler(http.HandlerFunc(s.takedownHandler))).Methods("POST")
+	r.HandleFunc("/admin/restore/{token}/{filename}", s.adminHandler(s.restoreHandler(false))).Methods("POST")
+	r.HandleFunc("/admin/hold/{token}/{filename}", s.adminHandler(http.HandlerFunc(s.legalHoldHandler))).Methods("POST", "DELETE")
+
 	r.HandleFunc("/{token}/{filename}", getHandlerFn).Methods("GET")
 	r.HandleFunc("/{action:(?:download|get|inline)}/{token}/{filename}", getHandlerFn).Methods("GET")
 
+	r.HandleFunc("/uploads/{filename}", s.basicAuthHandler(http.HandlerFunc(s.initiateUploadHandler))).Methods("POST")
+	r.HandleFunc("/uploads/{uploadID}/complete", s.basicAuthHandler(http.HandlerFunc(s.completeUploadHandler))).Methods("POST")
+	r.HandleFunc("/uploads/{uploadID}/{partNumber:[0-9]+}", s.basicAuthHandler(http.HandlerFunc(s.uploadPartHandler))).Methods("PUT")
+	r.HandleFunc("/uploads/{uploadID}", s.basicAuthHandler(http.HandlerFunc(s.abortUploadHandler))).Methods("DELETE")
+
+	r.HandleFunc("/fetch", s.basicAuthHandler(http.HandlerFunc(s.fetchHandler))).Methods("POST")
+	r.HandleFunc("/fetch/{filename}", s.basicAuthHandler(http.HandlerFunc(s.fetchHandler))).Methods("POST")
+
 	r.HandleFunc("/{filename}/virustotal", s.virusTotalHandler).Methods("PUT")
 	r.HandleFunc("/{filename}/scan", s.scanHandler).Methods("PUT")
 	r.HandleFunc("/put/{filename}", s.basicAuthHandler(http.HandlerFunc(s.putHandler))).Methods("PUT")
 	r.HandleFunc("/upload/{filename}", s.basicAuthHandler(http.HandlerFunc(s.putHandler))).Methods("PUT")
 	r.HandleFunc("/{filename}", s.basicAuthHandler(http.HandlerFunc(s.putHandler))).Methods("PUT")
 	r.HandleFunc("/", s.basicAuthHandler(http.HandlerFunc(s.postHandler))).Methods("POST")
+	r.HandleFunc("/{token}", s.basicAuthHandler(http.HandlerFunc(s.postHandler))).Methods("POST")
 	// r.HandleFunc("/{page}", viewHandler).Methods("GET")
 
 	r.HandleFunc("/{token}/{filename}/{deletionToken}", s.deleteHandler).Methods("DELETE")
+	r.HandleFunc("/{token}/{filename}/{deletionToken}", s.patchHandler).Methods("PATCH")
+	r.HandleFunc("/{token}/{filename}/{deletionToken}", s.basicAuthHandler(http.HandlerFunc(s.versionHandler))).Methods("PUT")
+	r.HandleFunc("/{token}/{filename}/{deletionToken}/rollback", s.rollbackHandler).Methods("POST")
+	r.HandleFunc("/{token}/{filename}/{deletionToken}/restore", s.restoreHandler(true)).Methods("POST")
+	r.HandleFunc("/{token}/{filename}/{deletionToken}/stats", s.statsHandler).Methods("GET")
+	r.HandleFunc("/{token}/{filename}/{deletionToken}/virustotal", s.virusTotalCheckHandler).Methods("POST")
+	r.Handle("/{token}/{filename}/report", limitByIP(abuseReportsPerMinute, http.HandlerFunc(s.abuseReportHandler))).Methods("POST")
 
 	r.NotFoundHandler = http.HandlerFunc(s.notFoundHandler)
 
@@ -540,7 +771,7 @@ func (s *Server) Run() {
 		cors = gorillaHandlers.CORS(
 			gorillaHandlers.AllowedHeaders([]string{"*"}),
 			gorillaHandlers.AllowedOrigins(strings.Split(s.CorsDomains, ",")),
-			gorillaHandlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"}),
+			gorillaHandlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
 		)
 	} else {
 		cors = func(h http.Handler) http.Handler {
@@ -552,7 +783,7 @@ func (s *Server) Run() {
 		ipFilterHandler(
 			handlers.LogHandler(
 				LoveHandler(
-					s.RedirectHandler(cors(r))),
+					s.RedirectHandler(cors(s.storageHealthHandler(r)))),
 				handlers.NewLogOptions(s.logger.Printf, "_default_"),
 			),
 			s.ipFilterOptions,
@@ -595,10 +826,17 @@ func (s *Server) Run() {
 
 	s.logger.Printf("---------------------------")
 
-	if s.purgeDays > 0 {
+	if s.purgeInterval > 0 {
 		go s.purgeHandler()
 	}
 
+	s.reserveUploadSessionTokens()
+	go s.uploadSessionReaper(context.Background())
+
+	if len(s.scanners) > 0 && s.scanWorkers > 0 {
+		s.startScanWorkers(context.Background())
+	}
+
 	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt)
 	signal.Notify(term, syscall.SIGTERM)
@@ -0,0 +1,199 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// sniffLen is the number of leading bytes content types are detected from
+const sniffLen = 512
+
+// signature identifies a content type by its magic bytes at offset
+type signature struct {
+	offset      int
+	magic       []byte
+	contentType string
+}
+
+// signatures complements http.DetectContentType with formats it does not know about
+var signatures = []signature{
+	{0, []byte("7z\xbc\xaf\x27\x1c"), "application/x-7z-compressed"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte("\xfd7zXZ\x00"), "application/x-xz"},
+	{0, []byte("\x28\xb5\x2f\xfd"), "application/zstd"},
+	{257, []byte("ustar"), "application/x-tar"},
+	{0, []byte("\x7fELF"), "application/x-elf"},
+	{0, []byte("MZ"), "application/vnd.microsoft.portable-executable"},
+	{0, []byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{0, []byte("\xce\xfa\xed\xfe"), "application/x-mach-binary"},
+	{0, []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+	{0, []byte("PAR1"), "application/vnd.apache.parquet"},
+	{0, []byte("{\\rtf"), "application/rtf"},
+	{0, []byte("fLaC"), "audio/flac"},
+	{0, []byte("8BPS"), "image/vnd.adobe.photoshop"},
+	{4, []byte("ftypheic"), "image/heic"},
+	{4, []byte("ftypavif"), "image/avif"},
+	{4, []byte("ftypqt  "), "video/quicktime"},
+	{4, []byte("ftypM4A "), "audio/mp4"},
+}
+
+var svgPattern = regexp.MustCompile(`(?i)<svg[\s>]`)
+
+// containerTypes are sniffed formats wrapping more specific ones, mapped to the
+// kinds of claimed types trusted to be more specific
+var containerTypes = map[string][]string{
+	"application/zip":    {"application/"},
+	"application/x-gzip": {"application/"},
+	"application/ogg":    {"application/", "audio/", "video/"},
+	"video/mp4":          {"audio/", "video/"},
+	"video/webm":         {"audio/", "video/"},
+}
+
+// sniffContentType detects the content type of data from its leading bytes
+func sniffContentType(data []byte) string {
+	for _, sig := range signatures {
+		if len(data) >= sig.offset+len(sig.magic) && bytes.Equal(data[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+			return sig.contentType
+		}
+	}
+
+	contentType := http.DetectContentType(data)
+	if (strings.HasPrefix(contentType, "text/plain") || strings.HasPrefix(contentType, "text/xml")) && svgPattern.Match(data) {
+		return "image/svg+xml"
+	}
+
+	return contentType
+}
+
+// mediaType returns the lower cased media type of contentType, without
+// parameters, or an empty string when it is invalid or says nothing specific
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	switch mediaType {
+	case "application/octet-stream", "binary/octet-stream", "application/x-www-form-urlencoded", "multipart/form-data":
+		return ""
+	}
+
+	return mediaType
+}
+
+// detectContentType reconciles the content type sniffed from the leading bytes
+// of a file with the one claimed by the client or, lacking it, by the extension
+// of filename. Content rendering as markup is never trusted to be anything else.
+func detectContentType(data []byte, filename string, declared string) string {
+	claimed := declared
+	if mediaType(claimed) == "" {
+		claimed = mime.TypeByExtension(filepath.Ext(filename))
+	}
+
+	claimedType := mediaType(claimed)
+	if len(data) == 0 {
+		if claimedType == "" {
+			return ""
+		}
+
+		return claimed
+	}
+
+	sniffed := sniffContentType(data)
+	sniffedType := mediaType(sniffed)
+
+	switch {
+	case claimedType == "":
+		return sniffed
+	case canContainsXSS(sniffed):
+		if canContainsXSS(claimedType) {
+			return claimed
+		}
+
+		return sniffed
+	case sniffedType == "":
+		// unknown binary content is not text
+		if strings.HasPrefix(claimedType, "text/") || canContainsXSS(claimedType) {
+			return sniffed
+		}
+
+		return claimed
+	case sniffedType == "text/plain":
+		// formats with a signature would have been sniffed
+		for _, prefix := range []string{"image/", "audio/", "video/"} {
+			if strings.HasPrefix(claimedType, prefix) && !canContainsXSS(claimedType) {
+				return sniffed
+			}
+		}
+
+		return claimed
+	case claimedType == sniffedType:
+		return claimed
+	}
+
+	if !strings.HasPrefix(claimedType, "text/") && !canContainsXSS(claimedType) {
+		for _, prefix := range containerTypes[sniffedType] {
+			if strings.HasPrefix(claimedType, prefix) {
+				return claimed
+			}
+		}
+	}
+
+	return sniffed
+}
+
+// readHead reads the leading bytes of reader to detect its content type,
+// returning a reader still yielding the whole content
+func readHead(reader io.ReadCloser) ([]byte, io.ReadCloser, error) {
+	head := make([]byte, sniffLen)
+
+	if file, ok := reader.(*os.File); ok {
+		n, err := file.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			return nil, reader, err
+		}
+
+		return head[:n], reader, nil
+	}
+
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, reader, err
+	}
+	head = head[:n]
+
+	return head, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), reader), reader}, nil
+}
@@ -0,0 +1,41 @@
+package server
+
+import "testing"
+
+func TestDetectContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	html := []byte("<!DOCTYPE html><html><script>alert(1)</script></html>")
+	zip := []byte("PK\x03\x04\x14\x00\x00\x00")
+	tar := append(make([]byte, 257), []byte("ustar\x0000")...)
+
+	for _, tc := range []struct {
+		data     []byte
+		filename string
+		declared string
+		want     string
+	}{
+		{nil, "hello.json", "", "application/json"},
+		{nil, "hello", "", ""},
+		{png, "image", "", "image/png"},
+		{png, "image.jpg", "", "image/png"},
+		{html, "image.png", "", "text/html; charset=utf-8"},
+		{html, "page", "text/plain", "text/html; charset=utf-8"},
+		{html, "page.html", "", "text/html; charset=utf-8"},
+		{[]byte("# Title"), "README", "text/markdown", "text/markdown"},
+		{[]byte(`{"a": 1}`), "data.json", "", "application/json"},
+		{[]byte("plain text"), "photo.png", "", "text/plain; charset=utf-8"},
+		{[]byte("plain text"), "notes", "text/csv", "text/csv"},
+		{[]byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), "logo.png", "", "image/svg+xml"},
+		{[]byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), "logo.svg", "", "image/svg+xml"},
+		{zip, "book", "application/epub+zip", "application/epub+zip"},
+		{zip, "page.html", "", "application/zip"},
+		{zip, "archive", "application/octet-stream", "application/zip"},
+		{tar, "backup", "", "application/x-tar"},
+		{[]byte("\x00\x01\x02\x03"), "page.html", "", "application/octet-stream"},
+		{[]byte("\x00\x01\x02\x03"), "custom.bin", "application/x-custom", "application/x-custom"},
+	} {
+		if got := detectContentType(tc.data, tc.filename, tc.declared); got != tc.want {
+			t.Errorf("detectContentType(%q, %q) = %q, want %q", tc.filename, tc.declared, got, tc.want)
+		}
+	}
+}
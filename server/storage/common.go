@@ -2,10 +2,12 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -51,6 +53,16 @@ func (r *Range) ContentRange() string {
 	return r.contentRange
 }
 
+// Bounds returns the first and last bytes of the accepted range, along with the
+// length of the whole content. ok is false if the range wasn't accepted.
+func (r *Range) Bounds() (start, end, total uint64, ok bool) {
+	if _, err := fmt.Sscanf(r.contentRange, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return 0, 0, 0, false
+	}
+
+	return start, end, total, true
+}
+
 var rexp *regexp.Regexp = regexp.MustCompile(`^bytes=([0-9]+)-([0-9]*)$`)
 
 // Parses HTTP Range header and returns struct on success
@@ -108,6 +120,84 @@ type Storage interface {
 	Type() string
 }
 
+// Lister is implemented by storages able to enumerate the stored files
+type Lister interface {
+	// List calls fn for every file stored under token, or for every stored file
+	// when token is empty. Metadata sidecars are not listed.
+	List(ctx context.Context, token string, fn func(token string, filename string) error) error
+}
+
+// ErrInsufficientStorage is returned when storing a file would breach the configured quota
+var ErrInsufficientStorage = errors.New("insufficient storage")
+
+// QuotaChecker is implemented by storages enforcing a quota on stored bytes or free space
+type QuotaChecker interface {
+	// CheckQuota returns ErrInsufficientStorage if contentLength more bytes cannot be stored
+	CheckQuota(ctx context.Context, contentLength uint64) error
+}
+
+// ErrLegalHold is returned when deleting or replacing a file under legal hold
+var ErrLegalHold = errors.New("file is under legal hold")
+
+// LegalHolder is implemented by storages able to protect files under legal hold
+// from being deleted or replaced, by the server as well as by purges and evictions
+type LegalHolder interface {
+	// SetLegalHold places a legal hold on a file, or releases it
+	SetLegalHold(ctx context.Context, token string, filename string, hold bool) error
+}
+
+// Evicter is implemented by storages able to free space by removing their oldest files
+type Evicter interface {
+	// Evict removes the oldest files once usage crossed the configured high-water mark
+	Evict(ctx context.Context) error
+}
+
+// Presigner is implemented by storages able to hand out short-lived direct download URLs
+type Presigner interface {
+	// PresignGet returns a URL, valid for expiry, downloading a file directly from the backend
+	// with the given Content-Type and Content-Disposition
+	PresignGet(ctx context.Context, token string, filename string, contentType string, contentDisposition string, expiry time.Duration) (string, error)
+}
+
+// MetadataStorage is implemented by storages able to keep metadata on the stored object
+// itself, instead of in a .metadata sidecar
+type MetadataStorage interface {
+	// PutWithMetadata saves a file on storage along with its metadata
+	PutWithMetadata(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64, metadata map[string]string) error
+	// GetMetadata retrieves the metadata stored on a file
+	GetMetadata(ctx context.Context, token string, filename string) (map[string]string, error)
+	// UpdateMetadata replaces the metadata stored on a file, leaving its content untouched
+	UpdateMetadata(ctx context.Context, token string, filename string, metadata map[string]string) error
+}
+
+// Part identifies an uploaded part of a multipart upload
+type Part struct {
+	Number int
+	ETag   string
+}
+
+// MultipartUploader is implemented by storages natively assembling uploads from parts
+type MultipartUploader interface {
+	// InitiateMultipart starts a multipart upload of a file, returning the upload id
+	InitiateMultipart(ctx context.Context, token string, filename string, contentType string, metadata map[string]string) (string, error)
+	// PutPart saves a part of a multipart upload, returning its ETag
+	PutPart(ctx context.Context, token string, filename string, uploadID string, number int, reader io.ReadSeeker, contentLength uint64) (string, error)
+	// CompleteMultipart assembles the file from the given parts
+	CompleteMultipart(ctx context.Context, token string, filename string, uploadID string, parts []Part) error
+	// AbortMultipart discards a multipart upload and its parts
+	AbortMultipart(ctx context.Context, token string, filename string, uploadID string) error
+}
+
+// splitKey splits an object key into its token and filename, skipping metadata sidecars
+func splitKey(key string) (token string, filename string, ok bool) {
+	token, filename, ok = strings.Cut(key, "/")
+	if !ok || token == "" || filename == "" || strings.HasSuffix(filename, ".metadata") {
+		return "", "", false
+	}
+
+	return token, filename, true
+}
+
 func CloseCheck(c io.Closer) {
 	if c == nil {
 		return
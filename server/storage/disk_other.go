@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package storage
+
+import "errors"
+
+// DiskUsage returns the total and available bytes of the filesystem containing path
+func DiskUsage(string) (uint64, uint64, error) {
+	return 0, 0, errors.New("disk usage not supported on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import "syscall"
+
+// DiskUsage returns the total and available bytes of the filesystem containing path
+func DiskUsage(path string) (total uint64, free uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		return
+	}
+
+	total = uint64(st.Blocks) * uint64(st.Bsize)
+	free = uint64(st.Bavail) * uint64(st.Bsize)
+
+	return
+}
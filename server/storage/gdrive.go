@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -26,36 +28,39 @@ type GDrive struct {
 	basedir         string
 	localConfigPath string
 	chunkSize       int
+	sharedDriveID   string
 	logger          *log.Logger
+
+	// ids caches the ids of token folders and files, keyed by token and token/filename
+	ids sync.Map
 }
 
 const gDriveRootConfigFile = "root_id.conf"
 const gDriveTokenJSONFile = "token.json"
 const gDriveDirectoryMimeType = "application/vnd.google-apps.folder"
 
-// NewGDriveStorage is the factory for GDrive
-func NewGDriveStorage(ctx context.Context, clientJSONFilepath string, localConfigPath string, basedir string, chunkSize int, logger *log.Logger) (*GDrive, error) {
-
+// NewGDriveStorage is the factory for GDrive.
+// clientJSONFilepath holds either OAuth client credentials or a service account key,
+// impersonate is the user a service account acts as with domain-wide delegation,
+// sharedDriveID the shared drive to store files in instead of My Drive.
+func NewGDriveStorage(ctx context.Context, clientJSONFilepath string, localConfigPath string, basedir string, chunkSize int, impersonate string, sharedDriveID string, logger *log.Logger) (*GDrive, error) {
 	b, err := os.ReadFile(clientJSONFilepath)
 	if err != nil {
 		return nil, err
 	}
 
-	// If modifying these scopes, delete your previously saved client_secret.json.
-	config, err := google.ConfigFromJSON(b, drive.DriveScope, drive.DriveMetadataScope)
+	httpClient, err := getGDriveClient(ctx, b, localConfigPath, impersonate, logger)
 	if err != nil {
 		return nil, err
 	}
 
-	httpClient := getGDriveClient(ctx, config, localConfigPath, logger)
-
 	srv, err := drive.NewService(ctx, option.WithHTTPClient(httpClient))
 	if err != nil {
 		return nil, err
 	}
 
-	storage := &GDrive{service: srv, basedir: basedir, rootID: "", localConfigPath: localConfigPath, chunkSize: chunkSize, logger: logger}
-	err = storage.setupRoot()
+	storage := &GDrive{service: srv, basedir: basedir, rootID: "", localConfigPath: localConfigPath, chunkSize: chunkSize, sharedDriveID: sharedDriveID, logger: logger}
+	err = storage.setupRoot(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -63,7 +68,7 @@ func NewGDriveStorage(ctx context.Context, clientJSONFilepath string, localConfi
 	return storage, nil
 }
 
-func (s *GDrive) setupRoot() error {
+func (s *GDrive) setupRoot(ctx context.Context) error {
 	rootFileConfig := filepath.Join(s.localConfigPath, gDriveRootConfigFile)
 
 	rootID, err := os.ReadFile(rootFileConfig)
@@ -76,17 +81,36 @@ func (s *GDrive) setupRoot() error {
 		return nil
 	}
 
-	dir := &drive.File{
-		Name:     s.basedir,
-		MimeType: gDriveDirectoryMimeType,
+	parent := "root"
+	if s.sharedDriveID != "" {
+		parent = s.sharedDriveID
 	}
 
-	di, err := s.service.Files.Create(dir).Fields("id").Do()
-	if err != nil {
+	// reuse an existing basedir, the config path may not survive container restarts
+	q := fmt.Sprintf("'%s' in parents and name='%s' and mimeType='%s' and trashed=false", parent, escapeGDriveQuery(s.basedir), gDriveDirectoryMimeType)
+	err = s.listAll(ctx, q, func(fi *drive.File) error {
+		s.rootID = fi.Id
+		return errStopList
+	})
+	if err != nil && err != errStopList {
 		return err
 	}
 
-	s.rootID = di.Id
+	if s.rootID == "" {
+		dir := &drive.File{
+			Name:     s.basedir,
+			Parents:  []string{parent},
+			MimeType: gDriveDirectoryMimeType,
+		}
+
+		di, err := s.service.Files.Create(dir).Context(ctx).SupportsAllDrives(true).Fields("id").Do()
+		if err != nil {
+			return err
+		}
+
+		s.rootID = di.Id
+	}
+
 	err = os.WriteFile(rootFileConfig, []byte(s.rootID), os.FileMode(0600))
 	if err != nil {
 		return err
@@ -99,35 +123,43 @@ func (s *GDrive) hasChecksum(f *drive.File) bool {
 	return f.Md5Checksum != ""
 }
 
-func (s *GDrive) list(nextPageToken string, q string) (*drive.FileList, error) {
-	return s.service.Files.List().Fields("nextPageToken, files(id, name, mimeType)").Q(q).PageToken(nextPageToken).Do()
+// errStopList stops listAll early without failing
+var errStopList = errors.New("stop listing")
+
+// escapeGDriveQuery escapes a value for use in a quoted query string
+func escapeGDriveQuery(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	return strings.Replace(value, `'`, `\'`, -1)
 }
 
-func (s *GDrive) findID(filename string, token string) (string, error) {
-	filename = strings.Replace(filename, `'`, `\'`, -1)
-	filename = strings.Replace(filename, `"`, `\"`, -1)
+// findID returns the id of token/filename, or of the token folder when filename is empty.
+// Found ids are cached, a missing token folder is reported as an empty id.
+func (s *GDrive) findID(ctx context.Context, filename string, token string) (string, error) {
+	key := token
+	if filename != "" {
+		key = token + "/" + filename
+	}
 
-	fileID, tokenID, nextPageToken := "", "", ""
+	if id, ok := s.ids.Load(key); ok {
+		return id.(string), nil
+	}
 
-	q := fmt.Sprintf("'%s' in parents and name='%s' and mimeType='%s' and trashed=false", s.rootID, token, gDriveDirectoryMimeType)
-	l, err := s.list(nextPageToken, q)
-	if err != nil {
-		return "", err
+	tokenID, ok := "", false
+	if id, cached := s.ids.Load(token); cached {
+		tokenID, ok = id.(string), true
 	}
 
-	for 0 < len(l.Files) {
-		for _, fi := range l.Files {
+	if !ok {
+		q := fmt.Sprintf("'%s' in parents and name='%s' and mimeType='%s' and trashed=false", s.rootID, escapeGDriveQuery(token), gDriveDirectoryMimeType)
+		if err := s.listAll(ctx, q, func(fi *drive.File) error {
 			tokenID = fi.Id
-			break
+			return errStopList
+		}); err != nil && err != errStopList {
+			return "", err
 		}
 
-		if l.NextPageToken == "" {
-			break
-		}
-
-		l, err = s.list(l.NextPageToken, q)
-		if err != nil {
-			return "", err
+		if tokenID != "" {
+			s.ids.Store(token, tokenID)
 		}
 	}
 
@@ -137,33 +169,21 @@ func (s *GDrive) findID(filename string, token string) (string, error) {
 		return "", fmt.Errorf("cannot find file %s/%s", token, filename)
 	}
 
-	q = fmt.Sprintf("'%s' in parents and name='%s' and mimeType!='%s' and trashed=false", tokenID, filename, gDriveDirectoryMimeType)
-	l, err = s.list(nextPageToken, q)
-	if err != nil {
+	fileID := ""
+	q := fmt.Sprintf("'%s' in parents and name='%s' and mimeType!='%s' and trashed=false", tokenID, escapeGDriveQuery(filename), gDriveDirectoryMimeType)
+	if err := s.listAll(ctx, q, func(fi *drive.File) error {
+		fileID = fi.Id
+		return errStopList
+	}); err != nil && err != errStopList {
 		return "", err
 	}
 
-	for 0 < len(l.Files) {
-		for _, fi := range l.Files {
-
-			fileID = fi.Id
-			break
-		}
-
-		if l.NextPageToken == "" {
-			break
-		}
-
-		l, err = s.list(l.NextPageToken, q)
-		if err != nil {
-			return "", err
-		}
-	}
-
 	if fileID == "" {
 		return "", fmt.Errorf("cannot find file %s/%s", token, filename)
 	}
 
+	s.ids.Store(key, fileID)
+
 	return fileID, nil
 }
 
@@ -175,13 +195,14 @@ func (s *GDrive) Type() string {
 // Head retrieves content length of a file from storage
 func (s *GDrive) Head(ctx context.Context, token string, filename string) (contentLength uint64, err error) {
 	var fileID string
-	fileID, err = s.findID(filename, token)
+	fileID, err = s.findID(ctx, filename, token)
 	if err != nil {
 		return
 	}
 
 	var fi *drive.File
-	if fi, err = s.service.Files.Get(fileID).Context(ctx).Fields("size").Do(); err != nil {
+	if fi, err = s.service.Files.Get(fileID).Context(ctx).SupportsAllDrives(true).Fields("size").Do(); err != nil {
+		s.forgetID(err, token, filename)
 		return
 	}
 
@@ -193,14 +214,15 @@ func (s *GDrive) Head(ctx context.Context, token string, filename string) (conte
 // Get retrieves a file from storage
 func (s *GDrive) Get(ctx context.Context, token string, filename string, rng *Range) (reader io.ReadCloser, contentLength uint64, err error) {
 	var fileID string
-	fileID, err = s.findID(filename, token)
+	fileID, err = s.findID(ctx, filename, token)
 	if err != nil {
 		return
 	}
 
 	var fi *drive.File
-	fi, err = s.service.Files.Get(fileID).Fields("size", "md5Checksum").Do()
+	fi, err = s.service.Files.Get(fileID).Context(ctx).SupportsAllDrives(true).Fields("size", "md5Checksum").Do()
 	if err != nil {
+		s.forgetID(err, token, filename)
 		return
 	}
 	if !s.hasChecksum(fi) {
@@ -210,7 +232,7 @@ func (s *GDrive) Get(ctx context.Context, token string, filename string, rng *Ra
 
 	contentLength = uint64(fi.Size)
 
-	fileGetCall := s.service.Files.Get(fileID)
+	fileGetCall := s.service.Files.Get(fileID).SupportsAllDrives(true)
 	if rng != nil {
 		header := fileGetCall.Header()
 		header.Set("Range", rng.Range())
@@ -235,47 +257,93 @@ func (s *GDrive) Get(ctx context.Context, token string, filename string, rng *Ra
 
 // Delete removes a file from storage
 func (s *GDrive) Delete(ctx context.Context, token string, filename string) (err error) {
-	metadata, _ := s.findID(fmt.Sprintf("%s.metadata", filename), token)
-	_ = s.service.Files.Delete(metadata).Do()
+	metadataFilename := fmt.Sprintf("%s.metadata", filename)
+	if metadata, err := s.findID(ctx, metadataFilename, token); err == nil {
+		_ = s.service.Files.Delete(metadata).Context(ctx).SupportsAllDrives(true).Do()
+		s.ids.Delete(token + "/" + metadataFilename)
+	}
 
 	var fileID string
-	fileID, err = s.findID(filename, token)
+	fileID, err = s.findID(ctx, filename, token)
 	if err != nil {
 		return
 	}
 
-	err = s.service.Files.Delete(fileID).Context(ctx).Do()
+	err = s.service.Files.Delete(fileID).Context(ctx).SupportsAllDrives(true).Do()
+	s.ids.Delete(token + "/" + filename)
 	return
 }
 
-// Purge cleans up the storage
-func (s *GDrive) Purge(ctx context.Context, days time.Duration) (err error) {
-	nextPageToken := ""
+// forgetID drops the cached id of a file found missing, e.g. deleted outside transfer.sh
+func (s *GDrive) forgetID(err error, token string, filename string) {
+	if s.IsNotExist(err) {
+		s.ids.Delete(token + "/" + filename)
+	}
+}
 
-	expirationDate := time.Now().Add(-1 * days).Format(time.RFC3339)
-	q := fmt.Sprintf("'%s' in parents and modifiedTime < '%s' and mimeType!='%s' and trashed=false", s.rootID, expirationDate, gDriveDirectoryMimeType)
-	l, err := s.list(nextPageToken, q)
-	if err != nil {
-		return err
+// List calls fn for every file stored under token, or for every stored file when token is empty
+func (s *GDrive) List(ctx context.Context, token string, fn func(token string, filename string) error) error {
+	q := fmt.Sprintf("'%s' in parents and mimeType='%s' and trashed=false", s.rootID, gDriveDirectoryMimeType)
+	if token != "" {
+		q = fmt.Sprintf("%s and name='%s'", q, escapeGDriveQuery(token))
 	}
 
-	for 0 < len(l.Files) {
+	return s.listAll(ctx, q, func(dir *drive.File) error {
+		q := fmt.Sprintf("'%s' in parents and mimeType!='%s' and trashed=false", dir.Id, gDriveDirectoryMimeType)
+
+		return s.listAll(ctx, q, func(fi *drive.File) error {
+			if token, filename, ok := splitKey(dir.Name + "/" + fi.Name); ok {
+				return fn(token, filename)
+			}
+
+			return nil
+		})
+	})
+}
+
+// listAll calls fn for every file matching q, paging through the results
+func (s *GDrive) listAll(ctx context.Context, q string, fn func(*drive.File) error) error {
+	nextPageToken := ""
+
+	for {
+		call := s.service.Files.List().Context(ctx).Fields("nextPageToken, files(id, name, mimeType)").Q(q).PageToken(nextPageToken)
+		if s.sharedDriveID != "" {
+			call = call.Corpora("drive").DriveId(s.sharedDriveID).IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+		}
+
+		l, err := call.Do()
+		if err != nil {
+			return err
+		}
+
 		for _, fi := range l.Files {
-			err = s.service.Files.Delete(fi.Id).Context(ctx).Do()
-			if err != nil {
-				return
+			if err := fn(fi); err != nil {
+				return err
 			}
 		}
 
 		if l.NextPageToken == "" {
-			break
+			return nil
 		}
 
-		l, err = s.list(l.NextPageToken, q)
-		if err != nil {
-			return
-		}
+		nextPageToken = l.NextPageToken
 	}
+}
+
+// Purge cleans up the storage
+func (s *GDrive) Purge(ctx context.Context, days time.Duration) (err error) {
+	expirationDate := time.Now().Add(-1 * days).Format(time.RFC3339)
+	q := fmt.Sprintf("'%s' in parents and modifiedTime < '%s' and mimeType!='%s' and trashed=false", s.rootID, expirationDate, gDriveDirectoryMimeType)
+
+	err = s.listAll(ctx, q, func(fi *drive.File) error {
+		return s.service.Files.Delete(fi.Id).Context(ctx).SupportsAllDrives(true).Do()
+	})
+
+	// ids of purged files are unknown here, start over
+	s.ids.Range(func(key, _ interface{}) bool {
+		s.ids.Delete(key)
+		return true
+	})
 
 	return
 }
@@ -295,7 +363,7 @@ func (s *GDrive) IsNotExist(err error) bool {
 
 // Put saves a file on storage
 func (s *GDrive) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
-	dirID, err := s.findID("", token)
+	dirID, err := s.findID(ctx, "", token)
 	if err != nil {
 		return err
 	}
@@ -307,12 +375,13 @@ func (s *GDrive) Put(ctx context.Context, token string, filename string, reader
 			MimeType: gDriveDirectoryMimeType,
 		}
 
-		di, err := s.service.Files.Create(dir).Fields("id").Do()
+		di, err := s.service.Files.Create(dir).Context(ctx).SupportsAllDrives(true).Fields("id").Do()
 		if err != nil {
 			return err
 		}
 
 		dirID = di.Id
+		s.ids.Store(token, dirID)
 	}
 
 	// Instantiate empty drive file
@@ -322,45 +391,90 @@ func (s *GDrive) Put(ctx context.Context, token string, filename string, reader
 		MimeType: contentType,
 	}
 
-	_, err = s.service.Files.Create(dst).Context(ctx).Media(reader, googleapi.ChunkSize(s.chunkSize)).Do()
+	fi, err := s.service.Files.Create(dst).Context(ctx).SupportsAllDrives(true).Fields("id").Media(reader, googleapi.ChunkSize(s.chunkSize)).Do()
+	if s.IsNotExist(err) {
+		// the token folder was removed outside transfer.sh
+		s.ids.Delete(token)
+	}
 
 	if err != nil {
 		return err
 	}
 
+	s.ids.Store(token+"/"+filename, fi.Id)
+
 	return nil
 }
 
 func (s *GDrive) IsRangeSupported() bool { return true }
 
-// Retrieve a token, saves the token, then returns the generated client.
-func getGDriveClient(ctx context.Context, config *oauth2.Config, localConfigPath string, logger *log.Logger) *http.Client {
+// getGDriveClient returns a client authenticated with a service account key or,
+// for OAuth client credentials, with the token saved by a previous interactive setup
+func getGDriveClient(ctx context.Context, credentials []byte, localConfigPath string, impersonate string, logger *log.Logger) (*http.Client, error) {
+	var key struct {
+		Type string `json:"type"`
+	}
+
+	if err := json.Unmarshal(credentials, &key); err != nil {
+		return nil, err
+	}
+
+	if key.Type == "service_account" {
+		config, err := google.JWTConfigFromJSON(credentials, drive.DriveScope)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Subject = impersonate
+
+		return config.Client(ctx), nil
+	} else if impersonate != "" {
+		return nil, errors.New("impersonation requires a service account key")
+	}
+
+	// If modifying these scopes, delete your previously saved client_secret.json.
+	config, err := google.ConfigFromJSON(credentials, drive.DriveScope, drive.DriveMetadataScope)
+	if err != nil {
+		return nil, err
+	}
+
 	tokenFile := filepath.Join(localConfigPath, gDriveTokenJSONFile)
 	tok, err := gDriveTokenFromFile(tokenFile)
 	if err != nil {
-		tok = getGDriveTokenFromWeb(ctx, config, logger)
-		saveGDriveToken(tokenFile, tok, logger)
+		if tok, err = getGDriveTokenFromWeb(ctx, config); err != nil {
+			return nil, err
+		}
+
+		if err = saveGDriveToken(tokenFile, tok, logger); err != nil {
+			return nil, err
+		}
 	}
 
-	return config.Client(ctx, tok)
+	return config.Client(ctx, tok), nil
 }
 
 // Request a token from the web, then returns the retrieved token.
-func getGDriveTokenFromWeb(ctx context.Context, config *oauth2.Config, logger *log.Logger) *oauth2.Token {
+// Fails when there is no terminal to complete the flow on.
+func getGDriveTokenFromWeb(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil, fmt.Errorf("no saved gdrive token in %s and no terminal to authorize interactively, use a service account key instead", gDriveTokenJSONFile)
+	}
+
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
 	fmt.Printf("Go to the following link in your browser then type the "+
 		"authorization code: \n%v\n", authURL)
 
 	var authCode string
 	if _, err := fmt.Scan(&authCode); err != nil {
-		logger.Fatalf("Unable to read authorization code %v", err)
+		return nil, fmt.Errorf("unable to read authorization code: %w", err)
 	}
 
 	tok, err := config.Exchange(ctx, authCode)
 	if err != nil {
-		logger.Fatalf("Unable to retrieve token from web %v", err)
+		return nil, fmt.Errorf("unable to retrieve token from web: %w", err)
 	}
-	return tok
+
+	return tok, nil
 }
 
 // Retrieves a token from a local file.
@@ -376,16 +490,17 @@ func gDriveTokenFromFile(file string) (*oauth2.Token, error) {
 }
 
 // Saves a token to a file path.
-func saveGDriveToken(path string, token *oauth2.Token, logger *log.Logger) {
+func saveGDriveToken(path string, token *oauth2.Token, logger *log.Logger) error {
 	logger.Printf("Saving credential file to: %s\n", path)
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	defer CloseCheck(f)
 	if err != nil {
-		logger.Fatalf("Unable to cache oauth token: %v", err)
+		return fmt.Errorf("unable to cache oauth token: %w", err)
 	}
 
-	err = json.NewEncoder(f).Encode(token)
-	if err != nil {
-		logger.Fatalf("Unable to encode oauth token: %v", err)
+	if err = json.NewEncoder(f).Encode(token); err != nil {
+		return fmt.Errorf("unable to encode oauth token: %w", err)
 	}
+
+	return nil
 }
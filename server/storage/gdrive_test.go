@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+func TestGDriveClientCredentials(t *testing.T) {
+	ctx := context.Background()
+	logger := log.New(io.Discard, "", 0)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serviceAccount, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "transfer@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    "https://oauth2.googleapis.com/token",
+	})
+
+	if _, err = getGDriveClient(ctx, serviceAccount, t.TempDir(), "user@example.com", logger); err != nil {
+		t.Errorf("service account with impersonation: %v", err)
+	}
+
+	oauthClient := []byte(`{"installed":{"client_id":"id","client_secret":"secret","auth_uri":"https://accounts.google.com/o/oauth2/auth","token_uri":"https://oauth2.googleapis.com/token","redirect_uris":["urn:ietf:wg:oauth:2.0:oob"]}}`)
+
+	if _, err = getGDriveClient(ctx, oauthClient, t.TempDir(), "user@example.com", logger); err == nil {
+		t.Error("impersonation accepted with OAuth client credentials")
+	}
+
+	configPath := t.TempDir()
+	if err = os.WriteFile(filepath.Join(configPath, gDriveTokenJSONFile), []byte(`{"access_token":"token","token_type":"Bearer"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = getGDriveClient(ctx, oauthClient, configPath, "", logger); err != nil {
+		t.Errorf("OAuth client with saved token: %v", err)
+	}
+}
+
+func TestGDriveFindIDCached(t *testing.T) {
+	var lists int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lists++
+
+		id := "file-id"
+		if strings.Contains(r.URL.Query().Get("q"), "mimeType='"+gDriveDirectoryMimeType+"'") {
+			id = "token-id"
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"files": []map[string]string{{"id": id}}})
+	}))
+	defer server.Close()
+
+	service, err := drive.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &GDrive{service: service, rootID: "root-id", logger: log.New(io.Discard, "", 0)}
+
+	for i := 0; i < 3; i++ {
+		if id, err := s.findID(context.Background(), "hello.txt", "token"); err != nil || id != "file-id" {
+			t.Fatalf("findID = %q, %v, want %q", id, err, "file-id")
+		}
+	}
+
+	if id, err := s.findID(context.Background(), "", "token"); err != nil || id != "token-id" {
+		t.Errorf("findID of token = %q, %v, want %q", id, err, "token-id")
+	}
+
+	if lists != 2 {
+		t.Errorf("%d list requests, want 2", lists)
+	}
+}
@@ -7,6 +7,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,11 +19,34 @@ type LocalStorage struct {
 	Storage
 	basedir string
 	logger  *log.Logger
+
+	// maxSize is the maximum number of bytes stored in basedir, 0 for unlimited
+	maxSize uint64
+	// minFree is the number of bytes to keep free on the basedir filesystem
+	minFree uint64
+	// highWatermark and lowWatermark are the usage percentages for eviction
+	highWatermark int
+	lowWatermark  int
+
+	usageMutex sync.Mutex
+	usageKnown bool
+	used       uint64
 }
 
 // NewLocalStorage is the factory for LocalStorage
-func NewLocalStorage(basedir string, logger *log.Logger) (*LocalStorage, error) {
-	return &LocalStorage{basedir: basedir, logger: logger}, nil
+func NewLocalStorage(basedir string, maxSize, minFree uint64, highWatermark, lowWatermark int, logger *log.Logger) (*LocalStorage, error) {
+	if lowWatermark <= 0 || lowWatermark > highWatermark {
+		lowWatermark = highWatermark
+	}
+
+	return &LocalStorage{
+		basedir:       basedir,
+		logger:        logger,
+		maxSize:       maxSize,
+		minFree:       minFree,
+		highWatermark: highWatermark,
+		lowWatermark:  lowWatermark,
+	}, nil
 }
 
 // Type returns the storage type
@@ -71,11 +98,15 @@ func (s *LocalStorage) Get(_ context.Context, token string, filename string, rng
 
 // Delete removes a file from storage
 func (s *LocalStorage) Delete(_ context.Context, token string, filename string) (err error) {
+	path := filepath.Join(s.basedir, token, filename)
+	if s.held(path) {
+		return ErrLegalHold
+	}
+
 	metadata := filepath.Join(s.basedir, token, fmt.Sprintf("%s.metadata", filename))
-	_ = os.Remove(metadata)
+	_ = s.remove(metadata)
 
-	path := filepath.Join(s.basedir, token, filename)
-	err = os.Remove(path)
+	err = s.remove(path)
 	return
 }
 
@@ -86,12 +117,12 @@ func (s *LocalStorage) Purge(_ context.Context, days time.Duration) (err error)
 			if err != nil {
 				return err
 			}
-			if info.IsDir() {
+			if info.IsDir() || s.held(path) || s.held(strings.TrimSuffix(path, ".metadata")) {
 				return nil
 			}
 
 			if info.ModTime().Before(time.Now().Add(-1 * days)) {
-				err = os.Remove(path)
+				err = s.remove(path)
 				return err
 			}
 
@@ -101,6 +132,268 @@ func (s *LocalStorage) Purge(_ context.Context, days time.Duration) (err error)
 	return
 }
 
+// CheckQuota returns ErrInsufficientStorage if contentLength more bytes cannot be stored
+func (s *LocalStorage) CheckQuota(_ context.Context, contentLength uint64) error {
+	if s.maxSize > 0 {
+		used, err := s.usage()
+		if err != nil {
+			return err
+		}
+
+		if used+contentLength > s.maxSize {
+			return ErrInsufficientStorage
+		}
+	}
+
+	if s.minFree > 0 {
+		_, free, err := DiskUsage(s.basedir)
+		if err != nil {
+			return err
+		}
+
+		if free < contentLength+s.minFree {
+			return ErrInsufficientStorage
+		}
+	}
+
+	return nil
+}
+
+// Evict removes the oldest files once usage crossed the high-water mark,
+// until it drops below the low-water mark. Usage is relative to the quota
+// when one is set, otherwise to the capacity of the basedir filesystem.
+func (s *LocalStorage) Evict(_ context.Context) error {
+	if s.highWatermark <= 0 {
+		return nil
+	}
+
+	var capacity, used uint64
+	if s.maxSize > 0 {
+		var err error
+		if used, err = s.usage(); err != nil {
+			return err
+		}
+
+		capacity = s.maxSize
+	} else {
+		total, free, err := DiskUsage(s.basedir)
+		if err != nil {
+			return err
+		}
+
+		capacity, used = total, total-free
+	}
+
+	if used*100 < capacity*uint64(s.highWatermark) {
+		return nil
+	}
+
+	type candidate struct {
+		path    string
+		modTime time.Time
+	}
+
+	var candidates []candidate
+	err := filepath.Walk(s.basedir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || strings.HasSuffix(path, ".metadata") || s.held(path) {
+			return nil
+		}
+
+		candidates = append(candidates, candidate{path: path, modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].modTime.Before(candidates[j].modTime)
+	})
+
+	target := capacity * uint64(s.lowWatermark) / 100
+	for _, c := range candidates {
+		if used <= target {
+			break
+		}
+
+		for _, path := range []string{fmt.Sprintf("%s.metadata", c.path), c.path} {
+			fi, err := os.Lstat(path)
+			if err != nil {
+				continue
+			}
+
+			if err = s.remove(path); err != nil {
+				return err
+			}
+
+			if uint64(fi.Size()) > used {
+				used = 0
+			} else {
+				used -= uint64(fi.Size())
+			}
+		}
+
+		// the previous versions of the file go with it, unless held
+		for _, path := range versionPaths(c.path) {
+			fi, err := os.Lstat(path)
+			if err != nil || s.held(path) {
+				continue
+			}
+
+			if err = s.remove(path); err != nil {
+				return err
+			}
+
+			if uint64(fi.Size()) > used {
+				used = 0
+			} else {
+				used -= uint64(fi.Size())
+			}
+		}
+
+		s.logger.Printf("Evicted %s to free space", c.path)
+	}
+
+	return nil
+}
+
+// versionPaths returns the paths of the previous versions the server keeps of the file at
+// path, named after it as file.vN.metadata.metadata
+func versionPaths(path string) []string {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+
+	version := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(path)) + `\.v[0-9]+\.metadata\.metadata$`)
+
+	var paths []string
+	for _, entry := range entries {
+		if version.MatchString(entry.Name()) {
+			paths = append(paths, filepath.Join(filepath.Dir(path), entry.Name()))
+		}
+	}
+
+	return paths
+}
+
+// usage returns the number of bytes stored in basedir, walking it on first use
+func (s *LocalStorage) usage() (uint64, error) {
+	s.usageMutex.Lock()
+	defer s.usageMutex.Unlock()
+
+	if s.usageKnown {
+		return s.used, nil
+	}
+
+	var used uint64
+	err := filepath.Walk(s.basedir, func(_ string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			used += uint64(info.Size())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.used = used
+	s.usageKnown = true
+
+	return s.used, nil
+}
+
+// adjustUsage applies delta to the tracked usage, if already computed
+func (s *LocalStorage) adjustUsage(delta int64) {
+	s.usageMutex.Lock()
+	defer s.usageMutex.Unlock()
+
+	if !s.usageKnown {
+		return
+	}
+
+	if delta < 0 && uint64(-delta) > s.used {
+		s.used = 0
+		return
+	}
+
+	s.used = uint64(int64(s.used) + delta)
+}
+
+// remove deletes path while keeping track of the usage
+func (s *LocalStorage) remove(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(path); err != nil {
+		return err
+	}
+
+	s.adjustUsage(-fi.Size())
+
+	return nil
+}
+
+// SetLegalHold places a legal hold on a file by making it read-only, or releases it
+func (s *LocalStorage) SetLegalHold(_ context.Context, token string, filename string, hold bool) error {
+	mode := os.FileMode(0600)
+	if hold {
+		mode = 0400
+	}
+
+	return os.Chmod(filepath.Join(s.basedir, token, filename), mode)
+}
+
+// held indicates if the file at path is under legal hold
+func (s *LocalStorage) held(path string) bool {
+	fi, err := os.Lstat(path)
+	return err == nil && heldMode(fi.Mode())
+}
+
+// heldMode indicates if a file mode is the one of files under legal hold
+func heldMode(mode os.FileMode) bool {
+	return mode.IsRegular() && mode.Perm()&0200 == 0
+}
+
+// List calls fn for every file stored under token, or for every stored file when token is empty
+func (s *LocalStorage) List(_ context.Context, token string, fn func(token string, filename string) error) error {
+	root := filepath.Join(s.basedir, token)
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		key, err := filepath.Rel(s.basedir, path)
+		if err != nil {
+			return err
+		}
+
+		if token, filename, ok := splitKey(filepath.ToSlash(key)); ok {
+			return fn(token, filename)
+		}
+
+		return nil
+	})
+}
+
 // IsNotExist indicates if a file doesn't exist on storage
 func (s *LocalStorage) IsNotExist(err error) bool {
 	if err == nil {
@@ -121,6 +414,15 @@ func (s *LocalStorage) Put(_ context.Context, token string, filename string, rea
 		return err
 	}
 
+	var previousSize int64
+	if fi, err := os.Lstat(filepath.Join(path, filename)); err == nil {
+		if heldMode(fi.Mode()) {
+			return ErrLegalHold
+		}
+
+		previousSize = fi.Size()
+	}
+
 	f, err = os.OpenFile(filepath.Join(path, filename), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	defer CloseCheck(f)
 
@@ -128,7 +430,10 @@ func (s *LocalStorage) Put(_ context.Context, token string, filename string, rea
 		return err
 	}
 
-	if _, err = io.Copy(f, reader); err != nil {
+	n, err := io.Copy(f, reader)
+	s.adjustUsage(n - previousSize)
+
+	if err != nil {
 		return err
 	}
 
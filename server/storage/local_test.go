@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func putLocal(t *testing.T, s *LocalStorage, token, filename string, size int) {
+	if err := s.Put(context.Background(), token, filename, strings.NewReader(strings.Repeat("x", size)), "text/plain", uint64(size)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalStorageQuota(t *testing.T) {
+	s, err := NewLocalStorage(t.TempDir(), 100, 0, 0, 0, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putLocal(t, s, "token", "a", 60)
+
+	if err = s.CheckQuota(context.Background(), 40); err != nil {
+		t.Errorf("CheckQuota(40) = %v, want nil", err)
+	}
+
+	if err = s.CheckQuota(context.Background(), 41); err != ErrInsufficientStorage {
+		t.Errorf("CheckQuota(41) = %v, want %v", err, ErrInsufficientStorage)
+	}
+
+	if err = s.Delete(context.Background(), "token", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.CheckQuota(context.Background(), 100); err != nil {
+		t.Errorf("CheckQuota(100) after delete = %v, want nil", err)
+	}
+}
+
+func TestLocalStorageEvict(t *testing.T) {
+	basedir := t.TempDir()
+
+	s, err := NewLocalStorage(basedir, 100, 0, 80, 50, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putLocal(t, s, "token", "old", 40)
+	putLocal(t, s, "token", "new", 40)
+
+	old := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(filepath.Join(basedir, "token", "old"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Evict(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Head(context.Background(), "token", "old"); !os.IsNotExist(err) {
+		t.Errorf("oldest file not evicted: %v", err)
+	}
+
+	if _, err = s.Head(context.Background(), "token", "new"); err != nil {
+		t.Errorf("newest file evicted: %v", err)
+	}
+}
+
+func TestLocalStorageVersionsFollowTheirFile(t *testing.T) {
+	basedir := t.TempDir()
+
+	s, err := NewLocalStorage(basedir, 100, 0, 80, 50, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putLocal(t, s, "token", "old", 30)
+	putLocal(t, s, "token", "old.v1.metadata.metadata", 30)
+	putLocal(t, s, "token", "new", 30)
+
+	old := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(filepath.Join(basedir, "token", "old"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Evict(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{"old", "old.v1.metadata.metadata"} {
+		if _, err = s.Head(context.Background(), "token", filename); !os.IsNotExist(err) {
+			t.Errorf("%s not evicted with its file: %v", filename, err)
+		}
+	}
+
+	putLocal(t, s, "token", "new.v1.metadata.metadata", 10)
+	if err = s.SetLegalHold(context.Background(), "token", "new.v1.metadata.metadata", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Purge(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Head(context.Background(), "token", "new.v1.metadata.metadata"); err != nil {
+		t.Errorf("held version purged: %v", err)
+	}
+
+	if _, err = s.Head(context.Background(), "token", "new"); !os.IsNotExist(err) {
+		t.Errorf("file not purged: %v", err)
+	}
+}
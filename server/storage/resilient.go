@@ -0,0 +1,590 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// ErrUnavailable is returned without reaching the backend while the circuit breaker is open
+var ErrUnavailable = errors.New("storage unavailable")
+
+// ErrTimeout is returned when a storage operation exceeded its deadline
+var ErrTimeout = errors.New("storage operation timed out")
+
+// Unwrapper is implemented by storages wrapping another storage
+type Unwrapper interface {
+	// Unwrap returns the wrapped storage
+	Unwrap() Storage
+}
+
+// HealthReporter is implemented by storages tracking the health of their backend
+type HealthReporter interface {
+	// Available indicates if the backend is currently considered healthy
+	Available() bool
+}
+
+// Capability returns s as T if the innermost wrapped storage implements T.
+// The outermost storage is returned, so the behaviour of wrappers still applies.
+func Capability[T any](s Storage) (T, bool) {
+	var zero T
+
+	inner := s
+	for {
+		unwrapper, ok := inner.(Unwrapper)
+		if !ok {
+			break
+		}
+
+		inner = unwrapper.Unwrap()
+	}
+
+	if _, ok := inner.(T); !ok {
+		return zero, false
+	}
+
+	t, ok := s.(T)
+	return t, ok
+}
+
+// ResilientStorage wraps a storage with per-operation deadlines, retries with
+// exponential backoff for idempotent operations and a circuit breaker
+type ResilientStorage struct {
+	inner   Storage
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	breaker *circuitBreaker
+	logger  *log.Logger
+}
+
+// NewResilientStorage is the factory for ResilientStorage.
+// A zero timeout, retries or breakerThreshold disables the respective feature.
+func NewResilientStorage(inner Storage, timeout time.Duration, retries int, backoff time.Duration, breakerThreshold int, breakerCooldown time.Duration, logger *log.Logger) *ResilientStorage {
+	return &ResilientStorage{
+		inner:   inner,
+		timeout: timeout,
+		retries: retries,
+		backoff: backoff,
+		breaker: &circuitBreaker{threshold: breakerThreshold, cooldown: breakerCooldown, logger: logger},
+		logger:  logger,
+	}
+}
+
+// Unwrap returns the wrapped storage
+func (s *ResilientStorage) Unwrap() Storage {
+	return s.inner
+}
+
+// Available indicates if the circuit breaker lets requests reach the backend
+func (s *ResilientStorage) Available() bool {
+	return s.breaker.available()
+}
+
+// Type returns the storage type
+func (s *ResilientStorage) Type() string {
+	return s.inner.Type()
+}
+
+// IsNotExist indicates if a file doesn't exist on storage
+func (s *ResilientStorage) IsNotExist(err error) bool {
+	return s.inner.IsNotExist(err)
+}
+
+// IsRangeSupported indicates if the wrapped storage supports Get with Range header
+func (s *ResilientStorage) IsRangeSupported() bool {
+	return s.inner.IsRangeSupported()
+}
+
+// Head retrieves content length of a file from storage
+func (s *ResilientStorage) Head(ctx context.Context, token string, filename string) (contentLength uint64, err error) {
+	err = s.do(ctx, true, func(ctx context.Context) (err error) {
+		contentLength, err = s.inner.Head(ctx, token, filename)
+		return
+	})
+
+	return
+}
+
+// Get retrieves a file from storage. The deadline applies to the backend
+// responding and to every read of the content, not to the whole transfer.
+func (s *ResilientStorage) Get(ctx context.Context, token string, filename string, rng *Range) (reader io.ReadCloser, contentLength uint64, err error) {
+	err = s.retry(ctx, true, func() error {
+		ctx, cancel := context.WithCancelCause(ctx)
+		watchdog := newWatchdog(s.timeout, cancel)
+
+		watchdog.start()
+		r, n, err := s.inner.Get(ctx, token, filename, rng)
+		watchdog.stop()
+
+		if err != nil {
+			cancel(nil)
+			return s.timeoutError(ctx, err)
+		}
+
+		reader = &watchdogReader{reader: r, watchdog: watchdog, cancel: cancel}
+		contentLength = n
+		return nil
+	})
+
+	return
+}
+
+// Put saves a file on storage. The deadline applies to the backend being idle
+// between reads of the content, so slow clients don't trip it. Put is only
+// retried when the reader can be rewound.
+func (s *ResilientStorage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
+	return s.put(ctx, reader, func(ctx context.Context, reader io.Reader) error {
+		return s.inner.Put(ctx, token, filename, reader, contentType, contentLength)
+	})
+}
+
+// PutWithMetadata saves a file on storage along with its metadata
+func (s *ResilientStorage) PutWithMetadata(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64, metadata map[string]string) error {
+	inner, ok := s.inner.(MetadataStorage)
+	if !ok {
+		return errors.New("metadata not supported")
+	}
+
+	return s.put(ctx, reader, func(ctx context.Context, reader io.Reader) error {
+		return inner.PutWithMetadata(ctx, token, filename, reader, contentType, contentLength, metadata)
+	})
+}
+
+// GetMetadata retrieves the metadata stored on a file
+func (s *ResilientStorage) GetMetadata(ctx context.Context, token string, filename string) (metadata map[string]string, err error) {
+	inner, ok := s.inner.(MetadataStorage)
+	if !ok {
+		return nil, errors.New("metadata not supported")
+	}
+
+	err = s.do(ctx, true, func(ctx context.Context) (err error) {
+		metadata, err = inner.GetMetadata(ctx, token, filename)
+		return
+	})
+
+	return
+}
+
+// UpdateMetadata replaces the metadata stored on a file, leaving its content untouched
+func (s *ResilientStorage) UpdateMetadata(ctx context.Context, token string, filename string, metadata map[string]string) error {
+	inner, ok := s.inner.(MetadataStorage)
+	if !ok {
+		return errors.New("metadata not supported")
+	}
+
+	return s.do(ctx, true, func(ctx context.Context) error {
+		return inner.UpdateMetadata(ctx, token, filename, metadata)
+	})
+}
+
+// Delete removes a file from storage
+func (s *ResilientStorage) Delete(ctx context.Context, token string, filename string) error {
+	return s.do(ctx, true, func(ctx context.Context) error {
+		return s.inner.Delete(ctx, token, filename)
+	})
+}
+
+// Purge cleans up the storage, without deadline as it walks the whole storage
+func (s *ResilientStorage) Purge(ctx context.Context, days time.Duration) error {
+	return s.inner.Purge(ctx, days)
+}
+
+// List calls fn for every file stored under token, or for every stored file when token is empty
+func (s *ResilientStorage) List(ctx context.Context, token string, fn func(token string, filename string) error) error {
+	inner, ok := s.inner.(Lister)
+	if !ok {
+		return errors.New("listing not supported")
+	}
+
+	return inner.List(ctx, token, fn)
+}
+
+// CheckQuota returns ErrInsufficientStorage if contentLength more bytes cannot be stored
+func (s *ResilientStorage) CheckQuota(ctx context.Context, contentLength uint64) error {
+	inner, ok := s.inner.(QuotaChecker)
+	if !ok {
+		return nil
+	}
+
+	return inner.CheckQuota(ctx, contentLength)
+}
+
+// Evict removes the oldest files once usage crossed the configured high-water mark
+func (s *ResilientStorage) Evict(ctx context.Context) error {
+	inner, ok := s.inner.(Evicter)
+	if !ok {
+		return nil
+	}
+
+	return inner.Evict(ctx)
+}
+
+// SetLegalHold places a legal hold on a file, or releases it
+func (s *ResilientStorage) SetLegalHold(ctx context.Context, token string, filename string, hold bool) error {
+	inner, ok := s.inner.(LegalHolder)
+	if !ok {
+		return errors.New("legal holds not supported")
+	}
+
+	return s.do(ctx, true, func(ctx context.Context) error {
+		return inner.SetLegalHold(ctx, token, filename, hold)
+	})
+}
+
+// PresignGet returns a URL, valid for expiry, downloading a file directly from the backend
+func (s *ResilientStorage) PresignGet(ctx context.Context, token string, filename string, contentType string, contentDisposition string, expiry time.Duration) (url string, err error) {
+	inner, ok := s.inner.(Presigner)
+	if !ok {
+		return "", errors.New("presigning not supported")
+	}
+
+	err = s.do(ctx, true, func(ctx context.Context) (err error) {
+		url, err = inner.PresignGet(ctx, token, filename, contentType, contentDisposition, expiry)
+		return
+	})
+
+	return
+}
+
+// InitiateMultipart starts a multipart upload of a file, returning the upload id
+func (s *ResilientStorage) InitiateMultipart(ctx context.Context, token string, filename string, contentType string, metadata map[string]string) (uploadID string, err error) {
+	inner, ok := s.inner.(MultipartUploader)
+	if !ok {
+		return "", errors.New("multipart uploads not supported")
+	}
+
+	err = s.do(ctx, false, func(ctx context.Context) (err error) {
+		uploadID, err = inner.InitiateMultipart(ctx, token, filename, contentType, metadata)
+		return
+	})
+
+	return
+}
+
+// PutPart saves a part of a multipart upload, returning its ETag
+func (s *ResilientStorage) PutPart(ctx context.Context, token string, filename string, uploadID string, number int, reader io.ReadSeeker, contentLength uint64) (etag string, err error) {
+	inner, ok := s.inner.(MultipartUploader)
+	if !ok {
+		return "", errors.New("multipart uploads not supported")
+	}
+
+	err = s.put(ctx, reader, func(ctx context.Context, reader io.Reader) (err error) {
+		etag, err = inner.PutPart(ctx, token, filename, uploadID, number, reader.(io.ReadSeeker), contentLength)
+		return
+	})
+
+	return
+}
+
+// CompleteMultipart assembles the file from the given parts
+func (s *ResilientStorage) CompleteMultipart(ctx context.Context, token string, filename string, uploadID string, parts []Part) error {
+	inner, ok := s.inner.(MultipartUploader)
+	if !ok {
+		return errors.New("multipart uploads not supported")
+	}
+
+	return s.do(ctx, false, func(ctx context.Context) error {
+		return inner.CompleteMultipart(ctx, token, filename, uploadID, parts)
+	})
+}
+
+// AbortMultipart discards a multipart upload and its parts
+func (s *ResilientStorage) AbortMultipart(ctx context.Context, token string, filename string, uploadID string) error {
+	inner, ok := s.inner.(MultipartUploader)
+	if !ok {
+		return errors.New("multipart uploads not supported")
+	}
+
+	return s.do(ctx, true, func(ctx context.Context) error {
+		return inner.AbortMultipart(ctx, token, filename, uploadID)
+	})
+}
+
+// put runs an upload under the idle watchdog, retrying when the reader can be rewound
+func (s *ResilientStorage) put(ctx context.Context, reader io.Reader, upload func(ctx context.Context, reader io.Reader) error) error {
+	seeker, retryable := reader.(io.Seeker)
+
+	var offset int64
+	if retryable {
+		var err error
+		if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			retryable = false
+		}
+	}
+
+	first := true
+	return s.retry(ctx, retryable, func() error {
+		if !first {
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+
+		watchdog := newWatchdog(s.timeout, cancel)
+		watchdog.start()
+		defer watchdog.stop()
+
+		var idle io.Reader = &idleReader{reader: reader, watchdog: watchdog}
+		if retryable {
+			idle = &idleReadSeeker{idleReader: idle.(*idleReader), seeker: seeker}
+		}
+
+		err := upload(ctx, idle)
+		return s.timeoutError(ctx, err)
+	})
+}
+
+// do runs op with the per-operation deadline, retrying it if idempotent
+func (s *ResilientStorage) do(ctx context.Context, idempotent bool, op func(ctx context.Context) error) error {
+	return s.retry(ctx, idempotent, func() error {
+		if s.timeout <= 0 {
+			return op(ctx)
+		}
+
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+
+		timer := time.AfterFunc(s.timeout, func() { cancel(ErrTimeout) })
+		defer timer.Stop()
+
+		return s.timeoutError(ctx, op(ctx))
+	})
+}
+
+// retry runs attempt through the circuit breaker, with exponential backoff between retries
+func (s *ResilientStorage) retry(ctx context.Context, retryable bool, attempt func() error) error {
+	attempts := 1
+	if retryable {
+		attempts += s.retries
+	}
+
+	for i := 0; ; i++ {
+		if err := s.breaker.allow(); err != nil {
+			return err
+		}
+
+		err := attempt()
+		failure := err != nil && ctx.Err() == nil && isTransient(err)
+		s.breaker.record(failure)
+
+		if !failure || i+1 >= attempts {
+			return err
+		}
+
+		delay := s.backoff << i
+		if delay > 0 {
+			delay += time.Duration(rand.Int63n(int64(delay)))
+		}
+
+		s.logger.Printf("Storage %s operation failed, retrying in %s: %s", s.inner.Type(), delay, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// statusCoder is implemented by the errors of backends answering with an HTTP status
+type statusCoder interface {
+	HTTPStatusCode() int
+}
+
+// isTransient indicates if an operation failed on a timeout, a network error or a server
+// error of the backend. Other errors, like a missing file, a legal hold or a denied access,
+// are returned without retrying and do not count as failures of the backend.
+func isTransient(err error) bool {
+	if errors.Is(err, ErrTimeout) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var statusErr statusCoder
+	if errors.As(err, &statusErr) {
+		return statusErr.HTTPStatusCode() >= http.StatusInternalServerError
+	}
+
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code >= http.StatusInternalServerError
+	}
+
+	return false
+}
+
+// timeoutError replaces the error of an operation canceled by its deadline with ErrTimeout
+func (s *ResilientStorage) timeoutError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(context.Cause(ctx), ErrTimeout) {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+
+	return err
+}
+
+// watchdog cancels an operation when it has been running for longer than timeout
+type watchdog struct {
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newWatchdog(timeout time.Duration, cancel context.CancelCauseFunc) *watchdog {
+	if timeout <= 0 {
+		return &watchdog{}
+	}
+
+	timer := time.AfterFunc(timeout, func() { cancel(ErrTimeout) })
+	timer.Stop()
+
+	return &watchdog{timer: timer, timeout: timeout}
+}
+
+func (w *watchdog) start() {
+	if w.timer != nil {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+func (w *watchdog) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// watchdogReader arms the watchdog while the backend is delivering content
+type watchdogReader struct {
+	reader   io.ReadCloser
+	watchdog *watchdog
+	cancel   context.CancelCauseFunc
+}
+
+func (r *watchdogReader) Read(p []byte) (int, error) {
+	r.watchdog.start()
+	n, err := r.reader.Read(p)
+	r.watchdog.stop()
+
+	return n, err
+}
+
+func (r *watchdogReader) Close() error {
+	r.watchdog.stop()
+	err := r.reader.Close()
+	r.cancel(nil)
+
+	return err
+}
+
+// idleReader disarms the watchdog while the backend waits for the content to upload
+type idleReader struct {
+	reader   io.Reader
+	watchdog *watchdog
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.watchdog.stop()
+	n, err := r.reader.Read(p)
+	r.watchdog.start()
+
+	return n, err
+}
+
+// idleReadSeeker is an idleReader keeping the content seekable
+type idleReadSeeker struct {
+	*idleReader
+	seeker io.Seeker
+}
+
+func (r *idleReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.seeker.Seek(offset, whence)
+}
+
+// circuitBreaker fails fast after threshold consecutive failures, until cooldown elapsed.
+// A single trial request is then let through to probe the backend.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	logger    *log.Logger
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+
+	if time.Now().Before(b.openUntil) || b.probing {
+		return ErrUnavailable
+	}
+
+	b.probing = true
+	return nil
+}
+
+func (b *circuitBreaker) record(failure bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+
+	if !failure {
+		if b.failures >= b.threshold {
+			b.logger.Printf("Storage recovered, closing circuit breaker")
+		}
+
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			b.logger.Printf("Storage failed %d times in a row, opening circuit breaker for %s", b.failures, b.cooldown)
+		}
+
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+func (b *circuitBreaker) available() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.failures < b.threshold || !time.Now().Before(b.openUntil)
+}
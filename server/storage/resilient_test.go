@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// headStorage is a local storage whose Head fails with err, counting the calls
+type headStorage struct {
+	*LocalStorage
+	err   error
+	calls int
+}
+
+func (h *headStorage) Head(context.Context, string, string) (uint64, error) {
+	h.calls++
+	return 0, h.err
+}
+
+// statusError is an error of a backend answering with an HTTP status
+type statusError int
+
+func (e statusError) Error() string       { return "status error" }
+func (e statusError) HTTPStatusCode() int { return int(e) }
+
+func TestResilientStorageRetries(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := NewLocalStorage(t.TempDir(), 0, 0, 0, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		err       error
+		calls     int
+		available bool
+	}{
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, 3, false},
+		{statusError(503), 3, false},
+		{ErrTimeout, 3, false},
+		{statusError(403), 1, true},
+		{ErrLegalHold, 1, true},
+		{ErrInsufficientStorage, 1, true},
+	} {
+		inner := &headStorage{LocalStorage: local, err: test.err}
+		s := NewResilientStorage(inner, 0, 2, time.Millisecond, 3, time.Minute, logger)
+
+		if _, err = s.Head(context.Background(), "token", "file"); !errors.Is(err, test.err) {
+			t.Errorf("%v: Head returned %v", test.err, err)
+		}
+
+		if inner.calls != test.calls || s.Available() != test.available {
+			t.Errorf("%v: %d calls, available %v, want %d calls, available %v", test.err, inner.calls, s.Available(), test.calls, test.available)
+		}
+	}
+}
@@ -2,10 +2,15 @@ package storage
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -16,6 +21,20 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// S3ObjectOptions holds the encryption, storage class and tagging applied to uploaded objects
+type S3ObjectOptions struct {
+	// SSE is the server-side encryption mode: "", "s3", "kms" or "c"
+	SSE string
+	// SSEKMSKeyID is the KMS key used with SSE-KMS, the AWS managed key when empty
+	SSEKMSKeyID string
+	// SSECustomerKey is the base64 encoded 256-bit key used with SSE-C
+	SSECustomerKey string
+	// StorageClass is the storage class of uploaded objects, the bucket default when empty
+	StorageClass string
+	// Tags is a comma separated list of key=value object tags
+	Tags string
+}
+
 // S3Storage is a storage backed by AWS S3
 type S3Storage struct {
 	Storage
@@ -24,15 +43,33 @@ type S3Storage struct {
 	logger      *log.Logger
 	purgeDays   time.Duration
 	noMultipart bool
+
+	sse               types.ServerSideEncryption
+	sseKMSKeyID       *string
+	sseCustomerKey    *string
+	sseCustomerKeyMD5 *string
+	storageClass      types.StorageClass
+	tagging           *string
 }
 
 // NewS3Storage is the factory for S3Storage
-func NewS3Storage(ctx context.Context, accessKey, secretKey, bucketName string, purgeDays int, region, endpoint string, disableMultipart bool, forcePathStyle bool, logger *log.Logger) (*S3Storage, error) {
+func NewS3Storage(ctx context.Context, accessKey, secretKey, bucketName string, purgeDays int, region, endpoint string, disableMultipart bool, forcePathStyle bool, objectOptions S3ObjectOptions, logger *log.Logger) (*S3Storage, error) {
 	cfg, err := getAwsConfig(ctx, accessKey, secretKey)
 	if err != nil {
 		return nil, err
 	}
 
+	storage := &S3Storage{
+		bucket:      bucketName,
+		logger:      logger,
+		noMultipart: disableMultipart,
+		purgeDays:   time.Duration(purgeDays*24) * time.Hour,
+	}
+
+	if err := storage.setObjectOptions(objectOptions); err != nil {
+		return nil, err
+	}
+
 	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
 		o.Region = region
 		o.UsePathStyle = forcePathStyle
@@ -41,13 +78,73 @@ func NewS3Storage(ctx context.Context, accessKey, secretKey, bucketName string,
 		}
 	})
 
-	return &S3Storage{
-		bucket:      bucketName,
-		s3:          client,
-		logger:      logger,
-		noMultipart: disableMultipart,
-		purgeDays:   time.Duration(purgeDays*24) * time.Hour,
-	}, nil
+	storage.s3 = client
+
+	return storage, nil
+}
+
+func (s *S3Storage) setObjectOptions(options S3ObjectOptions) error {
+	switch options.SSE {
+	case "":
+	case "s3":
+		s.sse = types.ServerSideEncryptionAes256
+	case "kms":
+		s.sse = types.ServerSideEncryptionAwsKms
+		if options.SSEKMSKeyID != "" {
+			s.sseKMSKeyID = aws.String(options.SSEKMSKeyID)
+		}
+	case "c":
+		key, err := base64.StdEncoding.DecodeString(options.SSECustomerKey)
+		if err != nil {
+			return fmt.Errorf("invalid sse-c key: %w", err)
+		} else if len(key) != 32 {
+			return errors.New("sse-c key must be 256 bits")
+		}
+
+		sum := md5.Sum(key)
+		s.sseCustomerKey = aws.String(options.SSECustomerKey)
+		s.sseCustomerKeyMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+	default:
+		return fmt.Errorf("invalid sse mode %q, must be one of s3, kms or c", options.SSE)
+	}
+
+	if options.StorageClass != "" {
+		s.storageClass = types.StorageClass(options.StorageClass)
+
+		valid := false
+		for _, storageClass := range s.storageClass.Values() {
+			valid = valid || storageClass == s.storageClass
+		}
+
+		if !valid {
+			return fmt.Errorf("invalid storage class %q", options.StorageClass)
+		}
+	}
+
+	if options.Tags != "" {
+		tags := url.Values{}
+		for _, tag := range strings.Split(options.Tags, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(tag), "=")
+			if key == "" {
+				return fmt.Errorf("invalid object tag %q", tag)
+			}
+
+			tags.Add(key, value)
+		}
+
+		s.tagging = aws.String(tags.Encode())
+	}
+
+	return nil
+}
+
+// sseCustomerAlgorithm returns the SSE-C algorithm to send along the key, if any
+func (s *S3Storage) sseCustomerAlgorithm() *string {
+	if s.sseCustomerKey == nil {
+		return nil
+	}
+
+	return aws.String("AES256")
 }
 
 // Type returns the storage type
@@ -60,8 +157,11 @@ func (s *S3Storage) Head(ctx context.Context, token string, filename string) (co
 	key := fmt.Sprintf("%s/%s", token, filename)
 
 	headRequest := &s3.HeadObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
 	}
 
 	// content type , content length
@@ -81,6 +181,35 @@ func (s *S3Storage) Purge(context.Context, time.Duration) (err error) {
 	return nil
 }
 
+// List calls fn for every file stored under token, or for every stored file when token is empty
+func (s *S3Storage) List(ctx context.Context, token string, fn func(token string, filename string) error) error {
+	listRequest := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	}
+
+	if token != "" {
+		listRequest.Prefix = aws.String(token + "/")
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(s.s3, listRequest)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range page.Contents {
+			if token, filename, ok := splitKey(aws.ToString(object.Key)); ok {
+				if err := fn(token, filename); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 // IsNotExist indicates if a file doesn't exist on storage
 func (s *S3Storage) IsNotExist(err error) bool {
 	if err == nil {
@@ -88,7 +217,8 @@ func (s *S3Storage) IsNotExist(err error) bool {
 	}
 
 	var nkerr *types.NoSuchKey
-	return errors.As(err, &nkerr)
+	var nferr *types.NotFound
+	return errors.As(err, &nkerr) || errors.As(err, &nferr)
 }
 
 // Get retrieves a file from storage
@@ -96,8 +226,11 @@ func (s *S3Storage) Get(ctx context.Context, token string, filename string, rng
 	key := fmt.Sprintf("%s/%s", token, filename)
 
 	getRequest := &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
 	}
 
 	if rng != nil {
@@ -143,7 +276,12 @@ func (s *S3Storage) Delete(ctx context.Context, token string, filename string) (
 }
 
 // Put saves a file on storage
-func (s *S3Storage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, _ uint64) (err error) {
+func (s *S3Storage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) (err error) {
+	return s.PutWithMetadata(ctx, token, filename, reader, contentType, contentLength, nil)
+}
+
+// PutWithMetadata saves a file on storage along with its metadata
+func (s *S3Storage) PutWithMetadata(ctx context.Context, token string, filename string, reader io.Reader, contentType string, _ uint64, metadata map[string]string) (err error) {
 	key := fmt.Sprintf("%s/%s", token, filename)
 
 	s.logger.Printf("Uploading file %s to S3 Bucket", filename)
@@ -166,16 +304,346 @@ func (s *S3Storage) Put(ctx context.Context, token string, filename string, read
 	}
 
 	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(s.bucket),
-		Key:         aws.String(key),
-		Body:        reader,
-		Expires:     expire,
-		ContentType: aws.String(contentType),
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Body:                 reader,
+		Expires:              expire,
+		ContentType:          aws.String(contentType),
+		ServerSideEncryption: s.sse,
+		SSEKMSKeyId:          s.sseKMSKeyID,
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+		StorageClass:         s.storageClass,
+		Tagging:              s.tagging,
+		Metadata:             metadata,
 	})
 
 	return
 }
 
+// GetMetadata retrieves the metadata stored on a file
+func (s *S3Storage) GetMetadata(ctx context.Context, token string, filename string) (map[string]string, error) {
+	key := fmt.Sprintf("%s/%s", token, filename)
+
+	response, err := s.s3.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Metadata, nil
+}
+
+// UpdateMetadata replaces the metadata stored on a file by copying it in place
+func (s *S3Storage) UpdateMetadata(ctx context.Context, token string, filename string, metadata map[string]string) error {
+	key := fmt.Sprintf("%s/%s", token, filename)
+
+	head, err := s.s3.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+	})
+	if err != nil {
+		return err
+	}
+
+	if head.ContentLength > maxCopyObjectSize {
+		return s.copyInParts(ctx, token, filename, head, metadata)
+	}
+
+	_, err = s.s3.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:                         aws.String(s.bucket),
+		Key:                            aws.String(key),
+		CopySource:                     aws.String(url.PathEscape(s.bucket) + "/" + url.PathEscape(token) + "/" + url.PathEscape(filename)),
+		MetadataDirective:              types.MetadataDirectiveReplace,
+		Metadata:                       metadata,
+		ContentType:                    head.ContentType,
+		Expires:                        head.Expires,
+		ServerSideEncryption:           s.sse,
+		SSEKMSKeyId:                    s.sseKMSKeyID,
+		SSECustomerAlgorithm:           s.sseCustomerAlgorithm(),
+		SSECustomerKey:                 s.sseCustomerKey,
+		SSECustomerKeyMD5:              s.sseCustomerKeyMD5,
+		CopySourceSSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		CopySourceSSECustomerKey:       s.sseCustomerKey,
+		CopySourceSSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+		StorageClass:                   s.storageClass,
+		ObjectLockLegalHoldStatus:      head.ObjectLockLegalHoldStatus,
+	})
+
+	return err
+}
+
+// SetLegalHold places an Object Lock legal hold on the current version of a file, or
+// releases it from every version. The bucket needs Object Lock, hence versioning,
+// enabled: copies replacing the metadata of a held file are new versions which keep
+// the hold, so a release lifts it from all the versions written while held.
+func (s *S3Storage) SetLegalHold(ctx context.Context, token string, filename string, hold bool) error {
+	key := fmt.Sprintf("%s/%s", token, filename)
+
+	if hold {
+		head, err := s.s3.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(s.bucket),
+			Key:                  aws.String(key),
+			SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+			SSECustomerKey:       s.sseCustomerKey,
+			SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+		})
+		if err != nil {
+			return err
+		}
+
+		return s.setLegalHold(ctx, key, head.VersionId, types.ObjectLockLegalHoldStatusOn)
+	}
+
+	paginator := s3.NewListObjectVersionsPaginator(s.s3, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(key),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, version := range page.Versions {
+			if aws.ToString(version.Key) != key {
+				continue
+			}
+
+			if err = s.setLegalHold(ctx, key, version.VersionId, types.ObjectLockLegalHoldStatusOff); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *S3Storage) setLegalHold(ctx context.Context, key string, versionID *string, status types.ObjectLockLegalHoldStatus) error {
+	_, err := s.s3.PutObjectLegalHold(ctx, &s3.PutObjectLegalHoldInput{
+		Bucket:    aws.String(s.bucket),
+		Key:       aws.String(key),
+		VersionId: versionID,
+		LegalHold: &types.ObjectLockLegalHold{Status: status},
+	})
+
+	return err
+}
+
+// InitiateMultipart starts a multipart upload of a file, returning the upload id
+func (s *S3Storage) InitiateMultipart(ctx context.Context, token string, filename string, contentType string, metadata map[string]string) (string, error) {
+	key := fmt.Sprintf("%s/%s", token, filename)
+
+	var expire *time.Time
+	if s.purgeDays.Hours() > 0 {
+		expire = aws.Time(time.Now().Add(s.purgeDays))
+	}
+
+	response, err := s.s3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Expires:              expire,
+		ContentType:          aws.String(contentType),
+		ServerSideEncryption: s.sse,
+		SSEKMSKeyId:          s.sseKMSKeyID,
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+		StorageClass:         s.storageClass,
+		Tagging:              s.tagging,
+		Metadata:             metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.ToString(response.UploadId), nil
+}
+
+// PutPart saves a part of a multipart upload, returning its ETag
+func (s *S3Storage) PutPart(ctx context.Context, token string, filename string, uploadID string, number int, reader io.ReadSeeker, contentLength uint64) (string, error) {
+	key := fmt.Sprintf("%s/%s", token, filename)
+
+	response, err := s.s3.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		UploadId:             aws.String(uploadID),
+		PartNumber:           int32(number),
+		Body:                 reader,
+		ContentLength:        int64(contentLength),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.ToString(response.ETag), nil
+}
+
+// CompleteMultipart assembles the file from the given parts
+func (s *S3Storage) CompleteMultipart(ctx context.Context, token string, filename string, uploadID string, parts []Part) error {
+	key := fmt.Sprintf("%s/%s", token, filename)
+
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, types.CompletedPart{
+			PartNumber: int32(part.Number),
+			ETag:       aws.String(part.ETag),
+		})
+	}
+
+	_, err := s.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+
+	return err
+}
+
+// AbortMultipart discards a multipart upload and its parts
+func (s *S3Storage) AbortMultipart(ctx context.Context, token string, filename string, uploadID string) error {
+	key := fmt.Sprintf("%s/%s", token, filename)
+
+	_, err := s.s3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+
+	return err
+}
+
+// maxCopyObjectSize is the largest object CopyObject accepts, larger ones are copied in parts
+const maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+// copyPartSize is the size of the parts larger objects are copied in
+const copyPartSize = 1024 * 1024 * 1024
+
+// copyInParts copies an object in place with new metadata through a multipart upload
+func (s *S3Storage) copyInParts(ctx context.Context, token string, filename string, head *s3.HeadObjectOutput, metadata map[string]string) error {
+	key := fmt.Sprintf("%s/%s", token, filename)
+	source := url.PathEscape(s.bucket) + "/" + url.PathEscape(token) + "/" + url.PathEscape(filename)
+
+	upload, err := s.s3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:                    aws.String(s.bucket),
+		Key:                       aws.String(key),
+		Metadata:                  metadata,
+		ContentType:               head.ContentType,
+		Expires:                   head.Expires,
+		ServerSideEncryption:      s.sse,
+		SSEKMSKeyId:               s.sseKMSKeyID,
+		SSECustomerAlgorithm:      s.sseCustomerAlgorithm(),
+		SSECustomerKey:            s.sseCustomerKey,
+		SSECustomerKeyMD5:         s.sseCustomerKeyMD5,
+		StorageClass:              s.storageClass,
+		Tagging:                   s.tagging,
+		ObjectLockLegalHoldStatus: head.ObjectLockLegalHoldStatus,
+	})
+	if err != nil {
+		return err
+	}
+
+	count := int((head.ContentLength + copyPartSize - 1) / copyPartSize)
+	parts := make([]types.CompletedPart, count)
+	errs := make([]error, count)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 10)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			start := int64(i) * copyPartSize
+			end := start + copyPartSize - 1
+			if end >= head.ContentLength {
+				end = head.ContentLength - 1
+			}
+
+			response, err := s.s3.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+				Bucket:                         aws.String(s.bucket),
+				Key:                            aws.String(key),
+				UploadId:                       upload.UploadId,
+				PartNumber:                     int32(i + 1),
+				CopySource:                     aws.String(source),
+				CopySourceRange:                aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+				SSECustomerAlgorithm:           s.sseCustomerAlgorithm(),
+				SSECustomerKey:                 s.sseCustomerKey,
+				SSECustomerKeyMD5:              s.sseCustomerKeyMD5,
+				CopySourceSSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+				CopySourceSSECustomerKey:       s.sseCustomerKey,
+				CopySourceSSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			parts[i] = types.CompletedPart{PartNumber: int32(i + 1), ETag: response.CopyPartResult.ETag}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			_ = s.AbortMultipart(ctx, token, filename, aws.ToString(upload.UploadId))
+			return err
+		}
+	}
+
+	_, err = s.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+
+	return err
+}
+
+// PresignGet returns a URL, valid for expiry, downloading a file directly from the backend
+// with the given Content-Type and Content-Disposition
+func (s *S3Storage) PresignGet(ctx context.Context, token string, filename string, contentType string, contentDisposition string, expiry time.Duration) (string, error) {
+	if s.sseCustomerKey != nil {
+		// the client would have to send the customer key along
+		return "", errors.New("presigned urls not supported with sse-c")
+	}
+
+	key := fmt.Sprintf("%s/%s", token, filename)
+
+	getRequest := &s3.GetObjectInput{
+		Bucket:                     aws.String(s.bucket),
+		Key:                        aws.String(key),
+		ResponseContentType:        aws.String(contentType),
+		ResponseContentDisposition: aws.String(contentDisposition),
+	}
+
+	request, err := s3.NewPresignClient(s.s3).PresignGetObject(ctx, getRequest, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", err
+	}
+
+	return request.URL, nil
+}
+
 func (s *S3Storage) IsRangeSupported() bool { return true }
 
 func getAwsConfig(ctx context.Context, accessKey, secretKey string) (aws.Config, error) {
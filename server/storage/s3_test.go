@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestS3ObjectOptions(t *testing.T) {
+	var s S3Storage
+	err := s.setObjectOptions(S3ObjectOptions{
+		SSE:            "c",
+		SSECustomerKey: "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		StorageClass:   "STANDARD_IA",
+		Tags:           "team=ops, env=prod",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aws.ToString(s.sseCustomerAlgorithm()) != "AES256" || aws.ToString(s.sseCustomerKeyMD5) == "" {
+		t.Errorf("sse-c not configured: algorithm %q, key md5 %q", aws.ToString(s.sseCustomerAlgorithm()), aws.ToString(s.sseCustomerKeyMD5))
+	}
+
+	if s.storageClass != types.StorageClassStandardIa {
+		t.Errorf("storage class = %q, want %q", s.storageClass, types.StorageClassStandardIa)
+	}
+
+	if got := aws.ToString(s.tagging); got != "env=prod&team=ops" {
+		t.Errorf("tagging = %q, want %q", got, "env=prod&team=ops")
+	}
+
+	for _, options := range []S3ObjectOptions{
+		{SSE: "aes"},
+		{SSE: "c", SSECustomerKey: "c2hvcnQ="},
+		{StorageClass: "COLD"},
+		{Tags: "=value"},
+	} {
+		if err := (&S3Storage{}).setObjectOptions(options); err == nil {
+			t.Errorf("setObjectOptions(%+v) accepted", options)
+		}
+	}
+}
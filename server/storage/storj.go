@@ -117,6 +117,25 @@ func (s *StorjStorage) Delete(ctx context.Context, token string, filename string
 	return
 }
 
+// List calls fn for every file stored under token, or for every stored file when token is empty
+func (s *StorjStorage) List(ctx context.Context, token string, fn func(token string, filename string) error) error {
+	options := &uplink.ListObjectsOptions{Recursive: true}
+	if token != "" {
+		options.Prefix = token + "/"
+	}
+
+	objects := s.project.ListObjects(fpath.WithTempData(ctx, "", true), s.bucket.Name, options)
+	for objects.Next() {
+		if token, filename, ok := splitKey(objects.Item().Key); ok {
+			if err := fn(token, filename); err != nil {
+				return err
+			}
+		}
+	}
+
+	return objects.Err()
+}
+
 // Purge cleans up the storage
 func (s *StorjStorage) Purge(context.Context, time.Duration) (err error) {
 	// NOOP expiration is set at upload time
@@ -125,6 +144,11 @@ func (s *StorjStorage) Purge(context.Context, time.Duration) (err error) {
 
 // Put saves a file on storage
 func (s *StorjStorage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) (err error) {
+	return s.PutWithMetadata(ctx, token, filename, reader, contentType, contentLength, nil)
+}
+
+// PutWithMetadata saves a file on storage along with its metadata
+func (s *StorjStorage) PutWithMetadata(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64, metadata map[string]string) (err error) {
 	key := storj.JoinPaths(token, filename)
 
 	s.logger.Printf("Uploading file %s to Storj Bucket", filename)
@@ -145,7 +169,13 @@ func (s *StorjStorage) Put(ctx context.Context, token string, filename string, r
 		_ = writer.Abort()
 		return err
 	}
-	err = writer.SetCustomMetadata(ctx, uplink.CustomMetadata{"content-type": contentType})
+	customMetadata := uplink.CustomMetadata{}
+	for k, v := range metadata {
+		customMetadata[k] = v
+	}
+	customMetadata["content-type"] = contentType
+
+	err = writer.SetCustomMetadata(ctx, customMetadata)
 	if err != nil {
 		//Ignoring the error to return the one that occurred first, but try to clean up.
 		_ = writer.Abort()
@@ -156,6 +186,38 @@ func (s *StorjStorage) Put(ctx context.Context, token string, filename string, r
 	return err
 }
 
+// GetMetadata retrieves the metadata stored on a file
+func (s *StorjStorage) GetMetadata(ctx context.Context, token string, filename string) (map[string]string, error) {
+	key := storj.JoinPaths(token, filename)
+
+	obj, err := s.project.StatObject(fpath.WithTempData(ctx, "", true), s.bucket.Name, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return obj.Custom, nil
+}
+
+// UpdateMetadata replaces the metadata stored on a file, keeping its content type
+func (s *StorjStorage) UpdateMetadata(ctx context.Context, token string, filename string, metadata map[string]string) error {
+	key := storj.JoinPaths(token, filename)
+
+	ctx = fpath.WithTempData(ctx, "", true)
+
+	obj, err := s.project.StatObject(ctx, s.bucket.Name, key)
+	if err != nil {
+		return err
+	}
+
+	customMetadata := uplink.CustomMetadata{}
+	for k, v := range metadata {
+		customMetadata[k] = v
+	}
+	customMetadata["content-type"] = obj.Custom["content-type"]
+
+	return s.project.UpdateObjectMetadata(ctx, s.bucket.Name, key, customMetadata, nil)
+}
+
 func (s *StorjStorage) IsRangeSupported() bool { return true }
 
 // IsNotExist indicates if a file doesn't exist on storage
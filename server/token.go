@@ -25,7 +25,19 @@ THE SOFTWARE.
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
 	"strings"
+	"time"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+	"github.com/sethvargo/go-diceware/diceware"
 )
 
 const (
@@ -37,11 +49,229 @@ const (
 func token(length int) string {
 	var builder strings.Builder
 	builder.Grow(length)
-	
+
+	max := big.NewInt(int64(len(SYMBOLS)))
 	for i := 0; i < length; i++ {
-		x := theRand.Intn(len(SYMBOLS) - 1)
-		builder.WriteByte(SYMBOLS[x])
+		x, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic("cannot read from cryptographically secure random source")
+		}
+
+		builder.WriteByte(SYMBOLS[x.Int64()])
 	}
 
 	return builder.String()
 }
+
+// TokenGenerator generates the tokens uploads are stored under
+type TokenGenerator interface {
+	// Generate returns a new token
+	Generate() (string, error)
+}
+
+// Base62TokenGenerator generates random alphanumeric tokens
+type Base62TokenGenerator struct {
+	Length int
+}
+
+// Generate returns a new token
+func (g Base62TokenGenerator) Generate() (string, error) {
+	return token(g.Length), nil
+}
+
+// DicewareTokenGenerator generates tokens of random words joined by dashes
+type DicewareTokenGenerator struct {
+	Words int
+}
+
+// Generate returns a new token
+func (g DicewareTokenGenerator) Generate() (string, error) {
+	words, err := diceware.Generate(g.Words)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(words, "-"), nil
+}
+
+// ULIDTokenGenerator generates ULIDs, lexicographically sortable by creation time
+type ULIDTokenGenerator struct{}
+
+// crockfordBase32 is the alphabet of ULIDs
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Generate returns a new token
+func (ULIDTokenGenerator) Generate() (string, error) {
+	var id [16]byte
+
+	// 48 bits of milliseconds since epoch followed by 80 random bits
+	binary.BigEndian.PutUint64(id[:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+
+	// 26 characters of 5 bits encode the 128 bits, the first one holding only 3
+	encoded := make([]byte, 26)
+	for i := len(encoded) - 1; i >= 0; i-- {
+		encoded[i] = crockfordBase32[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(encoded), nil
+}
+
+// NewTokenGenerator returns the token generator named kind: base62, diceware or ulid.
+// size is the length of base62 tokens and the number of words of diceware tokens.
+func NewTokenGenerator(kind string, size int) (TokenGenerator, error) {
+	switch kind {
+	case "", "base62":
+		return Base62TokenGenerator{Length: size}, nil
+	case "diceware":
+		return DicewareTokenGenerator{Words: size}, nil
+	case "ulid":
+		return ULIDTokenGenerator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown token generator %q", kind)
+	}
+}
+
+// defaultReservedTokens are tokens clashing with routes of the server
+var defaultReservedTokens = []string{
+	"download", "get", "inline", "put", "upload", "uploads", "fetch", "admin",
+	"images", "styles", "scripts", "fonts", "ico",
+	"favicon.ico", "robots.txt", "health.html",
+}
+
+// vanityTokenPattern restricts vanity tokens to URL-safe slugs
+var vanityTokenPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{2,63}$`)
+
+// errTokenInvalid is returned for a malformed or reserved vanity token
+var errTokenInvalid = errors.New("invalid token")
+
+// errTokenTaken is returned for a vanity token already in use
+var errTokenTaken = errors.New("token already in use")
+
+// maxTokenAttempts bounds the retries on collisions of generated tokens
+const maxTokenAttempts = 5
+
+// isReservedToken indicates if token is reserved, ignoring case
+func (s *Server) isReservedToken(token string) bool {
+	for _, reserved := range defaultReservedTokens {
+		if strings.EqualFold(token, reserved) {
+			return true
+		}
+	}
+
+	for _, reserved := range s.reservedTokens {
+		if strings.EqualFold(token, reserved) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// uploadToken returns the token a new upload is stored under: the vanity token
+// requested in the X-Vanity-Token header, or a generated one free on storage.
+// The token is reserved against concurrent uploads until release is called.
+func (s *Server) uploadToken(r *http.Request) (token string, release func(), err error) {
+	if vanity := r.Header.Get("X-Vanity-Token"); vanity != "" {
+		if !vanityTokenPattern.MatchString(vanity) || s.isReservedToken(vanity) {
+			return "", nil, errTokenInvalid
+		}
+
+		return s.reserveToken(r.Context(), vanity)
+	}
+
+	generator := s.tokenGenerator
+	if generator == nil {
+		generator = Base62TokenGenerator{Length: s.randomTokenLength}
+	}
+
+	for attempt := 0; attempt < maxTokenAttempts; attempt++ {
+		if token, err = generator.Generate(); err != nil {
+			return "", nil, err
+		}
+
+		if s.isReservedToken(token) {
+			continue
+		}
+
+		token, release, err = s.reserveToken(r.Context(), token)
+		if err != errTokenTaken {
+			return token, release, err
+		}
+	}
+
+	return "", nil, errors.New("could not generate a free token")
+}
+
+// reserveToken reserves token if no upload is using it yet. Tokens are case-sensitive,
+// like the keys of the storages checked for files under them.
+func (s *Server) reserveToken(ctx context.Context, token string) (string, func(), error) {
+	if _, loaded := s.tokenReservations.LoadOrStore(token, struct{}{}); loaded {
+		return "", nil, errTokenTaken
+	}
+
+	release := func() {
+		s.releaseToken(token)
+	}
+
+	exists, err := s.tokenExists(ctx, token)
+	if err != nil || exists {
+		release()
+
+		if err == nil {
+			err = errTokenTaken
+		}
+
+		return "", nil, err
+	}
+
+	return token, release, nil
+}
+
+// releaseToken releases the reservation of token
+func (s *Server) releaseToken(token string) {
+	s.tokenReservations.Delete(token)
+}
+
+// errTokenFound stops listing a token as soon as a file is found
+var errTokenFound = errors.New("token found")
+
+// tokenExists indicates if any file is stored under token
+func (s *Server) tokenExists(ctx context.Context, token string) (bool, error) {
+	lister, ok := storage.Capability[storage.Lister](s.storage)
+	if !ok {
+		return false, fmt.Errorf("%s storage cannot list its files", s.storage.Type())
+	}
+
+	err := lister.List(ctx, token, func(string, string) error {
+		return errTokenFound
+	})
+	if err == errTokenFound {
+		return true, nil
+	} else if s.storage.IsNotExist(err) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// tokenError writes the response for a failed uploadToken
+func (s *Server) tokenError(w http.ResponseWriter, err error) {
+	switch {
+	case err == errTokenInvalid:
+		http.Error(w, "Invalid token, use 3 to 64 letters, digits, dashes or underscores, not reserved", http.StatusBadRequest)
+	case err == errTokenTaken:
+		http.Error(w, "Token already in use", http.StatusConflict)
+	case isStorageUnavailable(err):
+		s.storageUnavailableError(w, err)
+	default:
+		s.logger.Printf("Error generating token: %s", err.Error())
+		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+	}
+}
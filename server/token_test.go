@@ -1,6 +1,15 @@
 package server
 
-import "testing"
+import (
+	"context"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
 
 func BenchmarkTokenConcat(b *testing.B) {
 	for i := 0; i < b.N; i++ {
@@ -13,3 +22,60 @@ func BenchmarkTokenLonger(b *testing.B) {
 		_ = token(10)
 	}
 }
+
+func TestTokenGenerators(t *testing.T) {
+	for kind, pattern := range map[string]string{
+		"base62":   `^[0-9a-zA-Z]{6}$`,
+		"diceware": `^[a-z]+(-[a-z]+){5}$`,
+		"ulid":     `^[0-9A-HJKMNP-TV-Z]{26}$`,
+	} {
+		generator, err := NewTokenGenerator(kind, 6)
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+
+		token, err := generator.Generate()
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+
+		if !regexp.MustCompile(pattern).MatchString(token) {
+			t.Errorf("%s: unexpected token %q", kind, token)
+		}
+	}
+
+	if _, err := NewTokenGenerator("unknown", 6); err == nil {
+		t.Error("expected an error for an unknown generator")
+	}
+}
+
+func TestReserveTokenCaseSensitive(t *testing.T) {
+	ctx := context.Background()
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(t.TempDir(), 0, 0, 0, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = local.Put(ctx, "stored", "hello.txt", strings.NewReader("hello"), "text/plain", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{storage: local, logger: logger}
+
+	_, release, err := s.reserveToken(ctx, "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	for token, want := range map[string]error{"report": errTokenTaken, "Report": nil, "stored": errTokenTaken, "Stored": nil} {
+		_, release, err := s.reserveToken(ctx, token)
+		if err != want {
+			t.Errorf("reserveToken(%q) = %v, want %v", token, err, want)
+		} else if err == nil {
+			release()
+		}
+	}
+}
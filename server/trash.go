@@ -0,0 +1,152 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+// trashed indicates if the owner deleted the file, which is kept until the trash is emptied
+func (m metadata) trashed() bool {
+	return !m.Trashed.IsZero()
+}
+
+// trashFile makes a file unavailable, deleting it only once the trash retention elapsed
+func (s *Server) trashFile(ctx context.Context, token, filename string) (metadata, error) {
+	s.lock(token, filename)
+	defer s.unlock(token, filename)
+
+	m, err := s.readMetadata(ctx, token, filename)
+	if err != nil {
+		return m, err
+	} else if m.held() {
+		return m, storage.ErrLegalHold
+	}
+
+	m.Trashed = time.Now().UTC()
+	if err = s.writeMetadata(ctx, token, filename, m); err != nil {
+		return m, err
+	}
+
+	if err = s.removeFromCollection(ctx, token, filename); err != nil {
+		s.logger.Printf("Error removing %s/%s from collection: %s", token, filename, err.Error())
+	}
+
+	return m, nil
+}
+
+// restoreHandler takes a file out of the trash before it is emptied, for its owner
+// authorized by the deletion token or for admins
+func (s *Server) restoreHandler(owner bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		token := vars["token"]
+		filename := sanitize(vars["filename"])
+
+		s.lock(token, filename)
+		defer s.unlock(token, filename)
+
+		m, err := s.readMetadata(r.Context(), token, filename)
+		if isStorageUnavailable(err) {
+			s.storageUnavailableError(w, err)
+			return
+		} else if err != nil || !m.trashed() || time.Since(m.Trashed) > s.trashRetention {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if owner && subtle.ConstantTimeCompare([]byte(m.DeletionToken), []byte(vars["deletionToken"])) != 1 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		m.Trashed = time.Time{}
+		if err = s.writeMetadata(r.Context(), token, filename, m); isStorageUnavailable(err) {
+			s.storageUnavailableError(w, err)
+			return
+		} else if err != nil {
+			s.logger.Printf("Error restoring %s/%s: %s", token, filename, err.Error())
+			http.Error(w, "Could not restore file", http.StatusInternalServerError)
+			return
+		}
+
+		if _, err = s.addToCollection(r.Context(), token, filename, m.ContentLength, false); err != nil {
+			s.logger.Printf("Error adding %s/%s to collection: %s", token, filename, err.Error())
+		}
+
+		s.logger.Printf("Restored %s/%s from the trash", token, filename)
+
+		setLimitHeaders(w, m)
+		s.writeStats(w, filename, m)
+	}
+}
+
+// emptyTrash deletes the files trashed longer than the trash retention, on every purge
+func (s *Server) emptyTrash(ctx context.Context) error {
+	lister, ok := storage.Capability[storage.Lister](s.storage)
+	if !ok {
+		return nil
+	}
+
+	type file struct{ token, filename string }
+
+	// files are deleted once listed, some storages failing to list while deleting
+	var expired []file
+	err := lister.List(ctx, "", func(token, filename string) error {
+		m, err := s.readMetadata(ctx, token, filename)
+		if err == nil && m.trashed() && !m.held() && time.Since(m.Trashed) > s.trashRetention {
+			expired = append(expired, file{token, filename})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, f := range expired {
+		s.lock(f.token, f.filename)
+
+		m, err := s.readMetadata(ctx, f.token, f.filename)
+		if err == nil && m.trashed() {
+			err = s.deleteFile(ctx, f.token, f.filename)
+			if err == nil {
+				s.logger.Printf("Emptied %s/%s from the trash", f.token, f.filename)
+			} else if !s.storage.IsNotExist(err) {
+				s.logger.Printf("Error emptying %s/%s from the trash: %s", f.token, f.filename, err.Error())
+			}
+		}
+
+		s.unlock(f.token, f.filename)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+type suiteTrash struct {
+	srvr *Server
+	vars map[string]string
+}
+
+func (s *suiteTrash) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	s.srvr, err = New(UseStorage(local), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10), TrashRetention(time.Hour), Purge(0, 1))
+	c.Assert(err, IsNil)
+
+	req := httptest.NewRequest("PUT", "http://test/hello.txt", strings.NewReader("one"))
+	w := httptest.NewRecorder()
+	s.srvr.putHandler(w, mux.SetURLVars(req, map[string]string{"filename": "hello.txt"}))
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	u, err := url.Parse(w.Header().Get("X-Url-Delete"))
+	c.Assert(err, IsNil)
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	c.Assert(parts, HasLen, 3)
+	s.vars = map[string]string{"token": parts[0], "filename": parts[1], "deletionToken": parts[2]}
+
+	c.Assert(s.serve(s.srvr.deleteHandler, "DELETE", s.vars).Code, Equals, http.StatusOK)
+}
+
+func (s *suiteTrash) serve(handler http.HandlerFunc, method string, vars map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, mux.SetURLVars(httptest.NewRequest(method, "http://test/", nil), vars))
+
+	return w
+}
+
+// trashedSince moves the time the file was trashed to d ago
+func (s *suiteTrash) trashedSince(c *C, d time.Duration) {
+	m, err := s.srvr.readMetadata(context.Background(), s.vars["token"], s.vars["filename"])
+	c.Assert(err, IsNil)
+
+	m.Trashed = time.Now().Add(-d)
+	c.Assert(s.srvr.writeMetadata(context.Background(), s.vars["token"], s.vars["filename"], m), IsNil)
+}
+
+func (s *suiteTrash) TestRestore(c *C) {
+	c.Assert(s.serve(s.srvr.getHandler, "GET", s.vars).Code, Equals, http.StatusNotFound)
+
+	wrong := map[string]string{"token": s.vars["token"], "filename": s.vars["filename"], "deletionToken": "wrong"}
+	c.Assert(s.serve(s.srvr.restoreHandler(true), "POST", wrong).Code, Equals, http.StatusNotFound)
+
+	c.Assert(s.serve(s.srvr.restoreHandler(true), "POST", s.vars).Code, Equals, http.StatusOK)
+
+	w := s.serve(s.srvr.getHandler, "GET", s.vars)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "one")
+}
+
+func (s *suiteTrash) TestAdminRestore(c *C) {
+	admin := map[string]string{"token": s.vars["token"], "filename": s.vars["filename"]}
+	c.Assert(s.serve(s.srvr.restoreHandler(false), "POST", admin).Code, Equals, http.StatusOK)
+	c.Assert(s.serve(s.srvr.getHandler, "GET", s.vars).Code, Equals, http.StatusOK)
+}
+
+func (s *suiteTrash) TestRestoreAfterRetention(c *C) {
+	s.trashedSince(c, 2*time.Hour)
+
+	c.Assert(s.serve(s.srvr.restoreHandler(true), "POST", s.vars).Code, Equals, http.StatusNotFound)
+}
+
+func (s *suiteTrash) TestEmptyTrash(c *C) {
+	c.Assert(s.srvr.emptyTrash(context.Background()), IsNil)
+
+	_, err := s.srvr.storage.Head(context.Background(), s.vars["token"], s.vars["filename"])
+	c.Assert(err, IsNil)
+
+	s.trashedSince(c, 2*time.Hour)
+	c.Assert(s.srvr.emptyTrash(context.Background()), IsNil)
+
+	_, err = s.srvr.storage.Head(context.Background(), s.vars["token"], s.vars["filename"])
+	c.Assert(s.srvr.storage.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,704 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+	"github.com/gorilla/mux"
+)
+
+// uploadSessionTTL is how long a multipart upload session can take to complete
+const uploadSessionTTL = 24 * time.Hour
+
+// uploadSessionPurgeInterval is the interval between two purges of expired sessions
+const uploadSessionPurgeInterval = time.Hour
+
+// maxUploadParts is the highest part number of a multipart upload
+const maxUploadParts = 10000
+
+// uploadSession is a multipart upload in progress, persisted in the temp path.
+// Parts are uploaded to the storage directly when it supports multipart uploads,
+// otherwise they are kept next to the session until completion.
+type uploadSession struct {
+	ID          string
+	Token       string
+	Filename    string
+	ContentType string
+	Metadata    metadata
+	// StorageUploadID is the multipart upload id of the storage, empty when parts are kept locally
+	StorageUploadID string
+	Created         time.Time
+}
+
+// errUploadSessionNotFound is returned for unknown or expired upload sessions
+var errUploadSessionNotFound = errors.New("upload session not found")
+
+func (s *Server) uploadSessionsDir() string {
+	return filepath.Join(s.tempPath, "transfer-uploads")
+}
+
+func (s *Server) uploadSessionDir(id string) string {
+	return filepath.Join(s.uploadSessionsDir(), id)
+}
+
+// multipartUploader returns the storage multipart uploader, unless uploads must be assembled
+// locally to be scanned before being stored, for the upload policy or to be checked
+// against the blocklist
+func (s *Server) multipartUploader() (storage.MultipartUploader, bool) {
+	if len(s.scanners) > 0 && s.scanWorkers == 0 || !s.uploadPolicy.empty() || s.blocklist.active() {
+		return nil, false
+	}
+
+	return storage.Capability[storage.MultipartUploader](s.storage)
+}
+
+func (s *Server) saveUploadSession(session *uploadSession) error {
+	dir := s.uploadSessionDir(session.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, "session.json"), data, 0600)
+}
+
+func (s *Server) loadUploadSession(id string) (*uploadSession, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return nil, errUploadSessionNotFound
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.uploadSessionDir(id), "session.json"))
+	if os.IsNotExist(err) {
+		return nil, errUploadSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	session := &uploadSession{}
+	if err = json.Unmarshal(data, session); err != nil {
+		return nil, err
+	}
+
+	if time.Since(session.Created) > uploadSessionTTL {
+		return nil, errUploadSessionNotFound
+	}
+
+	return session, nil
+}
+
+// removeUploadSession discards a session along with its parts
+func (s *Server) removeUploadSession(ctx context.Context, session *uploadSession, abort bool) {
+	if abort && session.StorageUploadID != "" {
+		if uploader, ok := storage.Capability[storage.MultipartUploader](s.storage); ok {
+			if err := uploader.AbortMultipart(ctx, session.Token, session.Filename, session.StorageUploadID); err != nil {
+				s.logger.Printf("Error aborting multipart upload %s: %s", session.ID, err.Error())
+			}
+		}
+	}
+
+	if err := os.RemoveAll(s.uploadSessionDir(session.ID)); err != nil {
+		s.logger.Printf("Error removing upload session %s: %s", session.ID, err.Error())
+	}
+
+	s.releaseToken(session.Token)
+}
+
+// reserveUploadSessionTokens reserves the tokens of the sessions left by a previous run
+func (s *Server) reserveUploadSessionTokens() {
+	entries, err := os.ReadDir(s.uploadSessionsDir())
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if session, err := s.loadUploadSession(entry.Name()); err == nil {
+			s.tokenReservations.Store(session.Token, struct{}{})
+		}
+	}
+}
+
+// purgeUploadSessions discards the sessions older than uploadSessionTTL
+func (s *Server) purgeUploadSessions(ctx context.Context) {
+	entries, err := os.ReadDir(s.uploadSessionsDir())
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(s.uploadSessionsDir(), entry.Name(), "session.json"))
+		if err != nil {
+			continue
+		}
+
+		session := &uploadSession{}
+		if err = json.Unmarshal(data, session); err != nil || time.Since(session.Created) <= uploadSessionTTL {
+			continue
+		}
+
+		s.logger.Printf("Removing expired upload session %s", session.ID)
+		s.removeUploadSession(ctx, session, true)
+	}
+}
+
+// uploadSessionReaper purges expired sessions periodically, whether files are purged or not
+func (s *Server) uploadSessionReaper(ctx context.Context) {
+	ticker := time.NewTicker(uploadSessionPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.purgeUploadSessions(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// initiateUploadHandler starts a multipart upload session, answering its id
+func (s *Server) initiateUploadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	filename := sanitize(vars["filename"])
+
+	if r.Header.Get("X-Encrypt-Password") != "" {
+		http.Error(w, "Encryption is not supported for multipart uploads", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.checkStorageSpace(r.Context(), 0, true); err != nil {
+		s.storageSpaceError(w, err)
+		return
+	}
+
+	uploadToken, release, err := s.uploadToken(r)
+	if err != nil {
+		s.tokenError(w, err)
+		return
+	}
+
+	// the token stays reserved until the session is completed, aborted or expires
+	initiated := false
+	defer func() {
+		if !initiated {
+			release()
+		}
+	}()
+
+	// nothing is uploaded yet, only the client and the extension tell the content type
+	contentType := detectContentType(nil, vars["filename"], r.Header.Get("Content-Type"))
+
+	if err := s.uploadRule(r).check(filename, contentType, nil); err != nil {
+		s.policyError(w, err)
+		return
+	}
+
+	session := &uploadSession{
+		ID:          token(32),
+		Token:       uploadToken,
+		Filename:    filename,
+		ContentType: contentType,
+		Created:     time.Now(),
+	}
+
+	if session.Metadata, err = s.metadataForRequest(contentType, 0, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.scanAfterStoring(r) {
+		session.Metadata.ScanStatus = scanStatusPending
+	}
+
+	if uploader, ok := s.multipartUploader(); ok {
+		// metadata too large for the object is written to a sidecar on completion
+		objectMetadata, err := session.Metadata.objectMetadata()
+		if err != nil && err != errMetadataTooLarge {
+			http.Error(w, "Could not encode metadata", http.StatusInternalServerError)
+			return
+		}
+
+		session.StorageUploadID, err = uploader.InitiateMultipart(r.Context(), session.Token, session.Filename, contentType, objectMetadata)
+		if isStorageUnavailable(err) {
+			s.storageUnavailableError(w, err)
+			return
+		} else if err != nil {
+			s.logger.Printf("Error initiating multipart upload: %s", err.Error())
+			http.Error(w, "Could not initiate upload", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := s.saveUploadSession(session); err != nil {
+		s.logger.Printf("Error saving upload session: %s", err.Error())
+		s.removeUploadSession(r.Context(), session, true)
+		http.Error(w, "Could not initiate upload", http.StatusInternalServerError)
+		return
+	}
+
+	initiated = true
+
+	s.logger.Printf("Initiated multipart upload %s for %s %s", session.ID, session.Token, filename)
+
+	w.Header().Set("Content-Type", "text/plain")
+	setLimitHeaders(w, session.Metadata)
+	_, _ = w.Write([]byte(session.ID))
+}
+
+// uploadPartHandler saves a numbered part of an upload session, answering its ETag
+func (s *Server) uploadPartHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	defer storage.CloseCheck(r.Body)
+
+	session, err := s.loadUploadSession(vars["uploadID"])
+	if err == errUploadSessionNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error loading upload session: %s", err.Error())
+		http.Error(w, "Could not load upload session", http.StatusInternalServerError)
+		return
+	}
+
+	number, err := strconv.Atoi(vars["partNumber"])
+	if err != nil || number < 1 || number > maxUploadParts {
+		http.Error(w, fmt.Sprintf("Part number must be between 1 and %d", maxUploadParts), http.StatusBadRequest)
+		return
+	}
+
+	if s.maxUploadSize > 0 && r.ContentLength > s.maxUploadSize {
+		s.logger.Print("Entity too large")
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	contentLength := r.ContentLength
+	if contentLength < 0 {
+		contentLength = 0
+	}
+
+	if err = s.checkStorageSpace(r.Context(), contentLength, true); err != nil {
+		s.storageSpaceError(w, err)
+		return
+	}
+
+	// parts are spooled in the session, the storage needs a seekable part with a known length
+	file, err := os.CreateTemp(s.uploadSessionDir(session.ID), ".part-")
+	if err != nil {
+		s.logger.Printf("%s", err.Error())
+		http.Error(w, "Could not save part", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}()
+
+	hash := md5.New()
+	n, err := io.Copy(io.MultiWriter(file, hash), r.Body)
+	if err != nil {
+		s.logger.Printf("%s", err.Error())
+		http.Error(w, "Could not save part", http.StatusInternalServerError)
+		return
+	}
+
+	if s.maxUploadSize > 0 && n > s.maxUploadSize {
+		s.logger.Print("Entity too large")
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if n == 0 {
+		http.Error(w, "Could not upload empty part", http.StatusBadRequest)
+		return
+	}
+
+	etag := hex.EncodeToString(hash.Sum(nil))
+
+	if uploader, ok := storage.Capability[storage.MultipartUploader](s.storage); ok && session.StorageUploadID != "" {
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "Cannot reset cache file", http.StatusInternalServerError)
+			return
+		}
+
+		etag, err = uploader.PutPart(r.Context(), session.Token, session.Filename, session.StorageUploadID, number, file, uint64(n))
+		if isStorageUnavailable(err) {
+			s.storageUnavailableError(w, err)
+			return
+		} else if err != nil {
+			s.logger.Printf("Error uploading part %d of %s: %s", number, session.ID, err.Error())
+			http.Error(w, "Could not save part", http.StatusInternalServerError)
+			return
+		}
+	} else if err = os.Rename(file.Name(), s.partPath(session, number, etag)); err != nil {
+		s.logger.Printf("%s", err.Error())
+		http.Error(w, "Could not save part", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(etag))
+}
+
+// partPath returns where a locally kept part is stored. The ETag is part of the name,
+// so a part uploaded again doesn't race with the previous upload of the same number.
+func (s *Server) partPath(session *uploadSession, number int, etag string) string {
+	return filepath.Join(s.uploadSessionDir(session.ID), fmt.Sprintf("part-%05d-%s", number, etag))
+}
+
+// parseParts reads a part list, one "<part number> <etag>" per line, in ascending order
+func parseParts(r io.Reader) ([]storage.Part, error) {
+	var parts []storage.Part
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid part %q", line)
+		}
+
+		number, err := strconv.Atoi(fields[0])
+		if err != nil || number < 1 || number > maxUploadParts {
+			return nil, fmt.Errorf("invalid part number %q", fields[0])
+		}
+
+		if len(parts) > 0 && number <= parts[len(parts)-1].Number {
+			return nil, errors.New("parts must be listed in ascending order")
+		}
+
+		parts = append(parts, storage.Part{Number: number, ETag: fields[1]})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 0 {
+		return nil, errors.New("no parts listed")
+	}
+
+	return parts, nil
+}
+
+// completeUploadHandler assembles an upload session from the listed parts and
+// registers the file like putHandler does
+func (s *Server) completeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	defer storage.CloseCheck(r.Body)
+
+	// guard against concurrent completions of the same session
+	s.lock("uploads", vars["uploadID"])
+	defer s.unlock("uploads", vars["uploadID"])
+
+	session, err := s.loadUploadSession(vars["uploadID"])
+	if err == errUploadSessionNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error loading upload session: %s", err.Error())
+		http.Error(w, "Could not load upload session", http.StatusInternalServerError)
+		return
+	}
+
+	parts, err := parseParts(io.LimitReader(r.Body, 1024*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if session.StorageUploadID != "" {
+		err = s.completeStorageUpload(r.Context(), session, parts)
+	} else {
+		err = s.completeLocalUpload(r.Context(), session, parts, s.uploadRule(r))
+	}
+
+	if status, ok := err.(uploadError); ok {
+		http.Error(w, status.message, status.code)
+		return
+	} else if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if errors.Is(err, storage.ErrInsufficientStorage) {
+		s.storageSpaceError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error completing upload %s: %s", session.ID, err.Error())
+		http.Error(w, "Could not save file", http.StatusInternalServerError)
+		return
+	}
+
+	s.removeUploadSession(r.Context(), session, false)
+
+	if session.Metadata.ScanStatus == scanStatusPending {
+		s.enqueueScan(session.Token, session.Filename)
+	}
+
+	s.logger.Printf("Completed multipart upload %s for %s %s", session.ID, session.Token, session.Filename)
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	filename := url.PathEscape(session.Filename)
+	relativeURL, _ := url.Parse(path.Join(s.proxyPath, session.Token, filename))
+	deleteURL, _ := url.Parse(path.Join(s.proxyPath, session.Token, filename, session.Metadata.DeletionToken))
+
+	w.Header().Set("X-Url-Delete", resolveURL(r, deleteURL, s.proxyPort))
+	setLimitHeaders(w, session.Metadata)
+
+	_, _ = w.Write([]byte(resolveURL(r, relativeURL, s.proxyPort)))
+}
+
+// uploadError is a completion failure caused by the client
+type uploadError struct {
+	code    int
+	message string
+}
+
+func (e uploadError) Error() string {
+	return e.message
+}
+
+// policyUploadError turns a policy violation into a completion failure caused by the client
+func policyUploadError(err error) error {
+	if errors.Is(err, errPolicyViolation) {
+		return uploadError{http.StatusUnsupportedMediaType, "Unsupported Media Type, " + err.Error()}
+	}
+
+	return err
+}
+
+// completeStorageUpload completes a multipart upload natively assembled by the storage
+func (s *Server) completeStorageUpload(ctx context.Context, session *uploadSession, parts []storage.Part) error {
+	uploader, ok := storage.Capability[storage.MultipartUploader](s.storage)
+	if !ok {
+		return errors.New("storage does not support multipart uploads")
+	}
+
+	if err := uploader.CompleteMultipart(ctx, session.Token, session.Filename, session.StorageUploadID, parts); err != nil {
+		return err
+	}
+
+	contentLength, err := s.storage.Head(ctx, session.Token, session.Filename)
+	if err != nil {
+		return err
+	}
+
+	if s.maxUploadSize > 0 && contentLength > uint64(s.maxUploadSize) {
+		s.logger.Print("Entity too large")
+		if err = s.storage.Delete(ctx, session.Token, session.Filename); err != nil {
+			s.logger.Printf("Error deleting oversized upload %s: %s", session.ID, err.Error())
+		}
+
+		return uploadError{http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge)}
+	}
+
+	// the size is only known once the parts are assembled, it goes with the mutable fields
+	// not to copy the object for updating the metadata set on initiation
+	m := session.Metadata
+	m.ContentLength = int64(contentLength)
+
+	_, ok = storage.Capability[storage.MetadataStorage](s.storage)
+	if _, err = session.Metadata.objectMetadata(); !ok || err == errMetadataTooLarge {
+		m.sidecar = true
+		return s.writeMetadata(ctx, session.Token, session.Filename, m)
+	} else if err != nil {
+		return errors.New("could not encode metadata")
+	}
+
+	return s.writeSidecar(ctx, session.Token, session.Filename, m.mutable())
+}
+
+// partsReader reads the concatenated parts without moving their offsets
+func partsReader(files []*os.File) io.Reader {
+	readers := make([]io.Reader, 0, len(files))
+	for _, f := range files {
+		readers = append(readers, io.NewSectionReader(f, 0, 1<<62))
+	}
+
+	return io.MultiReader(readers...)
+}
+
+// completeLocalUpload concatenates the locally kept parts into the storage
+func (s *Server) completeLocalUpload(ctx context.Context, session *uploadSession, parts []storage.Part, rule UploadRule) error {
+	var contentLength int64
+	files := make([]*os.File, 0, len(parts))
+	defer func() {
+		for _, f := range files {
+			storage.CloseCheck(f)
+		}
+	}()
+
+	for _, part := range parts {
+		f, err := os.Open(s.partPath(session, part.Number, strings.Trim(part.ETag, `"`)))
+		if os.IsNotExist(err) {
+			return uploadError{http.StatusBadRequest, fmt.Sprintf("Part %d with ETag %s not found", part.Number, part.ETag)}
+		} else if err != nil {
+			return err
+		}
+		files = append(files, f)
+
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		contentLength += fi.Size()
+	}
+
+	if s.maxUploadSize > 0 && contentLength > s.maxUploadSize {
+		s.logger.Print("Entity too large")
+		return uploadError{http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge)}
+	}
+
+	readers := make([]io.Reader, 0, len(files))
+	for _, f := range files {
+		readers = append(readers, f)
+	}
+	reader := io.MultiReader(readers...)
+
+	head, _, err := readHead(files[0])
+	if err != nil {
+		return err
+	}
+
+	contentType := detectContentType(head, session.Filename, session.ContentType)
+
+	if err = rule.check(session.Filename, contentType, head); err != nil {
+		return policyUploadError(err)
+	}
+
+	if err = s.blockUpload(partsReader(files)); errors.Is(err, errBlockedHash) {
+		s.logger.Printf("Upload rejected: %s", err.Error())
+		return uploadError{http.StatusForbidden, "File is blocked"}
+	} else if err != nil {
+		return err
+	}
+
+	m := session.Metadata
+	m.ContentLength = contentLength
+	m.ContentType = strings.ToLower(contentType)
+
+	// sessions quarantined once stored were initiated pending
+	prescan := len(s.scanners) > 0 && m.ScanStatus != scanStatusPending
+
+	if prescan || rule.inspectsArchive(head) {
+		if err := s.checkStorageSpace(ctx, contentLength, true); err != nil {
+			return err
+		}
+
+		file, err := os.CreateTemp(s.tempPath, "transfer-")
+		defer s.cleanTmpFile(file)
+		if err != nil {
+			return err
+		}
+
+		if prescan {
+			_, m.ScanStatus, m.ScanResults, err = s.copyAndScan(ctx, file, reader)
+		} else {
+			_, err = io.Copy(file, reader)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		if rule.inspectsArchive(head) {
+			if err = rule.checkArchive(file, head); err != nil {
+				return policyUploadError(err)
+			}
+		}
+
+		if prescan {
+			if m.ScanStatus == scanStatusInfected {
+				result := infectedResult(m.ScanResults)
+				s.logger.Printf("prescan positive: %s %s", result.Scanner, result.Detection)
+				return uploadError{http.StatusPreconditionFailed, fmt.Sprintf("Scan found a virus: %s", result.Detection)}
+			} else if m.ScanStatus != scanStatusClean {
+				return errors.New("could not perform prescan")
+			}
+		}
+
+		reader = file
+	}
+
+	if err := s.checkStorageSpace(ctx, contentLength, false); err != nil {
+		return err
+	}
+
+	s.logger.Printf("Uploading %s %s %d %s", session.Token, session.Filename, contentLength, contentType)
+
+	return s.putWithMetadata(ctx, session.Token, session.Filename, reader, contentType, uint64(contentLength), m)
+}
+
+// abortUploadHandler discards an upload session and its parts
+func (s *Server) abortUploadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	session, err := s.loadUploadSession(vars["uploadID"])
+	if err == errUploadSessionNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error loading upload session: %s", err.Error())
+		http.Error(w, "Could not load upload session", http.StatusInternalServerError)
+		return
+	}
+
+	s.removeUploadSession(r.Context(), session, true)
+
+	w.WriteHeader(http.StatusNoContent)
+}
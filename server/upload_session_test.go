@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+// multipartStorage is a storage keeping metadata on objects, assembling multipart uploads in memory
+type multipartStorage struct {
+	*objectMetadataStorage
+	parts map[string][][]byte
+}
+
+func (m *multipartStorage) InitiateMultipart(_ context.Context, token string, filename string, _ string, metadata map[string]string) (string, error) {
+	m.metadata[token+"/"+filename] = metadata
+	m.parts[token+"/"+filename] = nil
+	return token + "/" + filename, nil
+}
+
+func (m *multipartStorage) PutPart(_ context.Context, _ string, _ string, uploadID string, _ int, reader io.ReadSeeker, _ uint64) (string, error) {
+	data, err := io.ReadAll(reader)
+	m.parts[uploadID] = append(m.parts[uploadID], data)
+	return fmt.Sprintf("etag-%d", len(m.parts[uploadID])), err
+}
+
+func (m *multipartStorage) CompleteMultipart(ctx context.Context, token string, filename string, uploadID string, _ []storage.Part) error {
+	data := bytes.Join(m.parts[uploadID], nil)
+	return m.Put(ctx, token, filename, bytes.NewReader(data), "application/octet-stream", uint64(len(data)))
+}
+
+func (m *multipartStorage) AbortMultipart(_ context.Context, _ string, _ string, uploadID string) error {
+	delete(m.parts, uploadID)
+	return nil
+}
+
+type suiteUploadSession struct {
+	srvr    *Server
+	storage *multipartStorage
+}
+
+func (s *suiteUploadSession) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	s.storage = &multipartStorage{
+		objectMetadataStorage: &objectMetadataStorage{LocalStorage: local, metadata: map[string]map[string]string{}},
+		parts:                 map[string][][]byte{},
+	}
+
+	s.srvr, err = New(UseStorage(s.storage), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10))
+	c.Assert(err, IsNil)
+}
+
+func (s *suiteUploadSession) serve(handler http.HandlerFunc, method string, vars map[string]string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://test/uploads", strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, mux.SetURLVars(req, vars))
+
+	return w
+}
+
+func (s *suiteUploadSession) initiate(token string) *httptest.ResponseRecorder {
+	return s.serve(s.srvr.initiateUploadHandler, "POST", map[string]string{"filename": "hello.txt"}, "", map[string]string{"X-Vanity-Token": token})
+}
+
+func (s *suiteUploadSession) TestTokenReservedUntilAborted(c *C) {
+	w := s.initiate("session")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	uploadID := w.Body.String()
+
+	c.Assert(s.initiate("session").Code, Equals, http.StatusConflict)
+
+	c.Assert(s.serve(s.srvr.abortUploadHandler, "DELETE", map[string]string{"uploadID": uploadID}, "", nil).Code, Equals, http.StatusNoContent)
+	c.Assert(s.initiate("session").Code, Equals, http.StatusOK)
+}
+
+func (s *suiteUploadSession) TestCompleteKeepsObjectMetadata(c *C) {
+	w := s.initiate("session")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	uploadID := w.Body.String()
+
+	for i, part := range []string{"hello ", "world"} {
+		w = s.serve(s.srvr.uploadPartHandler, "PUT", map[string]string{"uploadID": uploadID, "partNumber": fmt.Sprint(i + 1)}, part, nil)
+		c.Assert(w.Code, Equals, http.StatusOK)
+	}
+
+	w = s.serve(s.srvr.completeUploadHandler, "POST", map[string]string{"uploadID": uploadID}, "1 etag-1\n2 etag-2\n", nil)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	c.Assert(s.storage.updates, Equals, 0)
+
+	m, err := s.srvr.readMetadata(context.Background(), "session", "hello.txt")
+	c.Assert(err, IsNil)
+	c.Assert(m.ContentLength, Equals, int64(11))
+
+	// the token is released on completion, the stored file keeps it taken
+	c.Assert(s.initiate("session").Code, Equals, http.StatusConflict)
+}
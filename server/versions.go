@@ -0,0 +1,324 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2020- Andrea Spacca and Stefan Benten.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+// fileVersion describes a previous version of a file, kept in a hidden object
+type fileVersion struct {
+	Version              int
+	ContentType          string
+	ContentLength        int64
+	Encrypted            bool
+	DecryptedContentType string
+	Uploaded             time.Time
+	ScanStatus           string
+	ScanResults          []scanResult
+	SHA256               string
+}
+
+// versionStats is what the owner of a file sees of its previous versions
+type versionStats struct {
+	Version       int        `json:"version"`
+	ContentType   string     `json:"content_type"`
+	ContentLength int64      `json:"content_length"`
+	Uploaded      *time.Time `json:"uploaded,omitempty"`
+}
+
+// errVersionNotFound is returned for versions of a file which are not kept
+var errVersionNotFound = errors.New("version not found")
+
+// versionObject is the name of the object keeping a previous version of filename.
+// Like sidecars it ends in .metadata, so it is neither listed nor served directly, and
+// as sanitize never names files "*.metadata" it is not the sidecar of another file.
+func versionObject(filename string, version int) string {
+	return fmt.Sprintf("%s.v%d.metadata.metadata", filename, version)
+}
+
+// currentVersion returns the version of the current content, files uploaded before
+// versioning being version 1
+func (m metadata) currentVersion() int {
+	if m.Version == 0 {
+		return 1
+	}
+
+	return m.Version
+}
+
+// asVersion describes the current content as a previous version
+func (m metadata) asVersion() fileVersion {
+	return fileVersion{
+		Version:              m.currentVersion(),
+		ContentType:          m.ContentType,
+		ContentLength:        m.ContentLength,
+		Encrypted:            m.Encrypted,
+		DecryptedContentType: m.DecryptedContentType,
+		Uploaded:             m.Uploaded,
+		ScanStatus:           m.ScanStatus,
+		ScanResults:          m.ScanResults,
+		SHA256:               m.SHA256,
+	}
+}
+
+// withVersion returns m describing the content of v instead of the current one, along
+// with the scans of that content
+func (m metadata) withVersion(v fileVersion) metadata {
+	m.Version = v.Version
+	m.ContentType = v.ContentType
+	m.ContentLength = v.ContentLength
+	m.Encrypted = v.Encrypted
+	m.DecryptedContentType = v.DecryptedContentType
+	m.ScanStatus = v.ScanStatus
+	m.ScanResults = v.ScanResults
+	m.SHA256 = v.SHA256
+	m.VirusTotal = nil
+
+	return m
+}
+
+// requestedVersion returns the object holding the version of filename requested, as
+// with ?version=N, the current one when empty, along with its metadata
+func (m metadata) requestedVersion(filename, requested string) (string, metadata, error) {
+	if requested == "" {
+		return filename, m, nil
+	}
+
+	version, err := strconv.Atoi(requested)
+	if err != nil {
+		return "", m, errVersionNotFound
+	} else if version == m.currentVersion() {
+		return filename, m, nil
+	}
+
+	for _, v := range m.Versions {
+		if v.Version == version {
+			return versionObject(filename, version), m.withVersion(v), nil
+		}
+	}
+
+	return "", m, errVersionNotFound
+}
+
+// storeVersion stores an upload, described by upload, as the new current version of
+// an existing file, keeping its limits and downloads
+func (s *Server) storeVersion(ctx context.Context, token, filename string, reader io.Reader, contentType string, contentLength uint64, upload metadata) (metadata, error) {
+	s.lock(token, filename)
+	defer s.unlock(token, filename)
+
+	current, err := s.readMetadata(ctx, token, filename)
+	if err != nil {
+		return upload, err
+	}
+
+	next := current.withVersion(upload.asVersion())
+	next.Uploaded = upload.Uploaded
+
+	return s.replaceContent(ctx, token, filename, reader, contentType, contentLength, current, next)
+}
+
+// replaceContent makes the content read from reader, described by next, the current
+// version of the file, keeping the current content as a previous version. The caller
+// holds the lock of the file.
+func (s *Server) replaceContent(ctx context.Context, token, filename string, reader io.Reader, contentType string, contentLength uint64, current, next metadata) (metadata, error) {
+	if current.held() {
+		return next, storage.ErrLegalHold
+	}
+
+	next.Version = current.currentVersion() + 1
+	next.Versions = append([]fileVersion(nil), current.Versions...)
+	next.VirusTotal = nil
+
+	if s.keepVersions > 0 {
+		if err := s.copyObject(ctx, token, filename, versionObject(filename, current.currentVersion())); err != nil {
+			return next, err
+		}
+
+		next.Versions = append(next.Versions, current.asVersion())
+	}
+
+	var dropped []fileVersion
+	if excess := len(next.Versions) - s.keepVersions; excess > 0 {
+		dropped, next.Versions = next.Versions[:excess], next.Versions[excess:]
+	}
+
+	if err := s.putWithMetadata(ctx, token, filename, reader, contentType, contentLength, next); err != nil {
+		return next, err
+	}
+
+	for _, v := range dropped {
+		if err := s.storage.Delete(ctx, token, versionObject(filename, v.Version)); err != nil && !s.storage.IsNotExist(err) {
+			s.logger.Printf("Error deleting version %d of %s/%s: %s", v.Version, token, filename, err.Error())
+		}
+	}
+
+	return next, nil
+}
+
+// copyObject copies the content of an object of token to another one
+func (s *Server) copyObject(ctx context.Context, token, from, to string) error {
+	reader, contentLength, err := s.storage.Get(ctx, token, from, nil)
+	defer storage.CloseCheck(reader)
+
+	if err != nil {
+		return err
+	}
+
+	return s.storage.Put(ctx, token, to, reader, "application/octet-stream", contentLength)
+}
+
+// deleteFile deletes a file along with its previous versions and drops it from its collection
+func (s *Server) deleteFile(ctx context.Context, token, filename string) error {
+	if m, err := s.readMetadata(ctx, token, filename); err == nil {
+		if m.held() {
+			return storage.ErrLegalHold
+		}
+
+		for _, v := range m.Versions {
+			if err := s.storage.Delete(ctx, token, versionObject(filename, v.Version)); err != nil && !s.storage.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	if err := s.storage.Delete(ctx, token, filename); err != nil {
+		return err
+	}
+
+	if err := s.removeFromCollection(ctx, token, filename); err != nil {
+		s.logger.Printf("Error removing %s/%s from collection: %s", token, filename, err.Error())
+	}
+
+	return nil
+}
+
+// versionHandler lets the owner of a file, authorized by its deletion token, upload
+// a new version of it
+func (s *Server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	token := vars["token"]
+	filename := vars["filename"]
+
+	defer storage.CloseCheck(r.Body)
+
+	if err := s.checkDeletionToken(r.Context(), vars["deletionToken"], token, filename); isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	s.storeUpload(w, r, token, filename, r.Body, r.Header.Get("Content-Type"), r.ContentLength, true)
+}
+
+// rollbackHandler lets the owner of a file, authorized by its deletion token, restore
+// a previous version, by default the last one, as a new version
+func (s *Server) rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	token := vars["token"]
+	filename := vars["filename"]
+
+	if err := s.checkDeletionToken(r.Context(), vars["deletionToken"], token, filename); isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	s.lock(token, filename)
+	defer s.unlock(token, filename)
+
+	current, err := s.readMetadata(r.Context(), token, filename)
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	requested := r.URL.Query().Get("version")
+	if requested == "" && len(current.Versions) > 0 {
+		requested = strconv.Itoa(current.Versions[len(current.Versions)-1].Version)
+	}
+
+	object, target, err := current.requestedVersion(filename, requested)
+	if err != nil || object == filename {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	} else if s.scanStatusError(w, target.scanError()) {
+		return
+	}
+
+	reader, contentLength, err := s.storage.Get(r.Context(), token, object, nil)
+	defer storage.CloseCheck(reader)
+
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error reading version %d of %s/%s: %s", target.Version, token, filename, err.Error())
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	target.Uploaded = time.Now().UTC()
+
+	m, err := s.replaceContent(r.Context(), token, filename, reader, target.ContentType, contentLength, current, target)
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if legalHoldError(w, err) {
+		return
+	} else if err != nil {
+		s.logger.Printf("Error rolling back %s/%s: %s", token, filename, err.Error())
+		http.Error(w, "Could not roll back file", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Printf("Rolled back %s/%s to version %d as version %d", token, filename, target.Version, m.Version)
+
+	setLimitHeaders(w, m)
+	w.Header().Set("X-Version", strconv.Itoa(m.Version))
+	s.writeStats(w, filename, m)
+}
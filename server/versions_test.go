@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	web "github.com/dutchcoders/transfer.sh-web"
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+
+	"github.com/dutchcoders/transfer.sh/server/storage"
+)
+
+type suiteVersions struct {
+	srvr *Server
+	vars map[string]string
+}
+
+func (s *suiteVersions) SetUpSuite(c *C) {
+	// the download pages are parsed by Run, which handler tests do not call
+	for _, name := range []string{"download.html", "download.markdown.html"} {
+		if htmlTemplates.Lookup(name) != nil {
+			continue
+		}
+
+		page, err := web.Asset(web.Prefix + "/" + name)
+		c.Assert(err, IsNil)
+
+		_, err = htmlTemplates.New(name).Parse(withDownloadDetails(name, string(page)))
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *suiteVersions) SetUpTest(c *C) {
+	logger := log.New(io.Discard, "", 0)
+
+	local, err := storage.NewLocalStorage(c.MkDir(), 0, 0, 0, 0, logger)
+	c.Assert(err, IsNil)
+
+	s.srvr, err = New(UseStorage(local), Logger(logger), TempPath(c.MkDir()), RandomTokenLength(10), KeepVersions(5))
+	c.Assert(err, IsNil)
+
+	req := httptest.NewRequest("PUT", "http://test/hello.txt", strings.NewReader("one"))
+	w := httptest.NewRecorder()
+	s.srvr.putHandler(w, mux.SetURLVars(req, map[string]string{"filename": "hello.txt"}))
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	u, err := url.Parse(w.Header().Get("X-Url-Delete"))
+	c.Assert(err, IsNil)
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	c.Assert(parts, HasLen, 3)
+	s.vars = map[string]string{"token": parts[0], "filename": parts[1], "deletionToken": parts[2]}
+
+	// the uploaded content is version 1, "two" the current version 2
+	c.Assert(s.serve(s.srvr.versionHandler, "PUT", "", "two").Code, Equals, http.StatusOK)
+}
+
+func (s *suiteVersions) serve(handler http.HandlerFunc, method, query, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://test/"+s.vars["token"]+"/"+s.vars["filename"]+query, strings.NewReader(body))
+
+	w := httptest.NewRecorder()
+	handler(w, mux.SetURLVars(req, s.vars))
+
+	return w
+}
+
+func (s *suiteVersions) updateMetadata(c *C, update func(m *metadata)) {
+	m, err := s.srvr.readMetadata(context.Background(), s.vars["token"], s.vars["filename"])
+	c.Assert(err, IsNil)
+
+	update(&m)
+
+	c.Assert(s.srvr.writeMetadata(context.Background(), s.vars["token"], s.vars["filename"], m), IsNil)
+}
+
+func (s *suiteVersions) TestScanGating(c *C) {
+	s.updateMetadata(c, func(m *metadata) {
+		m.ScanStatus = scanStatusPending
+		m.Versions[0].ScanStatus = scanStatusClean
+	})
+
+	c.Assert(s.serve(s.srvr.getHandler, "GET", "", "").Code, Equals, http.StatusLocked)
+
+	w := s.serve(s.srvr.getHandler, "GET", "?version=1", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "one")
+
+	s.updateMetadata(c, func(m *metadata) {
+		m.ScanStatus = scanStatusClean
+		m.Versions[0].ScanStatus = scanStatusInfected
+	})
+
+	c.Assert(s.serve(s.srvr.getHandler, "GET", "?version=1", "").Code, Equals, http.StatusForbidden)
+	c.Assert(s.serve(s.srvr.headHandler, "HEAD", "?version=1", "").Code, Equals, http.StatusForbidden)
+	c.Assert(s.serve(s.srvr.rollbackHandler, "POST", "?version=1", "").Code, Equals, http.StatusForbidden)
+	c.Assert(s.serve(s.srvr.getHandler, "GET", "?version=7", "").Code, Equals, http.StatusNotFound)
+}
+
+func (s *suiteVersions) TestRollback(c *C) {
+	w := s.serve(s.srvr.rollbackHandler, "POST", "", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("X-Version"), Equals, "3")
+
+	c.Assert(s.serve(s.srvr.getHandler, "GET", "", "").Body.String(), Equals, "one")
+	c.Assert(s.serve(s.srvr.getHandler, "GET", "?version=2", "").Body.String(), Equals, "two")
+}
+
+func (s *suiteVersions) TestPreviewPreviousVersion(c *C) {
+	s.updateMetadata(c, func(m *metadata) {
+		m.ContentType = "text/plain"
+		m.ScanStatus = scanStatusPending
+		m.Versions[0].ContentType = "text/plain"
+		m.Versions[0].ScanStatus = scanStatusClean
+	})
+
+	c.Assert(s.serve(s.srvr.previewHandler, "GET", "", "").Code, Equals, http.StatusLocked)
+
+	w := s.serve(s.srvr.previewHandler, "GET", "?version=1", "")
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	c.Assert(w.Body.String(), Matches, "(?s).*<pre>one.*")
+	c.Assert(w.Body.String(), Not(Matches), "(?s).*<pre>two.*")
+	c.Assert(w.Body.String(), Matches, `(?s).*/hello\.txt\?version=1.*`)
+}
@@ -25,9 +25,16 @@ THE SOFTWARE.
 package server
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"time"
 
+	"github.com/dutchcoders/transfer.sh/server/storage"
 	"github.com/gorilla/mux"
 
 	"github.com/Aetherinox/go-virustotal"
@@ -46,6 +53,7 @@ func (s *Server) virusTotalHandler(w http.ResponseWriter, r *http.Request) {
 	vt, err := virustotal.NewVirusTotal(s.VirusTotalKey)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	reader := r.Body
@@ -53,8 +61,296 @@ func (s *Server) virusTotalHandler(w http.ResponseWriter, r *http.Request) {
 	result, err := vt.Scan(filename, reader)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	s.logger.Println(result)
 	_, _ = w.Write([]byte(fmt.Sprintf("%v\n", result.Permalink)))
 }
+
+const (
+	// virusTotalPollInterval spaces the lookups of a file while VirusTotal analyses it,
+	// within the rate limit of the public API
+	virusTotalPollInterval = 30 * time.Second
+	// virusTotalCheckTimeout bounds the time waiting for the analysis of a file
+	virusTotalCheckTimeout = 20 * time.Minute
+)
+
+// virusTotalVerdict is the outcome of the last VirusTotal check of a stored file
+type virusTotalVerdict struct {
+	// Status is pending, clean, infected or error
+	Status    string
+	SHA256    string
+	Positives int
+	Total     int
+	Permalink string
+	Time      time.Time
+}
+
+// detections formats the number of engines detecting the file, as in 3/70
+func (v virusTotalVerdict) detections() string {
+	return fmt.Sprintf("%d/%d", v.Positives, v.Total)
+}
+
+// setVirusTotalHeaders exposes the VirusTotal verdict of a file
+func setVirusTotalHeaders(w http.ResponseWriter, m metadata) {
+	if m.VirusTotal == nil {
+		return
+	}
+
+	w.Header().Set("X-VirusTotal-Verdict", m.VirusTotal.Status)
+	if m.VirusTotal.Status == scanStatusClean || m.VirusTotal.Status == scanStatusInfected {
+		w.Header().Set("X-VirusTotal-Detections", m.VirusTotal.detections())
+		w.Header().Set("X-VirusTotal-Permalink", m.VirusTotal.Permalink)
+	}
+}
+
+// virusTotalCheckHandler looks a stored file up on VirusTotal by its SHA-256,
+// submitting it when unknown, and records the verdict in its metadata once available
+func (s *Server) virusTotalCheckHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	token := vars["token"]
+	filename := vars["filename"]
+
+	if s.VirusTotalKey == "" {
+		http.Error(w, "VirusTotal not configured", http.StatusNotImplemented)
+		return
+	}
+
+	if err := s.checkDeletionToken(r.Context(), vars["deletionToken"], token, filename); isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	s.lock(token, filename)
+	defer s.unlock(token, filename)
+
+	m, err := s.readMetadata(r.Context(), token, filename)
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if m.Encrypted {
+		http.Error(w, "Encrypted files cannot be checked", http.StatusBadRequest)
+		return
+	}
+
+	if m.VirusTotal != nil && m.VirusTotal.Status == scanStatusPending && time.Since(m.VirusTotal.Time) < virusTotalCheckTimeout {
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = fmt.Fprintln(w, scanStatusPending)
+		return
+	}
+
+	// files uploaded before hashes were recorded are hashed from the storage
+	hash := m.SHA256
+	if hash == "" {
+		hash, err = s.storedFileHash(r.Context(), token, filename)
+	}
+
+	if isStorageUnavailable(err) {
+		s.storageUnavailableError(w, err)
+		return
+	} else if err != nil {
+		s.logger.Printf("%s", err.Error())
+		http.Error(w, "Could not read file", http.StatusInternalServerError)
+		return
+	}
+
+	m.VirusTotal = &virusTotalVerdict{Status: scanStatusPending, SHA256: hash, Time: time.Now().UTC()}
+	if err = s.writeMetadata(r.Context(), token, filename, m); err != nil {
+		s.logger.Printf("Error recording VirusTotal check of %s/%s: %s", token, filename, err.Error())
+		http.Error(w, "Could not check file", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Printf("Checking %s/%s on VirusTotal: %s", token, filename, hash)
+
+	go s.checkVirusTotal(token, filename, hash)
+
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = fmt.Fprintln(w, scanStatusPending)
+}
+
+// storedFileHash returns the hex encoded SHA-256 of a stored file
+func (s *Server) storedFileHash(ctx context.Context, token, filename string) (string, error) {
+	reader, _, err := s.storage.Get(ctx, token, filename, nil)
+	if err != nil {
+		return "", err
+	}
+	defer storage.CloseCheck(reader)
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkVirusTotal looks up the file with the given hash, submits it when unknown to
+// VirusTotal, polls until its analysis is complete and records the verdict
+func (s *Server) checkVirusTotal(token, filename, hash string) {
+	ctx, cancel := context.WithTimeout(context.Background(), virusTotalCheckTimeout)
+	defer cancel()
+
+	verdict := virusTotalVerdict{Status: scanStatusError, SHA256: hash}
+
+	report, err := s.lookupVirusTotal(ctx, token, filename, hash)
+	if err != nil {
+		s.logger.Printf("Error checking %s/%s on VirusTotal: %s", token, filename, err.Error())
+	} else {
+		verdict.Status = scanStatusClean
+		if report.Positives > 0 {
+			verdict.Status = scanStatusInfected
+		}
+
+		verdict.Positives = report.Positives
+		verdict.Total = report.Total
+		verdict.Permalink = report.Permalink
+	}
+
+	verdict.Time = time.Now().UTC()
+
+	s.lock(token, filename)
+	defer s.unlock(token, filename)
+
+	m, err := s.readMetadata(ctx, token, filename)
+	if err != nil {
+		s.logger.Printf("Error recording VirusTotal check of %s/%s: %s", token, filename, err.Error())
+		return
+	} else if m.VirusTotal == nil || m.VirusTotal.SHA256 != hash {
+		// a new version replaced the checked content meanwhile
+		s.logger.Printf("Discarding VirusTotal verdict of %s/%s, its content was replaced", token, filename)
+		return
+	}
+
+	m.VirusTotal = &verdict
+	if err = s.writeMetadata(ctx, token, filename, m); err != nil {
+		s.logger.Printf("Error recording VirusTotal check of %s/%s: %s", token, filename, err.Error())
+		return
+	}
+
+	s.logger.Printf("VirusTotal verdict of %s/%s: %s %s", token, filename, verdict.Status, verdict.detections())
+}
+
+// lookupVirusTotal returns the report of the file with the given hash, submitting it
+// first if VirusTotal does not know it
+func (s *Server) lookupVirusTotal(ctx context.Context, token, filename, hash string) (*virustotal.ReportResponse, error) {
+	vt, err := virustotal.NewVirusTotal(s.VirusTotalKey)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := virusTotalReport(ctx, vt, hash)
+	if err != nil {
+		return nil, err
+	} else if report.ResponseCode == 1 {
+		return report, nil
+	}
+
+	reader, _, err := s.storage.Get(ctx, token, filename, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = vt.Scan(filename, reader)
+	storage.CloseCheck(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(virusTotalPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("virustotal analysis: %w", ctx.Err())
+		}
+
+		// the report stays unknown or queued while the analysis is running
+		if report, err = virusTotalReport(ctx, vt, hash); err != nil {
+			return nil, err
+		} else if report.ResponseCode == 1 {
+			return report, nil
+		}
+	}
+}
+
+// virusTotalReport gets the report of resource, giving up when ctx is done
+func virusTotalReport(ctx context.Context, vt *virustotal.VirusTotal, resource string) (*virustotal.ReportResponse, error) {
+	type reportResult struct {
+		report *virustotal.ReportResponse
+		err    error
+	}
+
+	resultCh := make(chan reportResult, 1)
+	go func() {
+		report, err := vt.Report(resource)
+		resultCh <- reportResult{report, err}
+	}()
+
+	select {
+	case result := <-resultCh:
+		return result.report, result.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("virustotal lookup: %w", ctx.Err())
+	}
+}
+
+// virusTotalScanner looks files up on VirusTotal by their SHA-256, files unknown
+// to VirusTotal are considered clean
+type virusTotalScanner struct {
+	key string
+}
+
+// NewVirusTotalScanner returns a scanner looking files up on VirusTotal with the API key
+func NewVirusTotalScanner(key string) Scanner {
+	return virusTotalScanner{key: key}
+}
+
+// Name identifies the scanner in scan results
+func (v virusTotalScanner) Name() string {
+	return "virustotal"
+}
+
+// Scan looks the file at path up
+func (v virusTotalScanner) Scan(ctx context.Context, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	vt, err := virustotal.NewVirusTotal(v.key)
+	if err != nil {
+		return "", err
+	}
+
+	report, err := virusTotalReport(ctx, vt, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return "", err
+	}
+
+	if report.ResponseCode != 1 || report.Positives == 0 {
+		return "", nil
+	}
+
+	return fmt.Sprintf("%d/%d engines", report.Positives, report.Total), nil
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	web "github.com/dutchcoders/transfer.sh-web"
+)
+
+func TestDownloadPagesShowVirusTotalVerdict(t *testing.T) {
+	data := map[string]interface{}{
+		"Filename":      "hello.txt",
+		"ContentType":   "text/plain",
+		"ContentLength": uint64(5),
+		"Description":   "release notes",
+		"VirusTotal":    &virusTotalVerdict{Status: scanStatusInfected, Positives: 3, Total: 70, Permalink: "https://www.virustotal.com/report"},
+	}
+
+	var pages int
+	for _, path := range web.AssetNames() {
+		if !strings.HasPrefix(stripPrefix(path), "download") || !strings.HasSuffix(path, ".html") {
+			continue
+		}
+
+		page, err := web.Asset(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		templates := initHTMLTemplates()
+		if _, err = templates.New(stripPrefix(path)).Parse(withDownloadDetails(path, string(page))); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+
+		var rendered bytes.Buffer
+		if err = templates.ExecuteTemplate(&rendered, stripPrefix(path), data); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+
+		for _, want := range []string{"release notes", "virustotal: <b>infected</b>, 3/70 engines", `href="https://www.virustotal.com/report"`} {
+			if !strings.Contains(rendered.String(), want) {
+				t.Errorf("%s does not show %q", path, want)
+			}
+		}
+
+		pages++
+	}
+
+	if pages == 0 {
+		t.Fatal("no bundled download page")
+	}
+}